@@ -7,11 +7,23 @@ import (
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"time"
 )
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+var adaptive = flag.Bool("adaptive", false, "adapt the topology level to the local entity density")
+var vertical = flag.Float64("vertical", 0, "maximum vertical distance in `meters` between neighbours (0 disables)")
+var floorHeight = flag.Float64("floor", 0, "bucket altitudes into floors of this height in `meters` (0 disables)")
+var kalman = flag.Bool("kalman", false, "smooth received locations with a Kalman filter")
+var udpAddr = flag.String("udp", "", "receive beacon datagrams on this `address` (empty disables)")
+var udpKey = flag.String("udpkey", "", "require beacon datagrams to carry an HMAC keyed by their token and this `key`")
+var mqttAddr = flag.String("mqtt", "", "bridge the devices of the MQTT broker at this `address` (empty disables)")
+var sosAcks = flag.Int("sosacks", 1, "number of acknowledgements that stop an SOS alert repeating")
+var sosRepeat = flag.Duration("sosrepeat", 30*time.Second, "interval at which an unacknowledged SOS alert repeats")
+var sosWebhooks = flag.String("soswebhooks", "", "comma separated `urls` notified of SOS alerts")
+var hysteresis = flag.Float64("hysteresis", 0, "distance in `meters` an entity must be inside a new cell before changing cell")
 
 func main() {
 
@@ -32,6 +44,16 @@ func main() {
 	rand.Seed(time.Now().Unix())
 
 	c := core.MakeConfig(250, 15)
+	c.SetHysteresisMeters(*hysteresis)
+	c.SetKalmanSmoothing(*kalman)
+	c.SetUDPBeacons(*udpAddr, []byte(*udpKey))
+	c.SetMQTTBroker(*mqttAddr)
+	c.SetSOS(*sosAcks, *sosRepeat, webhookURLs(*sosWebhooks))
+	c.SetVerticalThresholdMeters(*vertical)
+	c.SetFloorHeightMeters(*floorHeight)
+	if *adaptive {
+		c.SetAdaptiveScales(10, 1000)
+	}
 
 	// Create the topology with the given configuration and set
 	// the message channel.
@@ -72,3 +94,14 @@ func main() {
 		}
 	}
 }
+
+// Return the non empty urls of the comma separated list 'list'
+func webhookURLs(list string) []string {
+	urls := make([]string, 0)
+	for _, url := range strings.Split(list, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
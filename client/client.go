@@ -111,7 +111,7 @@ func main() {
 					fmt.Printf("Client Connected. Token=%s\n", uuid.UUID(tokenId).String())
 				}
 			} else {
-				loc.Timestamp = time.Now().Unix()
+				loc.SetTime(time.Now())
 				dataReqMsg := core.MakeDataRequestMsg(tokenId, loc)
 				_, err := dataReqMsg.Write(conn)
 				if err != nil {
@@ -8,11 +8,19 @@ type Activity struct {
 type UserData struct {
 	ClientId string   `json:"clientid"`
 	Location Location `json:"location"`
+
+	// The speed (meters/second) and course (degrees) estimated by the server
+	Speed  float64 `json:"speed"`
+	Course float64 `json:"course"`
 }
 
+// UserFilter selects the data a connection is subscribed to. The Action is
+// "add" or "remove" to change a single filter of the connection, otherwise
+// the filter replaces all current filters of the connection.
 type UserFilter struct {
-	Type  string `json:"filtertype"`
-	Value string `json:"filtervalue"`
+	Type   string `json:"filtertype"`
+	Value  string `json:"filtervalue"`
+	Action string `json:"action,omitempty"`
 }
 
 type CellActivity struct {
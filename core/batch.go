@@ -0,0 +1,196 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The largest number of locations in a batch
+	maxBatchBeacons = 1000
+
+	// The largest batch request body in bytes
+	maxBatchSize = maxBatchBeacons * 256
+
+	// The oldest location accepted in a batch
+	maxBatchAge = 7 * 24 * time.Hour
+)
+
+// BeaconResult reports whether a single location of a batch was accepted
+type BeaconResult struct {
+	Index    int    `json:"index"`
+	Accepted bool   `json:"accepted"`
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// BatchResponse is the response to a batch of beacons
+type BatchResponse struct {
+
+	// The number of locations accepted and rejected
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+
+	// True if the latest location was broadcast live
+	Live bool `json:"live"`
+
+	// The result of each location, in the order of the request
+	Results []BeaconResult `json:"results"`
+}
+
+// BeaconsHandler handles a batch of locations recorded by a client, such as
+// while it was offline. All valid locations are stored with their original
+// timestamps. Only the latest is broadcast live, if it is recent enough.
+// The response is 503 if the locations could not be stored, and a batch
+// may be retried as locations already stored are not stored again.
+// Headers:
+//    Content-Type: application/json
+// Request Body:
+//    [ <location>, <location>, ... ] (oldest first)
+func (endpoint *Endpoint) BeaconsHandler(w http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost {
+		// Beacon requests must be POST
+		return
+	}
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Get the entity associated with the token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Beacons: Failed to get entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ct := req.Header.Get("Content-Type")
+	if ct != "application/json" {
+		messageError(w, "Beacons: Not a valid JSON request (Content-Type)", http.StatusBadRequest)
+		return
+	}
+
+	var locs []Location
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBatchSize))
+	err = decoder.Decode(&locs)
+	if err != nil {
+		messageError(w, "Beacons: Invalid beacon locations: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(locs) == 0 || len(locs) > maxBatchBeacons {
+		messageError(w, "Beacons: Invalid number of locations", http.StatusBadRequest)
+		return
+	}
+
+	response, err := endpoint.processBatch(entity, locs)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		// The batch may be retried, as stored locations are not duplicated
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	js, _ := json.Marshal(&response)
+	w.Write(js)
+}
+
+//
+// Validate, store and broadcast the batch of locations 'locs' of the entity
+// 'entity'. Return the result of each location, and an error if the
+// accepted locations could not be stored, in which case they are reported
+// as not accepted.
+//
+func (endpoint *Endpoint) processBatch(entity *Entity, locs []Location) (BatchResponse, error) {
+
+	response := BatchResponse{Results: make([]BeaconResult, len(locs))}
+	accepted := make([]int, 0, len(locs))
+	now := time.Now()
+
+	// Keep the locations as received for broadcasting the latest live
+	received := make([]Location, len(locs))
+	copy(received, locs)
+
+	// Locations are validated against the previous accepted location,
+	// starting with the entity's location if it is older than the batch
+	var prev Location
+	for i := range locs {
+		loc := &locs[i]
+		response.Results[i].Index = i
+
+		if offset := entity.ClockOffset(); offset != 0 {
+			loc.RawMs = loc.UnixMilli()
+			loc.SetTime(loc.Time().Add(-offset))
+		}
+		if prev.Timestamp == 0 && entity.location.Time().Before(loc.Time()) {
+			prev = entity.location
+		}
+
+		var berr *beaconError
+		if loc.Time().After(now.Add(toleranceSec * time.Second)) {
+			berr = &beaconError{"not_synchronised", http.StatusBadRequest, "Location is in the future"}
+		} else if loc.Time().Before(now.Add(-maxBatchAge)) {
+			berr = &beaconError{"too_old", http.StatusBadRequest, "Location is too old"}
+		} else if err := endpoint.pipeline.validate(&prev, loc); err != nil {
+			berr = &beaconError{"location_rejected", http.StatusUnprocessableEntity, "Location rejected: " + err.Error()}
+		}
+		if berr != nil {
+			response.Results[i].Code = berr.code
+			response.Results[i].Error = berr.message
+			response.Rejected++
+			continue
+		}
+
+		response.Results[i].Accepted = true
+		response.Accepted++
+		prev = *loc
+		accepted = append(accepted, i)
+	}
+
+	// The latest location is broadcast live if it is recent, which also
+	// checks its plausibility and stores it
+	live := -1
+	if n := len(accepted); n > 0 && inSync(locs[accepted[n-1]].Time()) {
+		live = accepted[n-1]
+		accepted = accepted[:n-1]
+	}
+
+	// Flag implausible recorded locations without rejecting them
+	for _, i := range accepted {
+		flags := endpoint.ctx.GetTopology().CheckRecordedPlausibility(entity, locs[i])
+		endpoint.recordFlags(entity, flags)
+	}
+
+	if live >= 0 {
+		userData, berr := endpoint.processLocation(entity, received[live])
+		if berr == nil {
+			berr = endpoint.publishUserData(entity, userData, false)
+		}
+		if berr != nil {
+			log.Printf("Beacons: Failed to broadcast latest location: %s", berr.message)
+			accepted = append(accepted, live)
+		} else {
+			response.Live = true
+		}
+	}
+
+	if len(accepted) == 0 {
+		return response, nil
+	}
+	stored := make([]Location, len(accepted))
+	for j, i := range accepted {
+		stored[j] = locs[i]
+	}
+	err := endpoint.ctx.RecordLocations(entity, stored)
+	if err != nil {
+		log.Printf("Beacons: Failed to store locations: %v", err)
+		for _, i := range accepted {
+			response.Results[i] = BeaconResult{Index: i, Code: "store_failed", Error: "Failed to store location"}
+		}
+		response.Accepted -= len(accepted)
+		response.Rejected += len(accepted)
+	}
+	return response, err
+}
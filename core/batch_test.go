@@ -0,0 +1,142 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// batchContext records the locations stored, flags raised and broadcasts
+type batchContext struct {
+	Context
+	topology   *Topology
+	stored     [][]Location
+	flags      []PlausibilityFlag
+	broadcasts int
+	storeErr   error
+}
+
+func (ctx *batchContext) GetTopology() *Topology {
+	return ctx.topology
+}
+
+func (ctx *batchContext) RecordLocations(entity *Entity, locs []Location) error {
+	ctx.stored = append(ctx.stored, locs)
+	return ctx.storeErr
+}
+
+func (ctx *batchContext) RecordFlag(entity *Entity, flag PlausibilityFlag) error {
+	ctx.flags = append(ctx.flags, flag)
+	return nil
+}
+
+func (ctx *batchContext) Broadcast(entity *Entity, message []byte) error {
+	ctx.broadcasts++
+	return nil
+}
+
+// Return a context, endpoint and entity for processing batches
+func makeBatchTest() (*batchContext, *Endpoint, *Entity) {
+	topology := MakeTopology(MakeConfig(250, 15))
+	ctx := &batchContext{topology: &topology}
+	endpoint := MakeEndpoint(ctx)
+	entity := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), topology.MakeCell())
+	return ctx, &endpoint, entity
+}
+
+// Return 'n' locations walking north, 'step' apart from the time 'start'
+func makeBatchTrack(start time.Time, step time.Duration, n int) []Location {
+	locs := make([]Location, n)
+	for i := range locs {
+		locs[i] = MakeLocation(-34.9287+float64(i)*0.0001, 138.5999, 0, 0, 0)
+		locs[i].SetTime(start.Add(time.Duration(i) * step))
+	}
+	return locs
+}
+
+func TestProcessBatch(t *testing.T) {
+
+	ctx, endpoint, entity := makeBatchTest()
+
+	// Locations recorded an hour ago are stored, but not broadcast or
+	// flagged for arriving together
+	locs := makeBatchTrack(time.Now().Add(-time.Hour), 10*time.Second, 4)
+	locs[2].Lat = 100
+	response, err := endpoint.processBatch(entity, locs)
+	if err != nil {
+		t.Fatalf("processBatch: %v", err)
+	}
+	if response.Accepted != 3 || response.Rejected != 1 || response.Live {
+		t.Errorf("processBatch: %d accepted, %d rejected, live %v", response.Accepted, response.Rejected, response.Live)
+	}
+	if r := response.Results[2]; r.Accepted || r.Code != "location_rejected" || r.Index != 2 {
+		t.Errorf("processBatch: invalid location result %+v", r)
+	}
+	if len(ctx.stored) != 1 || len(ctx.stored[0]) != 3 || ctx.broadcasts != 0 {
+		t.Errorf("processBatch: stored %v, %d broadcasts", ctx.stored, ctx.broadcasts)
+	}
+	if len(ctx.flags) != 0 {
+		t.Errorf("processBatch: unexpected flags %+v", ctx.flags)
+	}
+
+	// The latest of recent locations is broadcast live and the rest stored
+	ctx.stored = nil
+	locs = makeBatchTrack(time.Now().Add(-2*time.Second), time.Second, 3)
+	response, err = endpoint.processBatch(entity, locs)
+	if err != nil || response.Accepted != 3 || !response.Live {
+		t.Fatalf("processBatch: %+v, %v", response, err)
+	}
+	if len(ctx.stored) != 1 || len(ctx.stored[0]) != 2 || ctx.broadcasts != 1 {
+		t.Errorf("processBatch: stored %v, %d broadcasts", ctx.stored, ctx.broadcasts)
+	}
+}
+
+func TestProcessBatchStoreFailure(t *testing.T) {
+
+	ctx, endpoint, entity := makeBatchTest()
+	ctx.storeErr = errors.New("Database is not connected.")
+
+	locs := makeBatchTrack(time.Now().Add(-time.Hour), 10*time.Second, 3)
+	response, err := endpoint.processBatch(entity, locs)
+	if err == nil {
+		t.Errorf("processBatch: expected the store to fail")
+	}
+	if response.Accepted != 0 || response.Rejected != 3 {
+		t.Errorf("processBatch: %d accepted, %d rejected", response.Accepted, response.Rejected)
+	}
+	for _, r := range response.Results {
+		if r.Accepted || r.Code != "store_failed" {
+			t.Errorf("processBatch: result %+v of a location not stored", r)
+		}
+	}
+}
+
+func TestProcessBatchPlausibility(t *testing.T) {
+
+	ctx, endpoint, entity := makeBatchTest()
+
+	// Accelerating from standing to 40 meters/second within a second
+	start := time.Now().Add(-time.Hour)
+	locs := makeBatchTrack(start, time.Second, 3)
+	locs[1] = locs[0]
+	locs[1].SetTime(start.Add(time.Second))
+	locs[2] = MakeLocation(locs[0].Lat+40/111320.0, locs[0].Lng, 0, 0, 0)
+	locs[2].SetTime(start.Add(2 * time.Second))
+
+	response, err := endpoint.processBatch(entity, locs)
+	if err != nil || response.Accepted != 3 {
+		t.Fatalf("processBatch: %+v, %v", response, err)
+	}
+	if len(ctx.flags) != 1 || ctx.flags[0].Type != flagAcceleration {
+		t.Errorf("processBatch: flags %+v, want an acceleration", ctx.flags)
+	}
+
+	// Recorded locations do not recover the trust of the client
+	score, _ := ctx.topology.GetTrust(entity.clientId)
+	endpoint.processBatch(entity, makeBatchTrack(start.Add(time.Minute), 10*time.Second, 10))
+	if after, _ := ctx.topology.GetTrust(entity.clientId); after != score {
+		t.Errorf("processBatch: trust recovered from %v to %v", score, after)
+	}
+}
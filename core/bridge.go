@@ -0,0 +1,307 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// The time to wait before reconnecting to the MQTT broker
+	mqttReconnect = 10 * time.Second
+
+	// The time a device is bridged without publishing anything
+	mqttIdleTimeout = 10 * time.Minute
+
+	// The period between checks for idle devices
+	mqttExpiryPeriod = time.Minute
+)
+
+// The topics published to by devices, below the token of the device
+var mqttDeviceTopics = []string{commandBeacon, commandStandby, "command"}
+
+//
+// MQTTBridge lets MQTT devices participate alongside HTTP and websocket
+// clients. Devices sync over HTTP, then publish to the topics
+//
+//    envisilab/{service}/{token}/beacon    a JSON location
+//    envisilab/{service}/{token}/standby   a JSON location
+//    envisilab/{service}/{token}/command   a command, as over the websocket
+//
+// and receive the events of their subscription on
+//
+//    envisilab/{service}/{token}/data
+//
+// where {token} is the token id of the device. The token identifies the
+// device, so messages to the topics of unknown tokens are ignored. A device
+// that publishes nothing for ten minutes is no longer bridged, so devices
+// that only receive publish a ping command.
+//
+// The traffic of cells and groups is delivered on the data topic of each
+// device, through the filters of its subscription and their permission
+// checks, not republished to topics of their own that any client of the
+// broker could read. The broker should only let the bridge subscribe to
+// wildcard topics, so that a data topic is only read by the device that
+// knows its token.
+//
+type MQTTBridge struct {
+
+	// The endpoint the devices' beacons and commands are given to
+	endpoint *Endpoint
+
+	// The topic prefix of the service, "envisilab/{service}/"
+	prefix string
+
+	// The current connection to the broker
+	client *mqttClient
+
+	// Map of entities to the connections of their devices
+	conns map[*Entity]*MQTTConnection
+
+	// A mutex for synchronising the bridge between threads
+	lock sync.Mutex
+}
+
+func MakeMQTTBridge(endpoint *Endpoint, service string) *MQTTBridge {
+	b := &MQTTBridge{
+		endpoint: endpoint,
+		prefix:   "envisilab/" + service + "/",
+		conns:    make(map[*Entity]*MQTTConnection),
+	}
+	return b
+}
+
+//
+// Connect to the broker at the address 'addr' and bridge its messages,
+// reconnecting whenever the connection fails.
+//
+func (b *MQTTBridge) Run(addr string) {
+
+	go b.expire()
+
+	for {
+		client, err := dialMQTT(addr, "envisilab-"+uuid.New().String()[:8])
+		for _, topic := range mqttDeviceTopics {
+			if err == nil {
+				err = client.Subscribe(b.prefix + "+/" + topic)
+			}
+		}
+		if err == nil {
+			log.Printf("MQTT Bridge connected to %s\n", addr)
+			b.lock.Lock()
+			b.client = client
+			b.lock.Unlock()
+			err = client.Run(b.handle)
+			client.Close()
+		}
+
+		log.Printf("MQTT Bridge disconnected: %v. Reconnecting in %v", err, mqttReconnect)
+		time.Sleep(mqttReconnect)
+	}
+}
+
+// Publish the payload 'payload' to the topic 'topic' if connected
+func (b *MQTTBridge) publish(topic string, payload []byte) {
+	b.lock.Lock()
+	client := b.client
+	b.lock.Unlock()
+	if client == nil {
+		return
+	}
+	err := client.Publish(topic, payload)
+	if err != nil {
+		log.Printf("MQTT Bridge: failed to publish to %s: %v", topic, err)
+	}
+}
+
+// Handle the message 'payload' published by a device to the topic 'topic'
+func (b *MQTTBridge) handle(topic string, payload []byte) {
+
+	parts := strings.Split(strings.TrimPrefix(topic, b.prefix), "/")
+	if len(parts) != 2 || !strings.HasPrefix(topic, b.prefix) {
+		return
+	}
+	tokenId, err := uuid.Parse(parts[0])
+	if err != nil {
+		return
+	}
+
+	if parts[1] != commandBeacon && parts[1] != commandStandby && parts[1] != "command" {
+		// Including the data topics, which the bridge only publishes to
+		return
+	}
+	c, err := b.getConnection(tokenId.String())
+	if err != nil {
+		// Devices must sync before publishing
+		return
+	}
+	c.touch()
+
+	var cmd Command
+	if parts[1] == "command" {
+		err = json.Unmarshal(payload, &cmd)
+		if err != nil {
+			log.Printf("MQTT Bridge: invalid command: %v", err)
+			return
+		}
+	} else {
+		var loc Location
+		err = json.Unmarshal(payload, &loc)
+		if err != nil {
+			log.Printf("MQTT Bridge: invalid location: %v", err)
+			return
+		}
+		cmd = Command{Type: parts[1], Location: &loc}
+	}
+
+	message, _ := json.Marshal(&cmd)
+	reply := b.endpoint.handleCommand(c.entity, c, message)
+	if reply != nil && parts[1] == "command" {
+		c.Write(&Event{Type: EventReply, Payload: reply})
+	}
+}
+
+// Return the connection of the device of the token 'tokenIdStr', starting
+// its subscription on its first message.
+func (b *MQTTBridge) getConnection(tokenIdStr string) (*MQTTConnection, error) {
+
+	entity, err := b.endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	c, ok := b.conns[entity]
+	if ok {
+		return c, nil
+	}
+	c = MakeMQTTConnection(entity, b)
+	b.conns[entity] = c
+	go c.ReadPump()
+	go c.WritePump()
+	return c, nil
+}
+
+// Periodically stop bridging idle devices and devices whose entity expired
+func (b *MQTTBridge) expire() {
+	ticker := time.NewTicker(mqttExpiryPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		b.lock.Lock()
+		for entity, c := range b.conns {
+			current, err := b.endpoint.GetEntity(uuid.UUID(entity.tokenId).String())
+			if current != entity || err != nil || c.idle(now) {
+				delete(b.conns, entity)
+				close(c.done)
+			}
+		}
+		b.lock.Unlock()
+	}
+}
+
+//
+// MQTTConnection is the Connection of a single MQTT device, publishing the
+// events of its subscription to the device's data topic.
+//
+type MQTTConnection struct {
+
+	// The entity representing this connection
+	entity *Entity
+
+	// The bridge on which this connection is operating
+	bridge *MQTTBridge
+
+	// The topic the events are published to
+	topic string
+
+	// The encoder of the events written to this connection
+	encoder eventEncoder
+
+	// Buffered channel of outbound messages.
+	send chan []byte
+
+	// The time the device last published, in unix nanoseconds
+	active int64
+
+	// Closed once the device is no longer bridged
+	done chan struct{}
+}
+
+func MakeMQTTConnection(entity *Entity, bridge *MQTTBridge) *MQTTConnection {
+	c := &MQTTConnection{
+		entity:  entity,
+		bridge:  bridge,
+		topic:   bridge.prefix + uuid.UUID(entity.tokenId).String() + "/data",
+		encoder: makeEventEncoder(eventVersionEnvelope),
+		send:    make(chan []byte, 100),
+		active:  time.Now().UnixNano(),
+		done:    make(chan struct{}),
+	}
+	return c
+}
+
+// Record that the device published a message
+func (c *MQTTConnection) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+// Return true if the device has published nothing for a while at 'now'
+func (c *MQTTConnection) idle(now time.Time) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.active))) > mqttIdleTimeout
+}
+
+func (c *MQTTConnection) GetEntity() *Entity {
+	return c.entity
+}
+
+// Run the subscription of the entity on this connection until the device
+// is no longer bridged
+func (c *MQTTConnection) ReadPump() {
+
+	c.entity.subscription.Start(c)
+
+	<-c.done
+	c.entity.subscription.Stop(c)
+}
+
+// Continually publish the events written to this connection
+func (c *MQTTConnection) WritePump() {
+	for {
+		select {
+		case message := <-c.send:
+			c.bridge.publish(c.topic, message)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *MQTTConnection) Write(event *Event) {
+	message := c.encoder.encode(event)
+	if message == nil {
+		return
+	}
+	if event.Type == EventSOS {
+		// SOS alerts bypass the queue, so are never dropped
+		go c.bridge.publish(c.topic, message)
+		return
+	}
+	select {
+	case c.send <- message:
+	default:
+		// Drop the event if the broker cannot keep up
+	}
+}
+
+// SetMQTTBroker bridges the devices of the MQTT broker at the address
+// 'addr', such as "localhost:1883". An empty address disables the bridge.
+func (c *Config) SetMQTTBroker(addr string) {
+	c.mqttAddr = addr
+}
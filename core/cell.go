@@ -17,6 +17,18 @@ type Cell struct {
 
 	// The configuration which details the cell layout
 	config *Config
+
+	// The scale of the current occupied cell
+	scale *Scale
+
+	// The occupancy of the topology, or nil if the cell is not tracked
+	occupancy *occupancy
+
+	// The id of the coarse cell counted as occupied by this cell
+	coarseID s2.CellID
+
+	// The id of the leaf cell of the location last checked by Changed
+	leafID s2.CellID
 }
 
 func MakeCell(config *Config) *Cell {
@@ -24,33 +36,95 @@ func MakeCell(config *Config) *Cell {
 	c.s2cellID = 0
 	c.cellGroup = make([]s2.CellID, 0, 9)
 	c.config = config
+	c.scale = config.selectScale(0)
 	return c
 }
 
 func (c *Cell) Update(cid s2.CellID) {
 	c.s2cellID = cid
+	c.scale = c.config.scaleForLevel(cid.Level())
 	c.updateBoundingCells()
 }
 
-// Changed
+// Changed returns true if the location 'loc' moves the cell to a new cell
+// id. When the new cell is a neighbour of the current cell the location must
+// be at least the configured hysteresis distance inside the new cell, so
+// that jitter along a cell edge does not repeatedly change the cell.
+// The level of the cell is selected by the occupancy of the coarse cell
+// containing the location, so the cell also changes when the level does.
 func (c *Cell) Changed(loc *Location) bool {
-	s2CellId := s2.CellIDFromLatLng(s2.LatLngFromDegrees(float64(loc.Lat), float64(loc.Lng))).Parent(c.config.topologyLevel)
-	if s2CellId != c.s2cellID {
-		c.s2cellID = s2CellId
-		c.updateBoundingCells()
-		return true
+	ll := s2.LatLngFromDegrees(float64(loc.Lat), float64(loc.Lng))
+	leaf := s2.CellIDFromLatLng(ll)
+	c.leafID = leaf
+
+	// Count a released cell towards the occupancy again
+	if c.occupancy != nil && c.coarseID == 0 && c.s2cellID != 0 {
+		c.coarseID = leaf.Parent(occupancyLevel)
+		c.occupancy.move(0, c.coarseID)
+	}
+
+	scale := c.config.selectScale(c.occupancy.count(leaf.Parent(occupancyLevel)))
+	s2CellId := leaf.Parent(scale.level)
+	if s2CellId == c.s2cellID {
+		return false
+	}
+
+	if c.config.hysteresisMeters > 0 && scale == c.scale && c.isNeighbour(s2CellId) {
+		dist := s2.CellFromCellID(s2CellId).BoundaryDistance(s2.PointFromLatLng(ll))
+		if dist.Angle().Radians() < earthMetersToRadians(c.config.hysteresisMeters) {
+			return false
+		}
+	}
+
+	if c.occupancy != nil {
+		coarseID := leaf.Parent(occupancyLevel)
+		if coarseID != c.coarseID {
+			c.occupancy.move(c.coarseID, coarseID)
+			c.coarseID = coarseID
+		}
+	}
+
+	c.scale = scale
+	c.s2cellID = s2CellId
+	c.updateBoundingCells()
+	return true
+}
+
+// release stops counting this cell towards the occupancy of the topology
+func (c *Cell) release() {
+	if c.occupancy != nil && c.coarseID != 0 {
+		c.occupancy.move(c.coarseID, 0)
+		c.coarseID = 0
+	}
+}
+
+// isNeighbour returns true if the cell 'cid' is within the current cell group
+func (c *Cell) isNeighbour(cid s2.CellID) bool {
+	for _, id := range c.cellGroup {
+		if id == cid {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if the location 'loc' is within the current cell group
+func (c *Cell) covers(loc Location) bool {
+	leaf := s2.CellIDFromLatLng(s2.LatLngFromDegrees(loc.Lat, loc.Lng))
+	for _, id := range c.cellGroup {
+		if id.Contains(leaf) {
+			return true
+		}
 	}
 	return false
 }
 
 //
-//
+// Update the cell group to the cells covering the search radius around the
+// current cell. Coverings are shared between cells through the config.
 //
 func (c *Cell) updateBoundingCells() {
-	region := s2.CapFromCenterHeight(s2.PointFromLatLng(c.s2cellID.LatLng().Normalized()), c.config.height)
-
-	rc := &s2.RegionCoverer{MaxLevel: c.config.topologyLevel, MinLevel: c.config.topologyLevel}
-	cells := rc.Covering(region)
+	cells := c.config.coverings.get(c.s2cellID, c.scale)
 
 	// Clear the slice
 	c.cellGroup = c.cellGroup[:0]
@@ -63,6 +137,10 @@ func (c *Cell) GetConfig() *Config {
 	return c.config
 }
 
+func (c *Cell) GetScale() *Scale {
+	return c.scale
+}
+
 func (c *Cell) GetCellId() s2.CellID {
 	return c.s2cellID
 }
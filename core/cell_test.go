@@ -0,0 +1,181 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+// Locations of entities moving north across cells from Adelaide
+func benchmarkLocations(n int) []Location {
+	locs := make([]Location, 0, n)
+	for i := 0; i < n; i++ {
+		locs = append(locs, MakeLocation(-34.9287+float64(i)*0.001, 138.5999, 0, 0, 0))
+	}
+	return locs
+}
+
+func TestComputeCovering(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	cid := s2.CellIDFromLatLng(s2.LatLngFromDegrees(-34.9287, 138.5999)).Parent(15)
+
+	// The fast path must cover at least the cells of the region coverer
+	region := s2.CapFromCenterHeight(s2.PointFromLatLng(cid.LatLng().Normalized()), c.height)
+	rc := &s2.RegionCoverer{MaxLevel: 15, MinLevel: 15}
+	covering := s2.CellUnion(computeCovering(cid, c.selectScale(0)))
+	covering.Normalize()
+	for _, id := range rc.Covering(region) {
+		if !covering.ContainsCellID(id) {
+			t.Errorf("Covering does not contain cell %v", id)
+		}
+	}
+}
+
+// The covering as computed before the cache and fast path were introduced
+func BenchmarkCoveringRegionCoverer(b *testing.B) {
+	c := MakeConfig(250, 15)
+	locs := benchmarkLocations(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loc := locs[i%len(locs)]
+		cid := s2.CellIDFromLatLng(s2.LatLngFromDegrees(loc.Lat, loc.Lng)).Parent(c.topologyLevel)
+		region := s2.CapFromCenterHeight(s2.PointFromLatLng(cid.LatLng().Normalized()), c.height)
+		rc := &s2.RegionCoverer{MaxLevel: c.topologyLevel, MinLevel: c.topologyLevel}
+		rc.Covering(region)
+	}
+}
+
+func BenchmarkCoveringNeighbours(b *testing.B) {
+	c := MakeConfig(250, 15)
+	locs := benchmarkLocations(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loc := locs[i%len(locs)]
+		cid := s2.CellIDFromLatLng(s2.LatLngFromDegrees(loc.Lat, loc.Lng)).Parent(c.topologyLevel)
+		computeCovering(cid, c.selectScale(0))
+	}
+}
+
+func BenchmarkCellChanged(b *testing.B) {
+	c := MakeConfig(250, 15)
+	locs := benchmarkLocations(1000)
+	cell := MakeCell(&c)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cell.Changed(&locs[i%len(locs)])
+	}
+}
+
+func BenchmarkCellChangedLargeRadius(b *testing.B) {
+	c := MakeConfig(1000, 15)
+	locs := benchmarkLocations(1000)
+	cell := MakeCell(&c)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cell.Changed(&locs[i%len(locs)])
+	}
+}
+
+// Return a location just inside the cell 'to' on the way from the centre of
+// the cell 'from', and the location of the centre of 'to'
+func locationsAcross(from s2.CellID, to s2.CellID) (Location, Location) {
+	a, b := from.Point(), to.Point()
+	for i := 1; i < 1000; i++ {
+		p := s2.Interpolate(float64(i)/1000, a, b)
+		ll := s2.LatLngFromPoint(p)
+		if s2.CellIDFromLatLng(ll).Parent(to.Level()) == to {
+			return MakeLocation(ll.Lat.Degrees(), ll.Lng.Degrees(), 0, 0, 0), CellCenterLocation(to)
+		}
+	}
+	panic("cells are not adjacent")
+}
+
+func TestCellChanged(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	c.SetHysteresisMeters(10)
+	cell := MakeCell(&c)
+	start := CellCenterLocation(s2.CellIDFromLatLng(s2.LatLngFromDegrees(-34.9287, 138.5999)).Parent(15))
+	if !cell.Changed(&start) {
+		t.Fatalf("Changed: the first location must change the cell")
+	}
+	if cell.Changed(&start) {
+		t.Errorf("Changed: the same location changed the cell")
+	}
+
+	// Crossing just into a neighbouring cell is within the hysteresis
+	neighbour := cell.GetCellId().EdgeNeighbors()[0]
+	edge, centre := locationsAcross(cell.GetCellId(), neighbour)
+	if cell.Changed(&edge) {
+		t.Errorf("Changed: changed cell within the hysteresis distance")
+	}
+
+	// Moving well inside the neighbouring cell changes the cell
+	if !cell.Changed(&centre) || cell.GetCellId() != neighbour {
+		t.Errorf("Changed: expected cell %v, got %v", neighbour, cell.GetCellId())
+	}
+
+	// Without hysteresis crossing the edge changes the cell
+	c.SetHysteresisMeters(0)
+	back, _ := locationsAcross(neighbour, s2.CellIDFromLatLng(s2.LatLngFromDegrees(start.Lat, start.Lng)).Parent(15))
+	if !cell.Changed(&back) {
+		t.Errorf("Changed: crossing the edge without hysteresis did not change the cell")
+	}
+}
+
+func TestSelectScale(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	if level := c.selectScale(1000).level; level != 15 {
+		t.Errorf("selectScale: expected the topology level without adaptive scales, got %d", level)
+	}
+
+	c.SetAdaptiveScales(10, 1000)
+	tests := []struct {
+		occupancy int
+		level     int
+	}{
+		{0, 13}, {9, 13}, {10, 15}, {999, 15}, {1000, 17},
+	}
+	for _, test := range tests {
+		if level := c.selectScale(test.occupancy).level; level != test.level {
+			t.Errorf("selectScale(%d): expected level %d, got %d", test.occupancy, test.level, level)
+		}
+	}
+}
+
+func TestOccupancy(t *testing.T) {
+
+	topology := MakeTopology(MakeConfig(250, 15))
+	loc := MakeLocation(-34.9287, 138.5999, 0, 0, 0)
+	coarseID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(loc.Lat, loc.Lng)).Parent(occupancyLevel)
+
+	a, b := topology.MakeCell(), topology.MakeCell()
+	a.Changed(&loc)
+	b.Changed(&loc)
+	if n := topology.occupancy.count(coarseID); n != 2 {
+		t.Errorf("occupancy: expected 2 entities, got %d", n)
+	}
+
+	// A released cell no longer counts, however often it is released
+	a.release()
+	a.release()
+	if n := topology.occupancy.count(coarseID); n != 1 {
+		t.Errorf("release: expected 1 entity, got %d", n)
+	}
+
+	// A released cell counts again at its next location, even in the same cell
+	a.Changed(&loc)
+	if n := topology.occupancy.count(coarseID); n != 2 {
+		t.Errorf("Changed: expected 2 entities, got %d", n)
+	}
+
+	// An entity in standby or that disconnects no longer counts
+	entity := MakeEntity(nil, ClientID{}, TokenID{}, b)
+	entity.SetStandby(true)
+	topology.Unsubscribe(&testConnection{entity: MakeEntity(nil, ClientID{}, TokenID{}, a)})
+	if n := topology.occupancy.count(coarseID); n != 0 {
+		t.Errorf("occupancy: expected no entities, got %d", n)
+	}
+}
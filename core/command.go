@@ -0,0 +1,261 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// The types of command received over a websocket
+const (
+	commandBeacon    = "beacon"
+	commandFilter    = "filter"
+	commandStandby   = "standby"
+	commandPing      = "ping"
+	commandAck       = "ack"
+	commandMessage   = "message"
+	commandSOS       = "sos"
+	commandSOSAck    = "sos_ack"
+	commandSOSCancel = "sos_cancel"
+)
+
+//
+// Command is the envelope of a message received from a client over its
+// websocket, allowing the client to beacon, filter, enter standby and keep
+// the connection alive without separate HTTP requests. For example:
+//
+//    {"type": "beacon", "id": "1", "location": {"lat": ..., "lng": ...}}
+//    {"type": "filter", "id": "2", "filter": {"filtertype": "group", ...}}
+//    {"type": "ping", "id": "3"}
+//    {"type": "ack", "seq": 42}
+//    {"type": "message", "id": "4", "message": {"to": {"type": "local"}, ...}}
+//    {"type": "sos", "id": "5", "location": {...}, "sos": {"text": "..."}}
+//    {"type": "sos_ack", "id": "6", "sos": {"id": "..."}}
+//
+// A message without a type is treated as a bare UserFilter, as sent by
+// older clients.
+//
+type Command struct {
+
+	// The type of the command
+	Type string `json:"type"`
+
+	// An id chosen by the client, echoed in the reply to the command
+	Id string `json:"id,omitempty"`
+
+	// The location of a beacon or standby command
+	Location *Location `json:"location,omitempty"`
+
+	// The filter of a filter command
+	Filter *UserFilter `json:"filter,omitempty"`
+
+	// The message of a message command
+	Message *ChatMessage `json:"message,omitempty"`
+
+	// The alert of an SOS command: the text of a new alert, or the id of the
+	// alert to acknowledge or cancel
+	SOS *SOSAlert `json:"sos,omitempty"`
+
+	// The sequence number of the latest event received, acknowledged by an
+	// ack command along with all earlier events
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+//
+// eventAcknowledger is a connection that tracks the events acknowledged by
+// its client
+//
+type eventAcknowledger interface {
+
+	// Record that the client received the events up to sequence number 'seq'
+	acknowledge(seq uint64) error
+}
+
+//
+// CommandReply is the reply to a Command. Every command other than a valid
+// ack is replied to, with an error code and message if it failed.
+//
+type CommandReply struct {
+
+	// Always "reply", to distinguish replies from other messages
+	Type string `json:"type"`
+
+	// The id and type of the command replied to
+	Id      string `json:"id,omitempty"`
+	Command string `json:"command"`
+
+	// True if the command succeeded
+	Ok bool `json:"ok"`
+
+	// The error code and message if the command failed
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// The server time in milliseconds
+	Time int64 `json:"time_ms"`
+
+	// The user data published by a beacon or standby command
+	UserData *UserData `json:"userdata,omitempty"`
+
+	// The id of the message sent by a message command
+	MessageId string `json:"messageid,omitempty"`
+
+	// The alert raised, acknowledged or cancelled by an SOS command
+	SOS *SOSAlert `json:"sos,omitempty"`
+}
+
+func makeCommandReply(cmd *Command) CommandReply {
+	r := CommandReply{
+		Type:    "reply",
+		Id:      cmd.Id,
+		Command: cmd.Type,
+		Ok:      true,
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	return r
+}
+
+func (r *CommandReply) fail(code string, message string) {
+	r.Ok = false
+	r.Code = code
+	r.Error = message
+}
+
+//
+// Handle the message 'message' received from the entity 'entity' over the
+// connection 'conn', which is nil for commands received by request. Return
+// the reply to write to the connection, or nil if there is no reply.
+//
+func (endpoint *Endpoint) handleCommand(entity *Entity, conn Connection, message []byte) []byte {
+
+	var cmd Command
+	err := json.Unmarshal(message, &cmd)
+	if err != nil {
+		cmd.Type = ""
+	}
+
+	if cmd.Type == "" {
+		// Older clients send a bare UserFilter, and expect no reply
+		userFilter := UserFilter{}
+		err = json.Unmarshal(message, &userFilter)
+		if err == nil && userFilter.Type != "" {
+			err = entity.subscription.setUserFilter(&userFilter)
+			if err != nil {
+				log.Printf("Command: filter failed: %v", err)
+			}
+			return nil
+		}
+	}
+
+	reply := makeCommandReply(&cmd)
+	switch cmd.Type {
+	case commandBeacon, commandStandby:
+		if cmd.Location == nil {
+			reply.fail("invalid_command", "Missing location")
+			break
+		}
+		userData, berr := endpoint.processLocation(entity, *cmd.Location)
+		if berr == nil {
+			berr = endpoint.publishUserData(entity, userData, cmd.Type == commandStandby)
+		}
+		if berr != nil {
+			reply.fail(berr.code, berr.message)
+			break
+		}
+		reply.UserData = userData
+	case commandFilter:
+		if cmd.Filter == nil || cmd.Filter.Type == "" {
+			reply.fail("invalid_command", "Missing filter")
+			break
+		}
+		err = entity.subscription.setUserFilter(cmd.Filter)
+		if ferr, ok := err.(*filterError); ok {
+			reply.fail(ferr.code, ferr.message)
+		} else if err != nil {
+			reply.fail("filter_failed", err.Error())
+		}
+	case commandMessage:
+		if cmd.Message == nil {
+			reply.fail("invalid_command", "Missing message")
+			break
+		}
+		berr := endpoint.sendMessage(entity, cmd.Message)
+		if berr != nil {
+			reply.fail(berr.code, berr.message)
+			break
+		}
+		reply.MessageId = cmd.Message.Id
+	case commandSOS:
+		text := ""
+		if cmd.SOS != nil {
+			text = cmd.SOS.Text
+		}
+		if cmd.Location != nil {
+			// Raise the alert at the given location, or else the last
+			// known location if it is not accepted
+			userData, berr := endpoint.processLocation(entity, *cmd.Location)
+			if berr == nil {
+				berr = endpoint.publishUserData(entity, userData, false)
+			}
+			if berr != nil {
+				log.Printf("Command: SOS location not accepted: %s", berr.message)
+			}
+		}
+		alert := endpoint.sos.Raise(entity, text, time.Now())
+		reply.SOS = &alert
+	case commandSOSAck, commandSOSCancel:
+		if cmd.SOS == nil || cmd.SOS.Id == "" {
+			reply.fail("invalid_command", "Missing SOS alert id")
+			break
+		}
+		var alert SOSAlert
+		if cmd.Type == commandSOSAck {
+			alert, err = endpoint.sos.Acknowledge(entity, cmd.SOS.Id)
+		} else {
+			alert, err = endpoint.sos.Cancel(entity, cmd.SOS.Id)
+		}
+		if err == errSOSNotFound {
+			reply.fail("sos_not_found", err.Error())
+			break
+		}
+		if err != nil {
+			reply.fail("not_permitted", err.Error())
+			break
+		}
+		reply.SOS = &alert
+	case commandPing:
+		// The reply carries the server time
+	case commandAck:
+		acknowledger, ok := conn.(eventAcknowledger)
+		if !ok {
+			reply.fail("unsupported_command", "Acknowledgements are only received over a websocket")
+			break
+		}
+		if cmd.Seq == 0 {
+			reply.fail("invalid_command", "Missing sequence number")
+			break
+		}
+		err = acknowledger.acknowledge(cmd.Seq)
+		if err != nil {
+			reply.fail("invalid_command", err.Error())
+			break
+		}
+
+		// Valid acknowledgements are not replied to
+		return nil
+	case "":
+		reply.fail("invalid_command", "Not a valid command")
+	default:
+		reply.fail("unknown_command", "Unknown command type: " + cmd.Type)
+	}
+
+	if !reply.Ok {
+		log.Printf("Command: %s failed: %s", cmd.Type, reply.Error)
+	}
+	js, err := json.Marshal(&reply)
+	if err != nil {
+		log.Printf("Command: Failure generating reply: %v", err)
+		return nil
+	}
+	return js
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// consentContext only permits following the clients that consented
+type consentContext struct {
+	filterContext
+	consented map[ClientID]bool
+}
+
+func (ctx *consentContext) CanFollow(entity *Entity, clientId ClientID) bool {
+	return ctx.consented[clientId]
+}
+
+func TestFilterCommand(t *testing.T) {
+
+	topology := MakeTopology(MakeConfig(250, 15))
+	ctx := &consentContext{filterContext{topology: &topology, subscribed: map[string]bool{}}, map[ClientID]bool{}}
+	endpoint := MakeEndpoint(ctx)
+	entity := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	conn := &testConnection{entity: entity}
+	friend := ClientID(uuid.New())
+	ctx.consented[friend] = true
+
+	// Apply the filters as the running subscription of the connection would
+	s := entity.subscription
+	go func() {
+		for obj := range s.input {
+			if req, ok := obj.(*filterRequest); ok {
+				req.result <- s.applyFilter(conn, req.filter)
+			}
+		}
+	}()
+	defer close(s.input)
+
+	tests := []struct {
+		command string
+		ok      bool
+		code    string
+	}{
+		{`{"type":"filter","id":"1","filter":{"filtertype":"entity","filtervalue":"` + uuid.UUID(friend).String() + `","action":"add"}}`, true, ""},
+		{`{"type":"filter","id":"2","filter":{"filtertype":"entity","filtervalue":"` + uuid.New().String() + `"}}`, false, "not_permitted"},
+		{`{"type":"filter","id":"3","filter":{"filtertype":"entity","filtervalue":"nobody"}}`, false, "invalid_filter"},
+		{`{"type":"filter","id":"4","filter":{"filtertype":"region","filtervalue":"[1,2]"}}`, false, "invalid_filter"},
+		{`{"type":"filter","id":"5","filter":{"filtertype":"weather"}}`, false, "invalid_filter"},
+		{`{"type":"filter","id":"6"}`, false, "invalid_command"},
+		{`{"type":"ack","seq":1}`, false, "unsupported_command"},
+	}
+	for _, test := range tests {
+		var reply CommandReply
+		if err := json.Unmarshal(endpoint.handleCommand(entity, nil, []byte(test.command)), &reply); err != nil {
+			t.Fatalf("handleCommand(%s): %v", test.command, err)
+		}
+		if reply.Ok != test.ok || reply.Code != test.code {
+			t.Errorf("handleCommand(%s): expected ok %v and code %q, got %+v", test.command, test.ok, test.code, reply)
+		}
+	}
+
+	// A failed filter leaves the current filters in place
+	if len(s.filters) != 2 || s.filters["entity:"+uuid.UUID(friend).String()] == nil {
+		t.Errorf("handleCommand: expected the local and entity filters, got %v", s.filters)
+	}
+}
+
+func TestEventAcknowledge(t *testing.T) {
+
+	enc := makeEventEncoder(eventVersionEnvelope)
+	for i := 0; i < 3; i++ {
+		enc.encode(&Event{Type: EventLocation, Payload: []byte(`{}`)})
+	}
+
+	if err := enc.acknowledge(4); err == nil {
+		t.Errorf("acknowledge: accepted an event not yet written")
+	}
+	if err := enc.acknowledge(3); err != nil || enc.acked != 3 {
+		t.Errorf("acknowledge: expected 3 acknowledged, got %d, %v", enc.acked, err)
+	}
+
+	// Earlier acknowledgements arriving late do not go backwards
+	if err := enc.acknowledge(2); err != nil || enc.acked != 3 {
+		t.Errorf("acknowledge: expected 3 acknowledged, got %d, %v", enc.acked, err)
+	}
+
+	legacy := makeEventEncoder(eventVersionLegacy)
+	if err := legacy.acknowledge(1); err == nil {
+		t.Errorf("acknowledge: accepted an acknowledgement of an unnumbered event")
+	}
+}
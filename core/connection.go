@@ -12,7 +12,7 @@ type Connection interface {
     // Continually receive subscribed data and write it to the connection
     WritePump()
 
-    // Write data to this connection
-    Write(message []byte)
+    // Write the event 'event' to this connection
+    Write(event *Event)
 
 }
@@ -1,9 +1,12 @@
 package core
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"strconv"
+	"time"
+	"github.com/golang/geo/s2"
 	"github.com/google/uuid"
 )
 
@@ -28,9 +31,29 @@ type Context interface {
 	// Subscribe the connection 'conn' to the group with id 'groupId'
 	SubscribeToGroup(conn Connection, groupId string) error
 
+	// Return nil if the entity 'entity' is a member of the group 'groupId',
+	// otherwise the reason it is not
+	CheckGroupMember(entity *Entity, groupId string) error
+
+	// Subscribe the connection 'conn' to the region 'region'
+	SubscribeToRegion(conn Connection, region *Region) error
+
+	// Return true if the entity 'entity' is permitted to follow the client 'clientId'
+	CanFollow(entity *Entity, clientId ClientID) bool
+
+	// Return the client ids of 'clientIds' whose positions the entity 'entity'
+	// is permitted to see
+	VisibleClients(entity *Entity, clientIds []string) map[string]bool
+
+	// Subscribe the connection 'conn' to the updates of the client 'clientId'
+	SubscribeToEntity(conn Connection, clientId ClientID) error
+
 	// Unsunscribe the connection 'conn' from all groups
 	UnsubscribeFromGroups(conn Connection) error
 
+	// Unsubscribe the connection 'conn' from the filter 'filter' only
+	UnsubscribeFromFilter(conn Connection, filter *UserFilter) error
+
     // Unsubscribe the connection from all its groups/cells
 	Unsubscribe(conn Connection) error
 
@@ -40,9 +63,33 @@ type Context interface {
     // Broadcast the entity location and message to the topology
 	Broadcast(entity *Entity, message []byte) error
 
+	// Record the plausibility flag 'flag' raised against the entity 'entity'
+	RecordFlag(entity *Entity, flag PlausibilityFlag) error
+
+	// Store the locations 'locs' of the entity 'entity' without broadcasting them
+	RecordLocations(entity *Entity, locs []Location) error
+
+	// Send the message 'msg' from the entity 'entity' to its target
+	SendMessage(entity *Entity, msg *ChatMessage) error
+
+	// Get up to 'limit' messages of the group 'groupId' older than the
+	// message 'before', if not empty, newest first
+	GetMessages(entity *Entity, groupId string, before string, limit int) ([]ChatMessage, error)
+
+	// Write the SOS alert 'alert' of the entity 'entity' to its recipients
+	// and store its latest state
+	BroadcastSOS(entity *Entity, alert *SOSAlert, message []byte) error
+
+	// Record the acknowledgement of the SOS alert 'alert' by the entity 'entity'
+	RecordSOSAck(entity *Entity, alert *SOSAlert) error
+
 	// Get the data associated with tokenId in the form of an activity.
 	GetData(tokenId TokenID) (Activity, error)
 
+	// Get the historical locations recorded between 'from' and 'to' within the
+	// rect 'bound', optionally restricted to the members of group 'groupId'.
+	GetLocations(bound s2.Rect, from time.Time, to time.Time, groupId string) ([]Location, error)
+
 }
 
 type DataStoreContext struct {
@@ -90,6 +137,19 @@ func (ctx *DataStoreContext) CreateEntity(tokenId TokenID, userAgent uint8) (*En
 	// Create an entity for the client with a cell structure to handle the data
 	entity := MakeEntity(ctx, clientId, tokenId, ctx.t.MakeCell())
 
+	// The clients it has blocked are not delivered to it
+	if ctx.store.IsConnected() {
+		blocked, berr := ctx.store.GetBlocked(uuid.UUID(clientId))
+		if berr != nil {
+			log.Printf("CreateEntity: Failed to get blocked clients: %v", berr)
+		}
+		clientIds := make([]ClientID, len(blocked))
+		for i, b := range blocked {
+			clientIds[i] = ClientID(b)
+		}
+		entity.SetBlocked(clientIds)
+	}
+
 	// TODO: get groups from database
 
 	return entity, nil
@@ -107,10 +167,108 @@ func (ctx *DataStoreContext) SubscribeToCell(conn Connection, cell *Cell) error
 }
 
 //
-// Subscribe the connection 'conn' to the group with id 'groupId'
+// Subscribe the connection 'conn' to the group with id 'groupId'. Only
+// members of the group may subscribe to it.
 //
 func (ctx *DataStoreContext) SubscribeToGroup(conn Connection, groupId string) error {
-	return ctx.t.SubscribeToGroup(conn, groupId, true)	// unsubscribe first
+
+	err := ctx.CheckGroupMember(conn.GetEntity(), groupId)
+	if err != nil {
+		return err
+	}
+	return ctx.t.SubscribeToGroup(conn, groupId)
+}
+
+//
+// Return nil if the entity 'entity' is a member of the group 'groupId', or
+// errNotGroupMember if it is not
+//
+func (ctx *DataStoreContext) CheckGroupMember(entity *Entity, groupId string) error {
+
+	if !ctx.store.IsConnected() {
+		return errors.New("Database is not connected.")
+	}
+
+	role, err := ctx.store.GroupRole(uuid.UUID(entity.clientId), groupId)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return errNotGroupMember
+	}
+	return nil
+}
+
+//
+// Subscribe the connection 'conn' to the region 'region'
+//
+func (ctx *DataStoreContext) SubscribeToRegion(conn Connection, region *Region) error {
+	return ctx.t.SubscribeToRegion(conn, region)
+}
+
+//
+// Return true if the entity 'entity' is permitted to follow the client
+// 'clientId'. A client must have given its consent to be followed.
+//
+func (ctx *DataStoreContext) CanFollow(entity *Entity, clientId ClientID) bool {
+
+	if entity.clientId == clientId {
+		return true
+	}
+
+	if !ctx.store.IsConnected() {
+		log.Print("CanFollow: Database is not connected.")
+		return false
+	}
+
+	ok, err := ctx.store.CanFollow(uuid.UUID(clientId), uuid.UUID(entity.clientId))
+	if err != nil {
+		log.Printf("CanFollow: %v", err)
+		return false
+	}
+	return ok
+}
+
+//
+// Return the client ids of 'clientIds' whose positions the entity 'entity' is
+// permitted to see: its own, and those of the clients that consented to being
+// followed by it or that share a group with it.
+//
+func (ctx *DataStoreContext) VisibleClients(entity *Entity, clientIds []string) map[string]bool {
+
+	own := uuid.UUID(entity.clientId).String()
+	visible := map[string]bool{own: true}
+	others := make([]string, 0, len(clientIds))
+	for _, clientId := range clientIds {
+		if clientId != own {
+			others = append(others, clientId)
+		}
+	}
+	if len(others) == 0 {
+		return visible
+	}
+
+	if !ctx.store.IsConnected() {
+		log.Print("VisibleClients: Database is not connected.")
+		return visible
+	}
+
+	permitted, err := ctx.store.VisibleClients(uuid.UUID(entity.clientId), others)
+	if err != nil {
+		log.Printf("VisibleClients: %v", err)
+		return visible
+	}
+	for _, clientId := range permitted {
+		visible[clientId] = true
+	}
+	return visible
+}
+
+//
+// Subscribe the connection 'conn' to the updates of the client 'clientId'
+//
+func (ctx *DataStoreContext) SubscribeToEntity(conn Connection, clientId ClientID) error {
+	return ctx.t.SubscribeToEntity(conn, clientId)
 }
 
 //
@@ -121,6 +279,13 @@ func (ctx *DataStoreContext) UnsubscribeFromGroups(conn Connection) error {
     return ctx.t.UnsubscribeFromGroups(conn)
 }
 
+//
+// Unsubscribe the connection 'conn' from the filter 'filter' only
+//
+func (ctx *DataStoreContext) UnsubscribeFromFilter(conn Connection, filter *UserFilter) error {
+	return ctx.t.UnsubscribeFromFilter(conn, filter)
+}
+
 //
 // Unsubscribe the connection from all its cells/groups
 //
@@ -129,12 +294,15 @@ func (ctx *DataStoreContext) Unsubscribe(conn Connection) error {
 }
 
 //
-// Broadcast the location and message to the topology
+// Handle the entity entering standby. It is no longer found near its last
+// known position, and its watchers are told of its presence.
 //
 func (ctx *DataStoreContext) Standby(entity *Entity, message []byte) error {
-
-	// TODO:
-	return nil
+	err := ctx.t.RemovePosition(entity)
+	if err != nil {
+		return err
+	}
+	return ctx.t.PublishPresence(entity, presenceStandby)
 }
 
 //
@@ -158,6 +326,185 @@ func (ctx *DataStoreContext) Broadcast(entity *Entity, message []byte) error {
 	return err
 }
 
+//
+// Record the plausibility flag raised against the entity in the datastore
+//
+func (ctx *DataStoreContext) RecordFlag(entity *Entity, flag PlausibilityFlag) error {
+
+	if !ctx.store.IsConnected() {
+		log.Print("RecordFlag: Database is not connected.")
+		return nil
+	}
+
+	_, flagged := ctx.t.GetTrust(entity.clientId)
+	return ctx.store.PlausibilityFlag(uuid.UUID(entity.clientId), uuid.UUID(entity.tokenId),
+		flag.Type, flag.Detail, flag.Score, flagged, time.Unix(flag.Time, 0))
+}
+
+//
+// Store the locations of the entity in the datastore without broadcasting
+//
+func (ctx *DataStoreContext) RecordLocations(entity *Entity, locs []Location) error {
+
+	if !ctx.store.IsConnected() {
+		return errors.New("Database is not connected.")
+	}
+	return ctx.store.LocationDataBatch(uuid.UUID(entity.tokenId), locs)
+}
+
+//
+// Send the message from the entity to its target. Only members of a group
+// may message it, and only its organisers may make announcements. Group
+// messages are stored as the group's history. A single client may only be
+// messaged by the clients visible to it that it has not blocked.
+//
+func (ctx *DataStoreContext) SendMessage(entity *Entity, msg *ChatMessage) error {
+
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if msg.To.Type == targetClient {
+		cerr := ctx.checkMessageConsent(entity, msg.To.Value)
+		if cerr != nil {
+			return cerr
+		}
+	}
+
+	if msg.To.Type == targetGroup {
+		if !ctx.store.IsConnected() {
+			return errors.New("Database is not connected.")
+		}
+		role, rerr := ctx.store.GroupRole(uuid.UUID(entity.clientId), msg.To.Value)
+		if rerr != nil {
+			return rerr
+		}
+		if role == "" {
+			return errNotGroupMember
+		}
+		if msg.Kind == messageAnnouncement && role != roleOrganiser {
+			return errNotOrganiser
+		}
+		err = ctx.store.SaveMessage(msg.To.Value, uuid.UUID(entity.clientId), msg.Id, msg.Kind, msg.Text, msg.Data,
+			time.Unix(0, msg.Time*int64(time.Millisecond)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctx.t.PublishMessage(entity, msg.To, js)
+}
+
+//
+// Return nil if the client 'clientId' accepts messages from the entity
+// 'entity': it consented to being followed by the entity or shares a group
+// with it, and has not blocked it. Return errNoConsent if it does not.
+//
+func (ctx *DataStoreContext) checkMessageConsent(entity *Entity, clientId string) error {
+
+	if !ctx.store.IsConnected() {
+		return errors.New("Database is not connected.")
+	}
+
+	if !ctx.VisibleClients(entity, []string{clientId})[clientId] {
+		return errNoConsent
+	}
+	clientUUID, err := uuid.Parse(clientId)
+	if err != nil {
+		return err
+	}
+	blocked, err := ctx.store.Blocked(clientUUID, uuid.UUID(entity.clientId))
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errNoConsent
+	}
+	return nil
+}
+
+//
+// Get the message history of a group of which the entity is a member
+//
+func (ctx *DataStoreContext) GetMessages(entity *Entity, groupId string, before string, limit int) ([]ChatMessage, error) {
+
+	if !ctx.store.IsConnected() {
+		return nil, errors.New("Database is not connected.")
+	}
+
+	role, err := ctx.store.GroupRole(uuid.UUID(entity.clientId), groupId)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		return nil, errNotGroupMember
+	}
+	return ctx.store.GetMessages(groupId, before, limit)
+}
+
+//
+// Write the SOS alert to the members of the entity's groups, the entities
+// around it and its followers, and store its latest state
+//
+func (ctx *DataStoreContext) BroadcastSOS(entity *Entity, alert *SOSAlert, message []byte) error {
+
+	var stored []string
+	if !ctx.store.IsConnected() {
+		log.Print("BroadcastSOS: Database is not connected.")
+	} else {
+		var err error
+		stored, err = ctx.store.GetGroups(uuid.UUID(entity.clientId))
+		if err != nil {
+			log.Printf("BroadcastSOS: Failed to get groups: %v", err)
+		}
+
+		err = ctx.store.SOSAlert(alert.Id, uuid.UUID(entity.clientId), uuid.UUID(entity.tokenId),
+			alert.Location.Lat, alert.Location.Lng, alert.Text, alert.State, alert.Attempt,
+			time.Unix(0, alert.Time*int64(time.Millisecond)), time.Now())
+		if err != nil {
+			log.Printf("BroadcastSOS: Failed to store alert: %v", err)
+		}
+	}
+
+	return ctx.t.PublishSOS(entity, sosGroups(entity.groups, stored), message)
+}
+
+//
+// Return the ids of the groups 'groups' of an entity and of the groups
+// 'stored' of its client, each once
+//
+func sosGroups(groups []Group, stored []string) []string {
+
+	ids := make([]string, 0, len(groups)+len(stored))
+	seen := make(map[string]bool, len(groups)+len(stored))
+	for _, group := range groups {
+		if !seen[group.Uuid] {
+			seen[group.Uuid] = true
+			ids = append(ids, group.Uuid)
+		}
+	}
+	for _, id := range stored {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+//
+// Record the acknowledgement of the SOS alert by the entity in the datastore
+//
+func (ctx *DataStoreContext) RecordSOSAck(entity *Entity, alert *SOSAlert) error {
+
+	if !ctx.store.IsConnected() {
+		log.Print("RecordSOSAck: Database is not connected.")
+		return nil
+	}
+	return ctx.store.SOSAck(alert.Id, uuid.UUID(entity.clientId), time.Now())
+}
+
 func (ctx *DataStoreContext) GetData(tokenId TokenID) (Activity, error) {
 
 	activity := Activity{}
@@ -177,3 +524,29 @@ func (ctx *DataStoreContext) GetData(tokenId TokenID) (Activity, error) {
 	activity.Locations, err = ctx.store.GetData(uuid.UUID(tokenId))
 	return activity, err
 }
+
+// The maximum number of historical locations returned by GetLocations
+const maxHistoricalLocations = 200000
+
+//
+// Get the historical locations recorded between 'from' and 'to' within the
+// rect 'bound', which may cross the antimeridian
+//
+func (ctx *DataStoreContext) GetLocations(bound s2.Rect, from time.Time, to time.Time, groupId string) ([]Location, error) {
+
+	if !ctx.store.IsConnected() {
+		return nil, errors.New("Database is not connected.")
+	}
+
+	lo, hi := bound.Lo(), bound.Hi()
+	locations := make([]Location, 0)
+	for _, lng := range lngRanges(bound.Lng) {
+		locs, err := ctx.store.GetLocations(lo.Lat.Degrees(), lng[0], hi.Lat.Degrees(), lng[1],
+			from, to, groupId, maxHistoricalLocations - len(locations))
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, locs...)
+	}
+	return locations, nil
+}
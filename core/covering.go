@@ -0,0 +1,103 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/geo/s2"
+)
+
+// The default maximum number of coverings held by a covering cache
+const defaultCoveringCacheSize = 4096
+
+//
+// coveringCache is a bounded LRU cache of cell id to the covering of the
+// search radius around that cell. It is shared by all cells of a Config and
+// holds coverings of every scale, as the cell id determines the scale.
+//
+type coveringCache struct {
+
+	// The maximum number of coverings held by the cache
+	size int
+
+	// The list of cached entries, most recently used first
+	order *list.List
+
+	// Map of cell ids to their entry within 'order'
+	entries map[s2.CellID]*list.Element
+
+	// A mutex for synchronising the cache between threads
+	lock sync.Mutex
+}
+
+// An entry within the covering cache
+type coveringEntry struct {
+	cellId   s2.CellID
+	covering []s2.CellID
+}
+
+func makeCoveringCache(size int) *coveringCache {
+	cc := &coveringCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[s2.CellID]*list.Element, size),
+	}
+	return cc
+}
+
+//
+// Return the covering for the cell 'cid' at the scale 'scale', computing and
+// caching it if required. The returned slice is shared and must not be
+// modified.
+//
+func (cc *coveringCache) get(cid s2.CellID, scale *Scale) []s2.CellID {
+
+	cc.lock.Lock()
+	elem, ok := cc.entries[cid]
+	if ok {
+		cc.order.MoveToFront(elem)
+		covering := elem.Value.(*coveringEntry).covering
+		cc.lock.Unlock()
+		return covering
+	}
+	cc.lock.Unlock()
+
+	// Compute the covering without holding the lock
+	covering := computeCovering(cid, scale)
+
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if elem, ok = cc.entries[cid]; ok {
+		// Another thread computed the covering in the meantime
+		cc.order.MoveToFront(elem)
+		return elem.Value.(*coveringEntry).covering
+	}
+	cc.entries[cid] = cc.order.PushFront(&coveringEntry{cellId: cid, covering: covering})
+	if cc.order.Len() > cc.size {
+		oldest := cc.order.Back()
+		cc.order.Remove(oldest)
+		delete(cc.entries, oldest.Value.(*coveringEntry).cellId)
+	}
+	return covering
+}
+
+//
+// Return the cells covering the search radius around the cell 'cid'.
+// When the search radius fits within the ring of cells neighbouring 'cid'
+// the cell and its edge and vertex neighbours are used instead of running
+// a region coverer.
+//
+func computeCovering(cid s2.CellID, scale *Scale) []s2.CellID {
+
+	level := scale.level
+	if earthMetersToRadians(scale.searchRadiusMeters) <= 1.5*s2.MinWidthMetric.Value(level) {
+		neighbours := cid.AllNeighbors(level)
+		covering := make([]s2.CellID, 0, len(neighbours)+1)
+		covering = append(covering, cid)
+		return append(covering, neighbours...)
+	}
+
+	region := s2.CapFromCenterHeight(s2.PointFromLatLng(cid.LatLng().Normalized()), scale.height)
+	rc := &s2.RegionCoverer{MaxLevel: level, MinLevel: level}
+	return rc.Covering(region)
+}
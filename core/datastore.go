@@ -6,7 +6,7 @@ import (
   "log"
   "time"
 
-  _ "github.com/lib/pq"
+  "github.com/lib/pq"
   "github.com/google/uuid"
 )
 
@@ -44,6 +44,7 @@ func (ds *DataStore) Connect() error {
   if err != nil {
     return err
   }
+  ds.db = db
   log.Print("DataStore connected.\n")
   return nil
 }
@@ -67,24 +68,304 @@ VALUES ($1, $2, $3, $4)`
   return nil
 }
 
+// rawTime returns the timestamp of the location as sent by the client
+func rawTime(loc *Location) time.Time {
+  if loc.RawMs == 0 {
+    return loc.Time()
+  }
+  return time.Unix(0, loc.RawMs * int64(time.Millisecond))
+}
+
 func (ds *DataStore) LocationData(tokenUUID uuid.UUID, loc Location) error {
   // TODO: It will be a better idea at some stage to bulk import location data.
   sql := `
-INSERT INTO v1.location_data (token_uuid, lat, lng, alt, timestamp)
-VALUES ($1, $2, $3, $4, $5)`
+INSERT INTO v1.location_data (token_uuid, lat, lng, alt, timestamp, raw_timestamp)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (token_uuid, timestamp) DO NOTHING`
   stmt, err := ds.db.Prepare(sql)
   if err != nil {
     return err
   }
   defer stmt.Close()
 
-  _, err = stmt.Exec(tokenUUID, loc.Lat, loc.Lng, loc.Alt, time.Unix(loc.Timestamp, 0))
+  _, err = stmt.Exec(tokenUUID, loc.Lat, loc.Lng, loc.Alt, loc.Time(), rawTime(&loc))
   if err != nil {
     return err
   }
   return nil
 }
 
+// LocationDataBatch inserts the locations 'locs' in a single transaction.
+// Locations already stored, such as those of a batch that is retried, are
+// skipped.
+func (ds *DataStore) LocationDataBatch(tokenUUID uuid.UUID, locs []Location) error {
+  tx, err := ds.db.Begin()
+  if err != nil {
+    return err
+  }
+
+  stmt, err := tx.Prepare(`
+INSERT INTO v1.location_data (token_uuid, lat, lng, alt, timestamp, raw_timestamp)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (token_uuid, timestamp) DO NOTHING`)
+  if err != nil {
+    tx.Rollback()
+    return err
+  }
+  defer stmt.Close()
+
+  for i := range locs {
+    loc := &locs[i]
+    _, err = stmt.Exec(tokenUUID, loc.Lat, loc.Lng, loc.Alt, loc.Time(), rawTime(loc))
+    if err != nil {
+      tx.Rollback()
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+// CanFollow returns true if the client 'clientUUID' has consented to being
+// followed by the client 'followerUUID'
+func (ds *DataStore) CanFollow(clientUUID uuid.UUID, followerUUID uuid.UUID) (bool, error) {
+  var count int
+  err := ds.db.QueryRow(
+    `SELECT COUNT(*) FROM v1.follow_consent WHERE client_uuid = $1 AND follower_uuid = $2`,
+    clientUUID, followerUUID).Scan(&count)
+  if err != nil {
+    return false, err
+  }
+  return count > 0, nil
+}
+
+// VisibleClients returns those of the clients 'clientUUIDs' visible to the
+// client 'viewerUUID': those that consented to being followed by it or that
+// share a group with it
+func (ds *DataStore) VisibleClients(viewerUUID uuid.UUID, clientUUIDs []string) ([]string, error) {
+  visible := make([]string, 0)
+  rows, err := ds.db.Query(`
+SELECT c::text FROM unnest($2::uuid[]) c
+WHERE EXISTS (
+  SELECT 1 FROM v1.follow_consent f WHERE f.client_uuid = c AND f.follower_uuid = $1)
+OR EXISTS (
+  SELECT 1 FROM v1.group_member a
+  JOIN v1.group_member b ON b.group_id = a.group_id
+  WHERE a.client_uuid = c AND b.client_uuid = $1)`,
+    viewerUUID, pq.Array(clientUUIDs))
+  if err != nil {
+    return visible, err
+  }
+
+  defer rows.Close()
+  for rows.Next() {
+    var clientId string
+    err = rows.Scan(&clientId)
+    if err != nil {
+      return visible, err
+    }
+    visible = append(visible, clientId)
+  }
+  return visible, rows.Err()
+}
+
+// GetLocations returns up to 'limit' of the latest locations recorded between
+// 'from' and 'to' within the given lat/lng bounds. If 'groupId' is not empty only the
+// locations of members of that group are returned.
+func (ds *DataStore) GetLocations(minLat, minLng, maxLat, maxLng float64, from time.Time, to time.Time, groupId string, limit int) ([]Location, error) {
+  locations := make([]Location, 0)
+  query := `
+SELECT l.lat, l.lng, l.alt, l.timestamp FROM v1.location_data l
+WHERE l.lat BETWEEN $1 AND $2 AND l.lng BETWEEN $3 AND $4 AND l.timestamp BETWEEN $5 AND $6`
+  args := []interface{}{minLat, maxLat, minLng, maxLng, from, to}
+  if groupId != "" {
+    query += `
+AND l.token_uuid IN (
+  SELECT e.token_uuid FROM v1.entity e
+  JOIN v1.group_member g ON g.client_uuid = e.client_uuid
+  WHERE g.group_id = $7)`
+    args = append(args, groupId)
+  }
+  query += fmt.Sprintf(" ORDER BY l.timestamp DESC LIMIT %d", limit)
+
+  rows, err := ds.db.Query(query, args...)
+  if err != nil {
+    return locations, err
+  }
+
+  defer rows.Close()
+  for rows.Next() {
+    loc := Location{}
+    ts := time.Time{}
+    err = rows.Scan(&loc.Lat, &loc.Lng, &loc.Alt, &ts)
+    if err != nil {
+      return locations, err
+    }
+    loc.SetTime(ts)
+    locations = append(locations, loc)
+  }
+  return locations, rows.Err()
+}
+
+// PlausibilityFlag records a plausibility flag raised against a client and
+// updates the client's trust score
+func (ds *DataStore) PlausibilityFlag(clientUUID uuid.UUID, tokenUUID uuid.UUID, flagType string, detail string, score float64, flagged bool, created time.Time) error {
+  _, err := ds.db.Exec(`
+INSERT INTO v1.plausibility_flag (client_uuid, token_uuid, type, detail, score, created)
+VALUES ($1, $2, $3, $4, $5, $6)`,
+    clientUUID, tokenUUID, flagType, detail, score, created)
+  if err != nil {
+    return err
+  }
+
+  _, err = ds.db.Exec(`
+INSERT INTO v1.client_trust (client_uuid, score, flagged, updated)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (client_uuid) DO UPDATE SET score = $2, flagged = $3, updated = $4`,
+    clientUUID, score, flagged, created)
+  return err
+}
+
+// GroupRole returns the role of the client 'clientUUID' in the group
+// 'groupId', or an empty string if the client is not a member
+func (ds *DataStore) GroupRole(clientUUID uuid.UUID, groupId string) (string, error) {
+  var role string
+  err := ds.db.QueryRow(
+    `SELECT role FROM v1.group_member WHERE client_uuid = $1 AND group_id = $2`,
+    clientUUID, groupId).Scan(&role)
+  if err == sql.ErrNoRows {
+    return "", nil
+  }
+  return role, err
+}
+
+// SaveMessage stores a message sent to the group 'groupId'
+func (ds *DataStore) SaveMessage(groupId string, senderUUID uuid.UUID, id string, kind string, text string, data []byte, created time.Time) error {
+  js := sql.NullString{String: string(data), Valid: len(data) > 0}
+  _, err := ds.db.Exec(`
+INSERT INTO v1.message (id, group_id, sender_uuid, kind, text, data, created)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+    id, groupId, senderUUID, kind, text, js, created)
+  return err
+}
+
+// GetMessages returns up to 'limit' messages of the group 'groupId', newest
+// first. If 'before' is not empty only the messages older than the message
+// with that id are returned.
+func (ds *DataStore) GetMessages(groupId string, before string, limit int) ([]ChatMessage, error) {
+  messages := make([]ChatMessage, 0)
+  query := `
+SELECT m.id, m.sender_uuid, m.kind, m.text, m.data, m.created FROM v1.message m
+WHERE m.group_id = $1`
+  args := []interface{}{groupId}
+  if before != "" {
+    query += `
+AND (m.created, m.id) < (SELECT b.created, b.id FROM v1.message b WHERE b.id = $2)`
+    args = append(args, before)
+  }
+  query += fmt.Sprintf(" ORDER BY m.created DESC, m.id DESC LIMIT %d", limit)
+
+  rows, err := ds.db.Query(query, args...)
+  if err != nil {
+    return messages, err
+  }
+
+  defer rows.Close()
+  for rows.Next() {
+    msg := ChatMessage{Type: "message", To: MessageTarget{Type: targetGroup, Value: groupId}}
+    var data sql.NullString
+    created := time.Time{}
+    err = rows.Scan(&msg.Id, &msg.From, &msg.Kind, &msg.Text, &data, &created)
+    if err != nil {
+      return messages, err
+    }
+    if data.Valid {
+      msg.Data = []byte(data.String)
+    }
+    msg.Time = created.UnixNano() / int64(time.Millisecond)
+    messages = append(messages, msg)
+  }
+  return messages, rows.Err()
+}
+
+// GetBlocked returns the clients whose messages the client 'clientUUID' has
+// blocked
+func (ds *DataStore) GetBlocked(clientUUID uuid.UUID) ([]uuid.UUID, error) {
+  blocked := make([]uuid.UUID, 0)
+  rows, err := ds.db.Query(
+    `SELECT blocked_uuid FROM v1.message_block WHERE client_uuid = $1`,
+    clientUUID)
+  if err != nil {
+    return blocked, err
+  }
+
+  defer rows.Close()
+  for rows.Next() {
+    var blockedUUID uuid.UUID
+    err = rows.Scan(&blockedUUID)
+    if err != nil {
+      return blocked, err
+    }
+    blocked = append(blocked, blockedUUID)
+  }
+  return blocked, rows.Err()
+}
+
+// Blocked returns true if the client 'clientUUID' has blocked the messages
+// of the client 'senderUUID'
+func (ds *DataStore) Blocked(clientUUID uuid.UUID, senderUUID uuid.UUID) (bool, error) {
+  var count int
+  err := ds.db.QueryRow(
+    `SELECT COUNT(*) FROM v1.message_block WHERE client_uuid = $1 AND blocked_uuid = $2`,
+    clientUUID, senderUUID).Scan(&count)
+  if err != nil {
+    return false, err
+  }
+  return count > 0, nil
+}
+
+// GetGroups returns the ids of the groups of which the client 'clientUUID'
+// is a member
+func (ds *DataStore) GetGroups(clientUUID uuid.UUID) ([]string, error) {
+  groups := make([]string, 0)
+  rows, err := ds.db.Query(
+    `SELECT group_id FROM v1.group_member WHERE client_uuid = $1`,
+    clientUUID)
+  if err != nil {
+    return groups, err
+  }
+
+  defer rows.Close()
+  for rows.Next() {
+    var groupId string
+    err = rows.Scan(&groupId)
+    if err != nil {
+      return groups, err
+    }
+    groups = append(groups, groupId)
+  }
+  return groups, rows.Err()
+}
+
+// SOSAlert stores the latest state of an SOS alert
+func (ds *DataStore) SOSAlert(id string, clientUUID uuid.UUID, tokenUUID uuid.UUID, lat, lng float64, text string, state string, attempts int, created time.Time, updated time.Time) error {
+  _, err := ds.db.Exec(`
+INSERT INTO v1.sos_alert (id, client_uuid, token_uuid, lat, lng, text, state, attempts, created, updated)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (id) DO UPDATE SET lat = $4, lng = $5, text = $6, state = $7, attempts = $8, updated = $10`,
+    id, clientUUID, tokenUUID, lat, lng, text, state, attempts, created, updated)
+  return err
+}
+
+// SOSAck records the acknowledgement of an SOS alert by the client 'clientUUID'
+func (ds *DataStore) SOSAck(alertId string, clientUUID uuid.UUID, created time.Time) error {
+  _, err := ds.db.Exec(`
+INSERT INTO v1.sos_ack (alert_id, client_uuid, created)
+VALUES ($1, $2, $3)
+ON CONFLICT (alert_id, client_uuid) DO NOTHING`,
+    alertId, clientUUID, created)
+  return err
+}
+
 func (ds *DataStore) GetData(tokenUUID uuid.UUID) ([]Location, error) {
   locations := make([]Location, 0)
   rows, err := ds.db.Query(
@@ -102,7 +383,7 @@ func (ds *DataStore) GetData(tokenUUID uuid.UUID) ([]Location, error) {
     if err != nil {
       return locations, err
     }
-    loc.Timestamp = ts.Unix()
+    loc.SetTime(ts)
     locations = append(locations, loc)
   }
   err = rows.Err()
@@ -0,0 +1,278 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/geo/s2"
+)
+
+const (
+	// The channel on which density updates are published, apart from the
+	// group, entity and inbox channels
+	densityChannel = "topology:density"
+
+	// The period between published density updates
+	densityPeriod = 10 * time.Second
+
+	// The number of one minute buckets held for each cell
+	densityBuckets = 60
+
+	// The fewest distinct entities a cell must hold for its density to be
+	// served, so that the density never locates a single entity
+	densityMinEntities = 3
+)
+
+// The levels at which density is aggregated
+var densityLevels = []int{10, 13, 15}
+
+//
+// Return true if the density is aggregated at the level 'level'
+//
+func isDensityLevel(level int) bool {
+	for _, l := range densityLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Return true if the density of the cells at level 'level' over the window
+// 'window' may be served. The cells of the finest level, about 300 meters
+// across, over the shortest window would show where a household is now.
+//
+func densityServed(level int, window time.Duration) bool {
+	return level < densityLevels[len(densityLevels)-1] || window > time.Minute
+}
+
+// The sliding windows over which density is aggregated
+var densityWindows = map[string]time.Duration{
+	"1m":  time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+}
+
+// cellDensity holds the beacons and entities seen within a single cell
+// over the last hour, in one minute buckets.
+type cellDensity struct {
+
+	// The minute each bucket holds, in minutes since the epoch
+	minutes [densityBuckets]int64
+
+	// The number of beacons within each bucket
+	beacons [densityBuckets]int
+
+	// The clients seen within each bucket
+	clients [densityBuckets]map[ClientID]bool
+}
+
+func (cd *cellDensity) record(clientId ClientID, minute int64) {
+	b := minute % densityBuckets
+	if cd.minutes[b] != minute {
+		cd.minutes[b] = minute
+		cd.beacons[b] = 0
+		cd.clients[b] = make(map[ClientID]bool)
+	}
+	cd.beacons[b]++
+	cd.clients[b][clientId] = true
+}
+
+// Return the number of distinct entities and beacons within the last 'minutes'
+func (cd *cellDensity) count(now int64, minutes int64) (int, int) {
+	beacons := 0
+	var clients map[ClientID]bool
+	for b := range cd.minutes {
+		if cd.minutes[b] <= now-minutes || cd.minutes[b] > now {
+			continue
+		}
+		beacons += cd.beacons[b]
+		if clients == nil {
+			clients = make(map[ClientID]bool, len(cd.clients[b]))
+		}
+		for c := range cd.clients[b] {
+			clients[c] = true
+		}
+	}
+	return len(clients), beacons
+}
+
+// Return true if no bucket holds data within the last hour
+func (cd *cellDensity) expired(now int64) bool {
+	for _, m := range cd.minutes {
+		if m > now-densityBuckets {
+			return false
+		}
+	}
+	return true
+}
+
+// CellDensityData is the density of a single cell over a window
+type CellDensityData struct {
+	CellId   string `json:"cellid"`
+	Level    int    `json:"level"`
+	Entities int    `json:"entities"`
+	Beacons  int    `json:"beacons"`
+}
+
+// DensityUpdate is the message published periodically on the density channel
+type DensityUpdate struct {
+	Window string            `json:"window"`
+	Time   int64             `json:"time"`
+	Cells  []CellDensityData `json:"cells"`
+}
+
+// Density aggregates the number of active entities and beacons per cell at
+// several levels over sliding windows.
+type Density struct {
+
+	// Map of levels to the cells at that level and their density
+	levels map[int]map[s2.CellID]*cellDensity
+
+	// A mutex for synchronising the density between threads
+	lock sync.Mutex
+}
+
+func MakeDensity() *Density {
+	d := &Density{levels: make(map[int]map[s2.CellID]*cellDensity)}
+	for _, level := range densityLevels {
+		d.levels[level] = make(map[s2.CellID]*cellDensity)
+	}
+	return d
+}
+
+// Record a beacon from the entity 'entity' using the leaf cell id computed
+// when its cell was last updated.
+func (d *Density) Record(entity *Entity, t time.Time) {
+
+	leaf := entity.cell.leafID
+	if leaf == 0 {
+		return
+	}
+	minute := t.Unix() / 60
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for level, cells := range d.levels {
+		cid := leaf.Parent(level)
+		cd, ok := cells[cid]
+		if !ok {
+			cd = new(cellDensity)
+			cells[cid] = cd
+		}
+		cd.record(entity.clientId, minute)
+	}
+}
+
+// Return the density of all cells at level 'level' over the window 'window'
+// that intersect the rect 'bound' and hold at least 'minEntities' distinct
+// entities. An empty bound matches all cells.
+func (d *Density) Query(level int, window time.Duration, bound s2.Rect, minEntities int) []CellDensityData {
+
+	now := time.Now().Unix() / 60
+	minutes := int64(window / time.Minute)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	data := make([]CellDensityData, 0)
+	for cid, cd := range d.levels[level] {
+		if !bound.IsEmpty() && !bound.IntersectsCell(s2.CellFromCellID(cid)) {
+			continue
+		}
+		entities, beacons := cd.count(now, minutes)
+		if beacons > 0 && entities >= minEntities {
+			data = append(data, CellDensityData{
+				CellId:   strconv.FormatUint(uint64(cid), 10),
+				Level:    level,
+				Entities: entities,
+				Beacons:  beacons,
+			})
+		}
+	}
+	return data
+}
+
+// Remove the cells with no data within the last hour
+func (d *Density) expire() {
+	now := time.Now().Unix() / 60
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, cells := range d.levels {
+		for cid, cd := range cells {
+			if cd.expired(now) {
+				delete(cells, cid)
+			}
+		}
+	}
+}
+
+// Periodically publish the one minute density of the levels served over that
+// window on the density channel using the publisher 'publisher'.
+func (d *Density) Run(publisher *Publisher) {
+	ticker := time.NewTicker(densityPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.expire()
+
+		update := DensityUpdate{Window: "1m", Time: time.Now().Unix(), Cells: make([]CellDensityData, 0)}
+		for _, level := range densityLevels {
+			if densityServed(level, time.Minute) {
+				update.Cells = append(update.Cells, d.Query(level, time.Minute, s2.EmptyRect(), densityMinEntities)...)
+			}
+		}
+
+		message, err := json.Marshal(&update)
+		if err != nil {
+			continue
+		}
+		err = publisher.Publish(densityChannel, message)
+		if err != nil {
+			log.Printf("Failed to publish density: %v", err)
+		}
+	}
+}
+
+// Return the density data 'data' as a GeoJSON FeatureCollection of cell polygons
+func DensityToGeoJSON(data []CellDensityData) ([]byte, error) {
+
+	type geometry struct {
+		Type        string         `json:"type"`
+		Coordinates [][][2]float64 `json:"coordinates"`
+	}
+	type feature struct {
+		Type       string          `json:"type"`
+		Geometry   geometry        `json:"geometry"`
+		Properties CellDensityData `json:"properties"`
+	}
+	type collection struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}
+
+	fc := collection{Type: "FeatureCollection", Features: make([]feature, 0, len(data))}
+	for _, cd := range data {
+		id, err := strconv.ParseUint(cd.CellId, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cell := s2.CellFromCellID(s2.CellID(id))
+		ring := make([][2]float64, 0, 5)
+		for k := 0; k < 4; k++ {
+			ll := s2.LatLngFromPoint(cell.Vertex(k))
+			ring = append(ring, [2]float64{ll.Lng.Degrees(), ll.Lat.Degrees()})
+		}
+		ring = append(ring, ring[0])
+		fc.Features = append(fc.Features, feature{
+			Type:       "Feature",
+			Geometry:   geometry{Type: "Polygon", Coordinates: [][][2]float64{ring}},
+			Properties: cd,
+		})
+	}
+	return json.Marshal(&fc)
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestDensityChannel(t *testing.T) {
+
+	// No group, client feed or inbox can share the density channel
+	channels := []string{groupChannel("density"), groupChannel(densityChannel),
+		entityChannel(ClientID(uuid.New())), inboxChannel(ClientID(uuid.New()))}
+	for _, channel := range channels {
+		if channel == densityChannel {
+			t.Errorf("densityChannel: shared with channel %s", channel)
+		}
+	}
+}
+
+func TestCellDensity(t *testing.T) {
+
+	cd := new(cellDensity)
+	a, b := ClientID(uuid.New()), ClientID(uuid.New())
+	now := int64(1000)
+
+	cd.record(a, now-30)
+	cd.record(a, now)
+	cd.record(b, now)
+	cd.record(a, now)
+
+	if entities, beacons := cd.count(now, 1); entities != 2 || beacons != 3 {
+		t.Errorf("count(1m): expected 2 entities and 3 beacons, got %d and %d", entities, beacons)
+	}
+	if entities, beacons := cd.count(now, 60); entities != 2 || beacons != 4 {
+		t.Errorf("count(1h): expected 2 entities and 4 beacons, got %d and %d", entities, beacons)
+	}
+
+	// A bucket reused an hour later no longer holds the old minute
+	cd.record(b, now+densityBuckets-30)
+	if entities, beacons := cd.count(now+densityBuckets-30, 60); entities != 2 || beacons != 4 {
+		t.Errorf("count: expected 2 entities and 4 beacons after wrap, got %d and %d", entities, beacons)
+	}
+	if cd.expired(now) || !cd.expired(now+2*densityBuckets) {
+		t.Errorf("expired: unexpected result")
+	}
+}
+
+func TestDensityQuery(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	d := MakeDensity()
+	loc := MakeLocation(-34.9287, 138.5999, 0, 0, 0)
+	entity := MakeEntity(nil, ClientID(uuid.New()), TokenID(uuid.New()), MakeCell(&c))
+	entity.cell.Changed(&loc)
+
+	now := time.Now()
+	d.Record(entity, now)
+	d.Record(entity, now)
+
+	for _, level := range densityLevels {
+		data := d.Query(level, time.Minute, s2.EmptyRect(), 1)
+		if len(data) != 1 || data[0].Entities != 1 || data[0].Beacons != 2 || data[0].Level != level {
+			t.Errorf("Query(%d): unexpected density %+v", level, data)
+		}
+	}
+
+	// Cells outside the bound are not returned
+	far := s2.RectFromLatLng(s2.LatLngFromDegrees(51.5, -0.1))
+	if data := d.Query(densityLevels[0], time.Minute, far, 1); len(data) != 0 {
+		t.Errorf("Query: expected no cells outside the bound, got %+v", data)
+	}
+
+	js, err := DensityToGeoJSON(d.Query(densityLevels[0], time.Minute, s2.EmptyRect(), 1))
+	if err != nil || !strings.Contains(string(js), `"Polygon"`) {
+		t.Errorf("DensityToGeoJSON: unexpected result %s, %v", js, err)
+	}
+	var fc struct {
+		Features []json.RawMessage `json:"features"`
+	}
+	if json.Unmarshal(js, &fc) != nil || len(fc.Features) != 1 {
+		t.Errorf("DensityToGeoJSON: expected one feature, got %s", js)
+	}
+}
+
+func TestDensityHandler(t *testing.T) {
+
+	topology := MakeTopology(MakeConfig(250, 15))
+	ctx := &batchContext{topology: &topology}
+	endpoint := MakeEndpoint(ctx)
+	endpoint.entities["t1"] = MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+
+	// A cell holding a single entity, and one holding enough entities
+	now := time.Now()
+	for _, lat := range []float64{-34.9287, 51.5, 51.5, 51.5} {
+		entity := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), topology.MakeCell())
+		entity.cell.Changed(&Location{Lat: lat, Lng: 138.5999})
+		topology.density.Record(entity, now)
+	}
+
+	get := func(token string, query string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/entity/"+token+"/density?"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"tokenid": token})
+		w := httptest.NewRecorder()
+		endpoint.DensityHandler(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	for _, c := range []struct {
+		token string
+		query string
+		code  int
+	}{
+		{"nobody", "", http.StatusBadRequest},
+		{"t1", "level=12", http.StatusBadRequest},
+		{"t1", "level=ten", http.StatusBadRequest},
+		{"t1", "window=2m", http.StatusBadRequest},
+		{"t1", "level=15&window=1m", http.StatusForbidden},
+		{"t1", "level=15", http.StatusOK},
+		{"t1", "level=13&window=1m", http.StatusOK},
+	} {
+		if code, body := get(c.token, c.query); code != c.code {
+			t.Errorf("DensityHandler(%s, %s): status %d, want %d: %s", c.token, c.query, code, c.code, body)
+		}
+	}
+
+	// Only the cell holding enough entities is served
+	code, body := get("t1", "level=15")
+	var fc struct {
+		Features []struct {
+			Properties CellDensityData `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal([]byte(body), &fc); err != nil || code != http.StatusOK {
+		t.Fatalf("DensityHandler: %d %s, %v", code, body, err)
+	}
+	if len(fc.Features) != 1 || fc.Features[0].Properties.Entities != 3 {
+		t.Errorf("DensityHandler: served %+v, want the cell of 3 entities only", fc.Features)
+	}
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// The websocket subprotocols selecting the encoding of the data channel.
+// Clients that do not ask for a subprotocol get JSON.
+const (
+	subprotocolJSON    = "envisilab.json"
+	subprotocolBinary  = "envisilab.binary"
+	subprotocolMsgpack = "envisilab.msgpack"
+)
+
+// The subprotocols offered to clients, in order of preference
+var dataSubprotocols = []string{subprotocolBinary, subprotocolMsgpack, subprotocolJSON}
+
+// The types of frame written by the binary encoding
+const (
+	// A location: seq (8), client id (16), location (32, version 2),
+	// speed (4), course (4) and the source filters: their count (1), then
+	// for each its type (1 byte length, then the bytes) and value (2 byte
+	// length, then the bytes)
+	binaryFrameLocation = 1
+
+	// Any other event, as the JSON the connection would otherwise receive
+	binaryFrameJSON = 2
+)
+
+//
+// eventPayload holds the decoded forms of the payload of an event. It is
+// shared by the events of the same data written to every connection, so
+// that each form is decoded once rather than once per connection.
+//
+type eventPayload struct {
+	userOnce sync.Once
+	userData *UserData
+	userErr  error
+
+	msgpackOnce sync.Once
+	value       interface{}
+	msgpack     []byte
+	msgpackErr  error
+
+	senderOnce sync.Once
+	sender     string
+}
+
+//
+// Return the decoded forms of the payload of the event
+//
+func (event *Event) decoded() *eventPayload {
+	if event.shared == nil {
+		event.shared = new(eventPayload)
+	}
+	return event.shared
+}
+
+//
+// Return the payload 'data' decoded as user data. The user data is empty
+// if the payload could not be decoded.
+//
+func (p *eventPayload) user(data []byte) (*UserData, error) {
+	p.userOnce.Do(func() {
+		p.userData = new(UserData)
+		p.userErr = json.Unmarshal(data, p.userData)
+	})
+	return p.userData, p.userErr
+}
+
+//
+// Return the client id of the sender of the message 'data', or an empty
+// string if it is not a message
+//
+func (p *eventPayload) senderOf(data []byte) string {
+	p.senderOnce.Do(func() {
+		var msg ChatMessage
+		if json.Unmarshal(data, &msg) == nil {
+			p.sender = msg.From
+		}
+	})
+	return p.sender
+}
+
+//
+// Return the JSON payload 'data' decoded, and encoded as MessagePack
+//
+func (p *eventPayload) msgpackOf(data []byte) (interface{}, []byte, error) {
+	p.msgpackOnce.Do(func() {
+		p.value, p.msgpackErr = decodeJSON(data)
+		if p.msgpackErr == nil {
+			buf := new(bytes.Buffer)
+			p.msgpackErr = writeMsgpack(buf, p.value)
+			p.msgpack = buf.Bytes()
+		}
+	})
+	return p.value, p.msgpack, p.msgpackErr
+}
+
+//
+// Return the event 'event' encoded in the encoding selected by the
+// subprotocol 'subprotocol', using the encoder 'enc' for JSON events.
+// Return nil if the event could not be encoded.
+//
+func encodeEvent(subprotocol string, enc *eventEncoder, event *Event) []byte {
+
+	switch subprotocol {
+	case subprotocolBinary:
+		return encodeBinaryEvent(enc, event)
+	case subprotocolMsgpack:
+		return encodeMsgpackEvent(enc, event)
+	}
+	return enc.encode(event)
+}
+
+//
+// Return the websocket message type of the encoding selected by the
+// subprotocol 'subprotocol'
+//
+func encodingMessageType(subprotocol string) int {
+	if subprotocol == subprotocolBinary || subprotocol == subprotocolMsgpack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+//
+// Return the event 'event' as MessagePack, as the JSON the connection would
+// otherwise receive. The payload is encoded once for all connections and
+// only the envelope, or the filters of version 1, for each.
+//
+func encodeMsgpackEvent(enc *eventEncoder, event *Event) []byte {
+
+	if !enc.writes(event) {
+		return nil
+	}
+	value, payload, err := event.decoded().msgpackOf(event.Payload)
+	if err != nil {
+		log.Printf("Encoding: failed to encode MessagePack: %v", err)
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	if enc.version < eventVersionEnvelope {
+		data, ok := value.(map[string]interface{})
+		if len(event.Source) == 0 || !ok {
+			return payload
+		}
+		tagged := make(map[string]interface{}, len(data)+1)
+		for k, v := range data {
+			tagged[k] = v
+		}
+		tagged["filters"] = msgpackFilters(event.Source)
+		err = writeMsgpack(buf, tagged)
+	} else {
+		err = writeMsgpackEnvelope(buf, enc.envelope(event), payload)
+	}
+	if err != nil {
+		log.Printf("Encoding: failed to encode MessagePack: %v", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+//
+// Write the envelope 'env' as MessagePack, with the payload already encoded
+// as 'payload', in the same sorted order as its JSON
+//
+func writeMsgpackEnvelope(buf *bytes.Buffer, env *Envelope, payload []byte) error {
+
+	n := 4
+	if len(env.Source) > 0 {
+		n++
+	}
+	writeMsgpackLength(buf, n, 0x80, 0xde)
+	writeMsgpack(buf, "payload")
+	buf.Write(payload)
+	writeMsgpack(buf, "seq")
+	writeMsgpackInt(buf, int64(env.Seq))
+	if len(env.Source) > 0 {
+		writeMsgpack(buf, "source")
+		if err := writeMsgpack(buf, msgpackFilters(env.Source)); err != nil {
+			return err
+		}
+	}
+	writeMsgpack(buf, "ts")
+	writeMsgpackInt(buf, env.Time)
+	writeMsgpack(buf, "type")
+	return writeMsgpack(buf, env.Type)
+}
+
+// Return the filters 'filters' as the values of their JSON
+func msgpackFilters(filters []UserFilter) []interface{} {
+	values := make([]interface{}, len(filters))
+	for i, f := range filters {
+		value := map[string]interface{}{"filtertype": f.Type, "filtervalue": f.Value}
+		if f.Action != "" {
+			value["action"] = f.Action
+		}
+		values[i] = value
+	}
+	return values
+}
+
+//
+// Return the event 'event' as a binary frame. Locations are written in the
+// compact binary location format, all other events, and locations whose
+// source filters do not fit the format, as JSON.
+//
+func encodeBinaryEvent(enc *eventEncoder, event *Event) []byte {
+
+	buf := new(bytes.Buffer)
+	if event.Type == EventLocation && binarySourceFits(event.Source) {
+		userData, err := event.decoded().user(event.Payload)
+		clientId, uerr := uuid.Parse(userData.ClientId)
+		if err == nil && uerr == nil {
+			buf.WriteByte(binaryFrameLocation)
+			binary.Write(buf, binary.BigEndian, enc.nextSeq())
+			binary.Write(buf, binary.BigEndian, &clientId)
+			SerializeVersion(&userData.Location, buf, 2)
+			binary.Write(buf, binary.BigEndian, float32(userData.Speed))
+			binary.Write(buf, binary.BigEndian, float32(userData.Course))
+			buf.WriteByte(byte(len(event.Source)))
+			for _, f := range event.Source {
+				buf.WriteByte(byte(len(f.Type)))
+				buf.WriteString(f.Type)
+				binary.Write(buf, binary.BigEndian, uint16(len(f.Value)))
+				buf.WriteString(f.Value)
+			}
+			return buf.Bytes()
+		}
+	}
+
+	js := enc.encode(event)
+	if js == nil {
+		return nil
+	}
+	buf.WriteByte(binaryFrameJSON)
+	buf.Write(js)
+	return buf.Bytes()
+}
+
+// Return true if the filters 'filters' fit the binary location format
+func binarySourceFits(filters []UserFilter) bool {
+	if len(filters) > math.MaxUint8 {
+		return false
+	}
+	for _, f := range filters {
+		if len(f.Type) > math.MaxUint8 || len(f.Value) > math.MaxUint16 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMsgpackEnvelope(t *testing.T) {
+
+	payload := []byte(`{"clientid":"c1","location":{"lat":51.5,"lng":-0.125},"speed":-3}`)
+	mp, err := jsonToMsgpack(payload)
+	if err != nil {
+		t.Fatalf("Failed to encode payload: %v", err)
+	}
+
+	for _, source := range [][]UserFilter{
+		nil,
+		{{Type: "cell", Value: "487604"}, {Type: "group", Value: "g1", Action: "add"}},
+	} {
+		env := &Envelope{Type: EventLocation, Source: source, Time: 1700000000123, Seq: 4294967296, Payload: payload}
+		js, _ := json.Marshal(env)
+		want, err := jsonToMsgpack(js)
+		if err != nil {
+			t.Fatalf("Failed to encode envelope: %v", err)
+		}
+		buf := new(bytes.Buffer)
+		if err := writeMsgpackEnvelope(buf, env, mp); err != nil {
+			t.Fatalf("Failed to write envelope: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("Envelope with %d filters encoded as % x, want % x", len(source), buf.Bytes(), want)
+		}
+	}
+}
+
+func TestMsgpackEvent(t *testing.T) {
+
+	payload := []byte(`{"clientid":"c1","location":{"lat":1,"lng":2}}`)
+	source := []UserFilter{{Type: "region", Value: "r1"}}
+	shared := new(eventPayload)
+	first := &Event{Type: EventLocation, Source: source, Payload: payload, shared: shared}
+	second := &Event{Type: EventLocation, Payload: payload, shared: shared}
+
+	legacy := makeEventEncoder(eventVersionLegacy)
+	want, _ := jsonToMsgpack(tagMessage(payload, source))
+	if got := encodeMsgpackEvent(&legacy, first); !bytes.Equal(got, want) {
+		t.Errorf("Tagged event encoded as % x, want % x", got, want)
+	}
+	if shared.msgpack == nil {
+		t.Errorf("Payload not shared between events")
+	}
+	want, _ = jsonToMsgpack(payload)
+	if got := encodeMsgpackEvent(&legacy, second); !bytes.Equal(got, want) {
+		t.Errorf("Untagged event encoded as % x, want % x", got, want)
+	}
+	if got := encodeMsgpackEvent(&legacy, &Event{Type: EventPresence, Payload: payload}); got != nil {
+		t.Errorf("Presence written to version 1 client")
+	}
+
+	enc := makeEventEncoder(eventVersionEnvelope)
+	encodeMsgpackEvent(&enc, second)
+	v, err := readMsgpack(bytes.NewReader(encodeMsgpackEvent(&enc, first)))
+	if err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	env := v.(map[string]interface{})
+	if env["seq"] != int64(2) || env["type"] != EventLocation {
+		t.Errorf("Envelope %v, want seq 2 of a location", env)
+	}
+	filters := env["source"].([]interface{})
+	if len(filters) != 1 || filters[0].(map[string]interface{})["filtervalue"] != "r1" {
+		t.Errorf("Envelope source %v, want region r1", filters)
+	}
+	if env["payload"].(map[string]interface{})["clientid"] != "c1" {
+		t.Errorf("Envelope payload %v, want client c1", env["payload"])
+	}
+}
+
+func TestBinaryLocationFrame(t *testing.T) {
+
+	clientId := uuid.New()
+	userData := UserData{
+		ClientId: clientId.String(),
+		Location: Location{Lat: 51.5, Lng: -0.125, Alt: 12, Heading: 90, Timestamp: 1700000000, Nanos: 250000000},
+		Speed:    3.5,
+		Course:   180,
+	}
+	payload, _ := json.Marshal(&userData)
+	source := []UserFilter{{Type: "cell", Value: "487604"}, {Type: "region", Value: "r1"}}
+
+	enc := makeEventEncoder(eventVersionEnvelope)
+	frame := encodeBinaryEvent(&enc, &Event{Type: EventLocation, Source: source, Payload: payload})
+	buf := bytes.NewBuffer(frame)
+
+	if kind, _ := buf.ReadByte(); kind != binaryFrameLocation {
+		t.Fatalf("Frame type %d, want a location", kind)
+	}
+	var seq uint64
+	var id uuid.UUID
+	var loc Location
+	var speed, course float32
+	binary.Read(buf, binary.BigEndian, &seq)
+	binary.Read(buf, binary.BigEndian, &id)
+	DeserializeVersion(&loc, buf, 2)
+	binary.Read(buf, binary.BigEndian, &speed)
+	binary.Read(buf, binary.BigEndian, &course)
+	if seq != 1 || id != clientId || speed != 3.5 || course != 180 {
+		t.Errorf("Frame seq %d, client %v, speed %v, course %v", seq, id, speed, course)
+	}
+	if loc.Lat != 51.5 || loc.Lng != -0.125 || loc.Alt != 12 || loc.UnixMilli() != userData.Location.UnixMilli() {
+		t.Errorf("Frame location %+v, want %+v", loc, userData.Location)
+	}
+
+	count, _ := buf.ReadByte()
+	var filters []UserFilter
+	for i := 0; i < int(count); i++ {
+		var f UserFilter
+		n, _ := buf.ReadByte()
+		f.Type = string(buf.Next(int(n)))
+		var m uint16
+		binary.Read(buf, binary.BigEndian, &m)
+		f.Value = string(buf.Next(int(m)))
+		filters = append(filters, f)
+	}
+	if len(filters) != 2 || filters[0] != source[0] || filters[1] != source[1] {
+		t.Errorf("Frame source %v, want %v", filters, source)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left in the frame", buf.Len())
+	}
+
+	// Events the location format cannot hold are written as JSON
+	long := []UserFilter{{Type: strings.Repeat("t", 256), Value: "v"}}
+	for _, event := range []*Event{
+		{Type: EventLocation, Source: long, Payload: payload},
+		{Type: EventLocation, Payload: []byte(`{"clientid":"not a uuid"}`)},
+		{Type: EventMessage, Payload: []byte(`{"text":"hello"}`)},
+	} {
+		frame := encodeBinaryEvent(&enc, event)
+		if len(frame) == 0 || frame[0] != binaryFrameJSON || !json.Valid(frame[1:]) {
+			t.Errorf("%s event not written as a JSON frame: %q", event.Type, frame)
+		}
+	}
+}
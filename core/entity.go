@@ -1,6 +1,11 @@
 package core
 
 import (
+	"sync"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/google/uuid"
 )
 
 
@@ -23,6 +28,31 @@ type Entity struct {
 
 	// The subscription used for this Entity
 	subscription *Subscription
+
+	// True while the Entity is in standby mode
+	standby bool
+
+	// The presence last published for the Entity: online, standby, offline
+	// or empty before its first beacon
+	presence string
+
+	// The motion model of the Entity
+	motion Motion
+
+	// The Kalman filter smoothing the locations of the Entity
+	kalman kalmanFilter
+
+	// The offset of the Entity's clock from the server clock (client - server)
+	clockOffset time.Duration
+
+	// The clients blocked by the client of this Entity, whose messages it
+	// does not receive, keyed by client UUID string
+	blocked map[string]bool
+
+	// The limit on the messages the Entity sends to single clients and to
+	// the entities around it
+	messageLimit rateLimiter
+	messageLock  sync.Mutex
 }
 
 func MakeEntity(ctx Context, clientId ClientID, tokenId TokenID, c *Cell) *Entity {
@@ -32,6 +62,8 @@ func MakeEntity(ctx Context, clientId ClientID, tokenId TokenID, c *Cell) *Entit
 	e.cell = c
 	e.groups = make([]Group, 0)
 	e.subscription = MakeSubscription(ctx)
+	e.kalman.variance = -1
+	e.messageLimit = makeRateLimiter(messageRatePerSec, messageBurst, time.Now())
 	return e
 }
 
@@ -39,17 +71,67 @@ func (e *Entity) SetGroups(groups []Group) {
 	e.groups = groups
 }
 
+// Set the clients blocked by the client of the Entity
+func (e *Entity) SetBlocked(clientIds []ClientID) {
+	e.blocked = make(map[string]bool, len(clientIds))
+	for _, clientId := range clientIds {
+		e.blocked[uuid.UUID(clientId).String()] = true
+	}
+}
+
+// Return true if the client of the Entity blocked the client 'clientId'
+func (e *Entity) blocks(clientId string) bool {
+	return e.blocked[clientId]
+}
+
+// Return true if the Entity may send a message limited by rate at 'now'
+func (e *Entity) allowMessage(now time.Time) bool {
+	e.messageLock.Lock()
+	defer e.messageLock.Unlock()
+	return e.messageLimit.allow(now)
+}
+
 func (e *Entity) Update(loc Location) {
 
+	e.motion.Update(loc)
 	e.location = loc
 	if !e.cell.Changed(&e.location) {
 		return
 	}
 
 	cellCpy := *e.cell	// subscription operates on a cell copy
+	cellCpy.cellGroup = append([]s2.CellID(nil), e.cell.cellGroup...)
 	e.subscription.setCellFilter(&cellCpy)
 }
 
+func (e *Entity) SetStandby(standby bool) {
+	e.standby = standby
+
+	// An entity in standby no longer counts towards the occupancy
+	if standby && e.cell != nil {
+		e.cell.release()
+	}
+}
+
+func (e *Entity) GetMotion() *Motion {
+	return &e.motion
+}
+
+// Set the offset of the Entity's clock from the server clock
+func (e *Entity) SetClockOffset(offset time.Duration) {
+	e.clockOffset = offset
+}
+
+// Return the offset of the Entity's clock from the server clock
+func (e *Entity) ClockOffset() time.Duration {
+	return e.clockOffset
+}
+
+// Return the position of the Entity predicted at the time 't'
+func (e *Entity) PredictLocation(t time.Time) Location {
+	return e.motion.Predict(t)
+}
+
 func (e *Entity) GetClientId() ClientID {
 	return e.clientId
 }
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The types of event written to a connection
+const (
+	EventLocation = "location"
+	EventPresence = "presence"
+	EventGeofence = "geofence"
+	EventDensity  = "density"
+	EventSystem   = "system"
+	EventReply    = "reply"
+	EventMessage  = "message"
+	EventSOS      = "sos"
+)
+
+// The versions of the format of the events written to a connection
+const (
+	// Version 1 writes the payload of each event as is, tagged with the
+	// filters that matched it
+	eventVersionLegacy = 1
+
+	// Version 2 writes each event within an Envelope
+	eventVersionEnvelope = 2
+)
+
+//
+// Event is a message to be written to a connection. The payload is the JSON
+// of the event itself, such as the UserData of a location event.
+//
+type Event struct {
+
+	// The type of the event
+	Type string
+
+	// The filters through which the event was received, if any
+	Source []UserFilter
+
+	// The JSON payload of the event
+	Payload []byte
+
+	// The decoded forms of the payload, shared with the events of the same
+	// data written to other connections
+	shared *eventPayload
+
+	// The sequence number reserved for the event, or zero to number it as
+	// the next event when it is encoded
+	seq uint64
+}
+
+//
+// Envelope is the version 2 format of an Event written to a connection
+//
+type Envelope struct {
+
+	// The type of the event
+	Type string `json:"type"`
+
+	// The filters through which the event was received, if any
+	Source []UserFilter `json:"source,omitempty"`
+
+	// The server time the event was written, in milliseconds
+	Time int64 `json:"ts"`
+
+	// The sequence number of the event on the connection, starting at 1.
+	// A gap in the sequence means events were dropped.
+	Seq uint64 `json:"seq"`
+
+	// The event itself
+	Payload json.RawMessage `json:"payload"`
+}
+
+//
+// Return the event type of the data 'data' received through the filters
+// 'filters'
+//
+func eventTypeOf(filters []UserFilter, data []byte) string {
+	if isMessage(data) {
+		return EventMessage
+	}
+	if isSOS(data) {
+		return EventSOS
+	}
+	if isPresence(data) {
+		return EventPresence
+	}
+	for _, f := range filters {
+		if f.Type == "density" {
+			return EventDensity
+		}
+	}
+	return EventLocation
+}
+
+//
+// Return the event version requested by the client making the request
+// 'req', either in the 'v' query parameter or the Event-Version header. It
+// is independent of the message version of the Content-Version header.
+// Clients that do not ask for a version get the version 1 format.
+//
+func negotiateEventVersion(req *http.Request) int {
+
+	v := req.URL.Query().Get("v")
+	if v == "" {
+		v = req.Header.Get("Event-Version")
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < eventVersionLegacy {
+		return eventVersionLegacy
+	}
+	if version > eventVersionEnvelope {
+		return eventVersionEnvelope
+	}
+	return version
+}
+
+//
+// eventEncoder encodes the events written to a single connection in the
+// version negotiated by the connection.
+//
+type eventEncoder struct {
+
+	// The negotiated event version
+	version int
+
+	// The sequence number of the last event encoded
+	seq uint64
+
+	// The sequence number of the latest event acknowledged by the client
+	acked uint64
+}
+
+func makeEventEncoder(version int) eventEncoder {
+	return eventEncoder{version: version}
+}
+
+//
+// Return the sequence number of the next event, or zero before version 2
+//
+func (enc *eventEncoder) nextSeq() uint64 {
+	if enc.version < eventVersionEnvelope {
+		return 0
+	}
+	return atomic.AddUint64(&enc.seq, 1)
+}
+
+//
+// Record that the client received the events up to the sequence number
+// 'seq'. Acknowledgements of events not yet written are rejected.
+//
+func (enc *eventEncoder) acknowledge(seq uint64) error {
+	if enc.version < eventVersionEnvelope {
+		return errors.New("Events are only numbered from version 2")
+	}
+	if seq > atomic.LoadUint64(&enc.seq) {
+		return errors.New("Acknowledged event not yet written")
+	}
+	for {
+		acked := atomic.LoadUint64(&enc.acked)
+		if seq <= acked || atomic.CompareAndSwapUint64(&enc.acked, acked, seq) {
+			return nil
+		}
+	}
+}
+
+//
+// Return the event 'event' encoded in the negotiated version, or nil if the
+// event cannot be written in that version
+//
+func (enc *eventEncoder) encode(event *Event) []byte {
+
+	if !enc.writes(event) {
+		return nil
+	}
+	if enc.version < eventVersionEnvelope {
+		if len(event.Source) > 0 {
+			return tagMessage(event.Payload, event.Source)
+		}
+		return event.Payload
+	}
+
+	js, err := json.Marshal(enc.envelope(event))
+	if err != nil {
+		return event.Payload
+	}
+	return js
+}
+
+//
+// Return true if the event 'event' can be written in the negotiated version
+//
+func (enc *eventEncoder) writes(event *Event) bool {
+	// Older clients only understand user data
+	return enc.version >= eventVersionEnvelope ||
+		(event.Type != EventPresence && event.Type != EventGeofence)
+}
+
+//
+// Return the envelope of the event 'event', numbered as the next event
+// unless a sequence number was reserved for it
+//
+func (enc *eventEncoder) envelope(event *Event) *Envelope {
+	seq := event.seq
+	if seq == 0 {
+		seq = enc.nextSeq()
+	}
+	return &Envelope{
+		Type:    event.Type,
+		Source:  event.Source,
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+		Seq:     seq,
+		Payload: json.RawMessage(event.Payload),
+	}
+}
+
+//
+// Return true if the client acknowledged the event numbered 'seq'
+//
+func (enc *eventEncoder) acknowledged(seq uint64) bool {
+	return seq != 0 && seq <= atomic.LoadUint64(&enc.acked)
+}
+
+// SystemEvent is the payload of a system event
+type SystemEvent struct {
+
+	// The name of the system event, such as "welcome"
+	Event string `json:"event"`
+
+	// The event version negotiated by the connection
+	Version int `json:"version,omitempty"`
+
+	// The server time in milliseconds
+	Time int64 `json:"time_ms"`
+}
+
+//
+// Return a system event named 'name' for a connection using the event
+// version 'version'
+//
+func makeSystemEvent(name string, version int) *Event {
+	payload, _ := json.Marshal(&SystemEvent{
+		Event:   name,
+		Version: version,
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	return &Event{Type: EventSystem, Payload: payload}
+}
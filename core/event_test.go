@@ -0,0 +1,119 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEventVersion(t *testing.T) {
+
+	tests := []struct {
+		query    string
+		header   string
+		value    string
+		expected int
+	}{
+		{"", "", "", eventVersionLegacy},
+		{"?v=2", "", "", eventVersionEnvelope},
+		{"?v=9", "", "", eventVersionEnvelope},
+		{"?v=x", "", "", eventVersionLegacy},
+		{"", "Event-Version", "2", eventVersionEnvelope},
+
+		// The message version does not select the event version
+		{"", "Content-Version", "2", eventVersionLegacy},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/data"+test.query, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		if version := negotiateEventVersion(req); version != test.expected {
+			t.Errorf("negotiateEventVersion(%s %s: %s): expected %d, got %d", test.query, test.header, test.value, test.expected, version)
+		}
+	}
+}
+
+func TestEventEncoder(t *testing.T) {
+
+	location := &Event{Type: EventLocation, Source: []UserFilter{{Type: "local"}}, Payload: []byte(`{"clientid":"a"}`)}
+	presence := &Event{Type: EventPresence, Payload: []byte(`{"type":"presence","state":"online"}`)}
+
+	// Version 1 writes the tagged payload, and nothing it cannot represent
+	legacy := makeEventEncoder(eventVersionLegacy)
+	if js := string(legacy.encode(location)); js != `{"filters":[{"filtertype":"local","filtervalue":""}],"clientid":"a"}` {
+		t.Errorf("encode(v1): unexpected location %s", js)
+	}
+	if js := legacy.encode(presence); js != nil {
+		t.Errorf("encode(v1): expected no presence, got %s", js)
+	}
+
+	// Version 2 writes envelopes numbered from 1
+	enc := makeEventEncoder(eventVersionEnvelope)
+	for i, event := range []*Event{location, presence, location} {
+		var env Envelope
+		if err := json.Unmarshal(enc.encode(event), &env); err != nil {
+			t.Fatalf("encode(v2): %v", err)
+		}
+		if env.Seq != uint64(i+1) || env.Type != event.Type || string(env.Payload) != string(event.Payload) || env.Time == 0 {
+			t.Errorf("encode(v2): unexpected envelope %+v", env)
+		}
+		if len(env.Source) != len(event.Source) {
+			t.Errorf("encode(v2): expected source %v, got %v", event.Source, env.Source)
+		}
+	}
+}
+
+func TestEventTypeOf(t *testing.T) {
+
+	tests := []struct {
+		filters  []UserFilter
+		data     string
+		expected string
+	}{
+		{nil, `{"clientid":"a"}`, EventLocation},
+		{nil, `{"type":"presence","clientid":"a"}`, EventPresence},
+		{nil, `{"type":"message","id":"1"}`, EventMessage},
+		{nil, `{"type":"sos","id":"1"}`, EventSOS},
+		{[]UserFilter{{Type: "density"}}, `{"window":"1m"}`, EventDensity},
+	}
+	for _, test := range tests {
+		if eventType := eventTypeOf(test.filters, []byte(test.data)); eventType != test.expected {
+			t.Errorf("eventTypeOf(%s): expected %s, got %s", test.data, test.expected, eventType)
+		}
+	}
+}
+
+func TestGeofence(t *testing.T) {
+
+	fc := &filterChannels{filter: UserFilter{Type: "region", Value: "park"}}
+	userData := &UserData{ClientId: "a", Location: MakeLocation(-34.9287, 138.5999, 0, 0, 100)}
+
+	steps := []struct {
+		inside   bool
+		expected string
+	}{
+		{false, ""},
+		{true, geofenceEnter},
+		{true, ""},
+		{false, geofenceExit},
+		{false, ""},
+		{true, geofenceEnter},
+	}
+	for i, step := range steps {
+		event := fc.crossed(userData, step.inside)
+		if step.expected == "" {
+			if event != nil {
+				t.Errorf("crossed(%d): unexpected event %s", i, event.Payload)
+			}
+			continue
+		}
+		var geofence GeofenceEvent
+		if event == nil || event.Type != EventGeofence || json.Unmarshal(event.Payload, &geofence) != nil {
+			t.Fatalf("crossed(%d): expected a geofence event, got %+v", i, event)
+		}
+		if geofence.Event != step.expected || geofence.Region != "park" || geofence.ClientId != "a" {
+			t.Errorf("crossed(%d): unexpected geofence event %+v", i, geofence)
+		}
+	}
+}
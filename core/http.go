@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"errors"
 	"net/http"
+	"sort"
+	"strconv"
+	"github.com/golang/geo/s2"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -24,21 +27,33 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, large enough for a GeoJSON
+	// region filter of a few hundred positions, or a message command with
+	// the longest text or data.
+	maxMessageSize = 16384
 
 	// The maximum amount of time in seconds that we can tolerate
 	toleranceSec = 5
 
 	// Cleanup period
 	cleanupPeriodSec = 30 * time.Second
+
+	// The largest radius accepted by a nearby query
+	maxNearbyRadiusMeters = 50000
+
+	// The largest clock offset accepted from a client
+	maxClockOffset = 24 * time.Hour
+
+	// The default and largest number of entities returned by a nearest query
+	defaultNearestK = 10
+	maxNearestK = 100
 )
 
-func inSync(t int64) bool {
-    now := time.Now().Unix()
-	if t > now + toleranceSec || t < now - toleranceSec {
+func inSync(t time.Time) bool {
+    drift := t.Sub(time.Now())
+	if drift > toleranceSec * time.Second || drift < -toleranceSec * time.Second {
 		// Not within 5 seconds of the server time.
-		log.Printf("Client/Server time not synchronised (%d seconds)", t-now)
+		log.Printf("Client/Server time not synchronised (%.3f seconds)", drift.Seconds())
 		return false
 	}
 	return true
@@ -54,6 +69,14 @@ type DataResponse struct {
   Activities []Activity `json:"activities"`
 }
 
+type NearbyResponse struct {
+  Entities []UserData `json:"entities"`
+}
+
+type NearestResponse struct {
+  Entities []Neighbour `json:"entities"`
+}
+
 //
 //
 //
@@ -68,16 +91,48 @@ type Endpoint struct {
 	// A Read/Write lock for synchronising entities
 	lock sync.RWMutex
 
+	// A cache of rendered map tiles
+	tiles *tileCache
+
+	// The pipeline processing the locations received from entities
+	pipeline LocationPipeline
+
+	// The streams of the entities reading their data without a websocket
+	streams map[*Entity]*StreamConnection
+
+	// Map of short ids to entities, for trackers sending beacon datagrams
+	shortIds map[uint32]*Entity
+
+	// The SOS alerts raised by entities
+	sos *SOSService
+
 }
 
 func MakeEndpoint(ctx Context) Endpoint {
 	e := Endpoint{
 		ctx: ctx,
 		entities: make(map[string]*Entity),
+		streams: make(map[*Entity]*StreamConnection),
+		shortIds: make(map[uint32]*Entity),
+		tiles: makeTileCache(),
+		pipeline: MakeLocationPipeline(&ctx.GetTopology().config),
+		sos: MakeSOSService(ctx, &ctx.GetTopology().config),
 	}
 	return e
 }
 
+// An SOS alert queued on a websocket connection
+type pendingSOS struct {
+
+	// The encoded alert and its sequence number, zero before version 2
+	message []byte
+	seq     uint64
+
+	// The times the alert was queued and last written
+	queued  time.Time
+	written time.Time
+}
+
 //
 //
 //
@@ -94,14 +149,33 @@ type WebSocketConnection struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// The SOS alerts written before all other messages, by alert id. Each
+	// is kept and written again until the client acknowledges it, so that
+	// none is dropped.
+	sos     map[string]*pendingSOS
+	sosLock sync.Mutex
+
+	// Signalled when an SOS alert is queued
+	sosReady chan struct{}
+
+	// The encoder of the events written to this connection
+	encoder eventEncoder
+
+	// The subprotocol selecting the encoding of this connection
+	subprotocol string
 }
 
-func MakeWebSocketConnection(entity *Entity, endpoint *Endpoint, conn *websocket.Conn) *WebSocketConnection {
+func MakeWebSocketConnection(entity *Entity, endpoint *Endpoint, conn *websocket.Conn, version int) *WebSocketConnection {
 	c := &WebSocketConnection{
 		entity: entity,
 		endpoint: endpoint,
 		conn: conn,
 		send: make(chan []byte, 100),
+		sos: make(map[string]*pendingSOS),
+		sosReady: make(chan struct{}, 1),
+		encoder: makeEventEncoder(version),
+		subprotocol: conn.Subprotocol(),
 	}
 	return c
 }
@@ -110,15 +184,20 @@ func (c *WebSocketConnection) GetEntity() *Entity {
 	return c.entity
 }
 
+// Record that the client received the events up to sequence number 'seq'
+func (c *WebSocketConnection) acknowledge(seq uint64) error {
+	return c.encoder.acknowledge(seq)
+}
+
 // Continually read some data from the web socket connection and publish it
 func (c *WebSocketConnection) ReadPump() {
 
-	// Start the Subscription for the associated Entity using the current connection
-	go c.entity.subscription.Start(c)
+	// Attach the current connection to the Subscription of the associated Entity
+	c.entity.subscription.Start(c)
 
 	defer func() {
-		// Stop the subscription and hence unsubscribe this connection
-		c.entity.subscription.Stop()
+		// Detach this connection, stopping the subscription if it was the last
+		c.entity.subscription.Stop(c)
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
@@ -133,29 +212,42 @@ func (c *WebSocketConnection) ReadPump() {
 			break
 		}
 
-		// Create a UserFilter instance
-		userFilter := UserFilter{}
-
-		// Decode the received user filter
-		err = json.Unmarshal(message, &userFilter)
-		if err != nil {
-			log.Printf("error: %v", err)
-	    		continue
-	    }
-
-		c.entity.subscription.setUserFilter(&userFilter)
+		// Handle the received command, or bare user filter
+		reply := c.endpoint.handleCommand(c.entity, c, message)
+		if reply != nil {
+			c.Write(&Event{Type: EventReply, Payload: reply})
+		}
 	}
 }
 
 // Continually receive subscribed data and write it to the web socket connection
 func (c *WebSocketConnection) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
+	redeliver := time.NewTicker(sosRedeliverPeriod)
 	defer func() {
 		ticker.Stop()
+		redeliver.Stop()
 		c.conn.Close()
 	}()
 	for {
+		// Write the SOS alerts before any other messages
 		select {
+		case <-c.sosReady:
+			if err := c.writeSOS(time.Now()); err != nil {
+				return
+			}
+		default:
+		}
+
+		select {
+		case <-c.sosReady:
+			if err := c.writeSOS(time.Now()); err != nil {
+				return
+			}
+		case now := <-redeliver.C:
+			if err := c.writeSOS(now); err != nil {
+				return
+			}
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
@@ -164,7 +256,16 @@ func (c *WebSocketConnection) WritePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			messageType := encodingMessageType(c.subprotocol)
+			if messageType == websocket.BinaryMessage {
+				// Binary encodings write each message in its own frame
+				if err := c.conn.WriteMessage(messageType, message); err != nil {
+					return
+				}
+				continue
+			}
+
+			w, err := c.conn.NextWriter(messageType)
 			if err != nil {
 				return
 			}
@@ -191,7 +292,117 @@ func (c *WebSocketConnection) WritePump() {
 	}
 }
 
-func (c *WebSocketConnection) Write(message []byte) {
+//
+// Write the priority message 'message' to the websocket in its own frame,
+// rather than batched with other queued messages
+//
+func (c *WebSocketConnection) writePriority(message []byte) error {
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	messageType := encodingMessageType(c.subprotocol)
+	if messageType == websocket.BinaryMessage {
+		return c.conn.WriteMessage(messageType, message)
+	}
+
+	// JSON messages are always written as an array
+	buf := make([]byte, 0, len(message)+2)
+	buf = append(buf, '[')
+	buf = append(buf, message...)
+	buf = append(buf, ']')
+	return c.conn.WriteMessage(messageType, buf)
+}
+
+//
+// Write the queued SOS alerts due at the time 'now'
+//
+func (c *WebSocketConnection) writeSOS(now time.Time) error {
+	for _, message := range c.dueSOS(now) {
+		if err := c.writePriority(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Queue the SOS alert 'event' to be written before any other message. It
+// replaces the earlier state of the same alert, acknowledged or not.
+//
+func (c *WebSocketConnection) queueSOS(event *Event, now time.Time) {
+
+	var alert SOSAlert
+	if err := json.Unmarshal(event.Payload, &alert); err != nil || alert.Id == "" {
+		log.Printf("WebSocket: invalid SOS alert not written")
+		return
+	}
+
+	// The alert keeps its sequence number each time it is written, so the
+	// client acknowledges it once
+	sos := *event
+	sos.seq = c.encoder.nextSeq()
+	message := encodeEvent(c.subprotocol, &c.encoder, &sos)
+	if message == nil {
+		return
+	}
+
+	c.sosLock.Lock()
+	c.sos[alert.Id] = &pendingSOS{message: message, seq: sos.seq, queued: now}
+	c.sosLock.Unlock()
+
+	select {
+	case c.sosReady <- struct{}{}:
+	default:
+		// The writer is already signalled
+	}
+}
+
+//
+// Return the queued SOS alerts to write at the time 'now', oldest first:
+// those not yet written, and those not acknowledged since they were last
+// written. Alerts acknowledged, queued for longer than an alert repeats or
+// written to a client that does not acknowledge events are removed.
+//
+func (c *WebSocketConnection) dueSOS(now time.Time) [][]byte {
+
+	c.sosLock.Lock()
+	due := make([]*pendingSOS, 0, len(c.sos))
+	for id, p := range c.sos {
+		if c.encoder.acknowledged(p.seq) || now.Sub(p.queued) > sosExpiry {
+			delete(c.sos, id)
+			continue
+		}
+		if !p.written.IsZero() && now.Sub(p.written) < sosRedeliverPeriod {
+			continue
+		}
+		p.written = now
+		due = append(due, p)
+		if p.seq == 0 {
+			// Events are only acknowledged from version 2
+			delete(c.sos, id)
+		}
+	}
+	c.sosLock.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].queued.Before(due[j].queued)
+	})
+	messages := make([][]byte, len(due))
+	for i, p := range due {
+		messages[i] = p.message
+	}
+	return messages
+}
+
+func (c *WebSocketConnection) Write(event *Event) {
+	if event.Type == EventSOS {
+		// SOS alerts bypass the queue of other messages
+		c.queueSOS(event, time.Now())
+		return
+	}
+	message := encodeEvent(c.subprotocol, &c.encoder, event)
+	if message == nil {
+		return
+	}
 	select {
 	case c.send <- message:
 	default:
@@ -203,6 +414,11 @@ func (c *WebSocketConnection) Write(message []byte) {
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+
+	// Clients choose the encoding of the data channel by subprotocol, and
+	// may negotiate permessage-deflate
+	Subprotocols:      dataSubprotocols,
+	EnableCompression: true,
 }
 
 
@@ -219,14 +435,43 @@ func ServeHTTPS_V1(ctx Context) {
 
     router := mux.NewRouter()
 
+	router.HandleFunc("/api/v1/time", endpoint.TimeHandler)
 	router.HandleFunc("/api/v1/entity/sync", endpoint.SyncHandler)
 	router.HandleFunc("/api/v1/entity/{tokenid}/standby", endpoint.StandbyHandler)
 	router.HandleFunc("/api/v1/entity/{tokenid}/beacon", endpoint.BeaconHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/beacons", endpoint.BeaconsHandler)
 	router.HandleFunc("/api/v1/entity/{tokenid}/data", endpoint.DataHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/events", endpoint.EventsHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/poll", endpoint.PollHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/command", endpoint.CommandHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/groups/{groupid}/messages", endpoint.MessagesHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/nearby", endpoint.NearbyHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/nearest", endpoint.NearestHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/density", endpoint.DensityHandler)
+	router.HandleFunc("/api/v1/entity/{tokenid}/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{format:png|geojson}", endpoint.TileHandler)
 	//router.HandleFunc("/api/v1/entity/{tokenid}/complete", endpoint.CompleteHandler)
 	router.HandleFunc("/api/v1/entity/{tokenid}/download", endpoint.DownloadHandler)
 	http.Handle("/", router)
 
+	// Repeat SOS alerts until they are acknowledged
+	go endpoint.sos.Run()
+
+	// Receive beacon datagrams from low power trackers, if configured
+	config := &ctx.GetTopology().config
+	if config.udpAddr != "" {
+		go func() {
+			err := MakeUDPListener(&endpoint, config.udpKey).Listen(config.udpAddr)
+			if err != nil {
+				log.Printf("UDP Beacon Service stopped: %v", err)
+			}
+		}()
+	}
+
+	// Bridge the devices of an MQTT broker, if configured
+	if config.mqttAddr != "" {
+		go MakeMQTTBridge(&endpoint, config.service).Run(config.mqttAddr)
+	}
+
     log.Print("HTTPS Service Started on Port 9443\n")
 
     // Use ListenAndServeTLS() instead of ListenAndServe() which accepts two extra parameters.
@@ -246,6 +491,22 @@ type SyncRequest struct {
 
 	// The client current time for sync
 	Time int64 `json:"time"`
+
+	// The client current time in milliseconds (version 2 clients)
+	TimeMs int64 `json:"time_ms,omitempty"`
+
+	// The clock offset (client - server) and round trip time estimated by
+	// the client using the time endpoint, if any
+	OffsetMs *int64 `json:"offset_ms,omitempty"`
+	RttMs    int64  `json:"rtt_ms,omitempty"`
+}
+
+// Return the client time of the sync request with full precision
+func (r *SyncRequest) ClientTime() time.Time {
+	if r.TimeMs != 0 {
+		return time.Unix(0, r.TimeMs * int64(time.Millisecond))
+	}
+	return time.Unix(r.Time, 0)
 }
 
 
@@ -256,6 +517,31 @@ type SyncResponse struct {
 
 	// A list of groups of which the client is a member
 	Groups []Group `json:"groups"`
+
+	// The clock offset (client - server) applied to the client's beacons
+	OffsetMs int64 `json:"offset_ms"`
+
+	// The short id identifying the client in beacon datagrams, if any
+	ShortId uint32 `json:"shortid,omitempty"`
+
+	// The key of the HMAC of the client's beacon datagrams, if required
+	BeaconKey []byte `json:"beaconkey,omitempty"`
+}
+
+// TimeResponse is the response to an NTP style time request. The client
+// sends its time 't0' and notes the time 't3' the response is received. The
+// clock offset is then ((t1 - t0) + (t2 - t3)) / 2 and the round trip time
+// (t3 - t0) - (t2 - t1). All times are unix milliseconds.
+type TimeResponse struct {
+
+	// The client time the request was sent
+	T0 int64 `json:"t0"`
+
+	// The server time the request was received
+	T1 int64 `json:"t1"`
+
+	// The server time the response was sent
+	T2 int64 `json:"t2"`
 }
 
 //
@@ -280,6 +566,40 @@ func (endpoint *Endpoint) CreateEntity(clientId ClientID, userAgent uint8) (*Ent
 	defer endpoint.lock.Unlock()
 	endpoint.entities[uuid.UUID(tokenId).String()] = entity
 
+	// The short id is only usable while it is unique
+	shortId := shortIdOf(tokenId)
+	if _, ok := endpoint.shortIds[shortId]; !ok {
+		endpoint.shortIds[shortId] = entity
+	}
+
+	return entity, nil
+}
+
+//
+// Return the short id of the entity 'entity', or zero if it has none
+//
+func (endpoint *Endpoint) GetShortId(entity *Entity) uint32 {
+
+	endpoint.lock.RLock()
+	defer endpoint.lock.RUnlock()
+	shortId := shortIdOf(entity.tokenId)
+	if endpoint.shortIds[shortId] != entity {
+		return 0
+	}
+	return shortId
+}
+
+//
+// Return the Entity with the short id 'shortId' or error on failure.
+//
+func (endpoint *Endpoint) GetEntityByShortId(shortId uint32) (*Entity, error) {
+
+	endpoint.lock.RLock()
+	defer endpoint.lock.RUnlock()
+	entity, ok := endpoint.shortIds[shortId]
+	if !ok {
+		return nil, fmt.Errorf("Could not find entity with short id: %d", shortId)
+	}
 	return entity, nil
 }
 
@@ -305,15 +625,80 @@ func (endpoint *Endpoint) Cleanup() {
 
 	for s, e  := range endpoint.entities {
 		if e.expired() {
+			endpoint.ctx.GetTopology().RemoveEntity(e)
 			delete(endpoint.entities, s)
+			if endpoint.shortIds[shortIdOf(e.tokenId)] == e {
+				delete(endpoint.shortIds, shortIdOf(e.tokenId))
+			}
+		}
+	}
+}
+
+//
+// Return the clock offset (client - server) of the client making the sync
+// request 'r' received at the server time 'received'. The offset estimated
+// by the client is preferred when it agrees with the time of the request.
+//
+// Version 1 clients send whole seconds, so without an estimate an offset
+// within that quantisation is noise and is not applied. Larger offsets are
+// rounded to whole seconds, so corrected timestamps remain whole seconds.
+//
+func clockOffset(r *SyncRequest, received time.Time) (time.Duration, error) {
+
+	// The one way estimate includes the latency of the request
+	offset := r.ClientTime().Sub(received)
+	if r.OffsetMs != nil {
+		estimated := time.Duration(*r.OffsetMs) * time.Millisecond
+		slack := toleranceSec * time.Second + time.Duration(r.RttMs) * time.Millisecond
+		if d := offset - estimated; d <= slack && d >= -slack {
+			offset = estimated
 		}
+	} else if r.TimeMs == 0 {
+		if offset <= time.Second && offset >= -time.Second {
+			offset = 0
+		}
+		offset = offset.Round(time.Second)
+	}
+
+	if offset > maxClockOffset || offset < -maxClockOffset {
+		return 0, errors.New("Client clock offset too large")
+	}
+	return offset, nil
+}
+
+// TimeHandler handles NTP style time requests. Clients make several
+// requests and keep the offset of the one with the smallest round trip.
+// Query:
+//    t0: <client_time_ms>
+// Response Body:
+//    { t0: <client_time_ms>, t1: <server_receive_ms>, t2: <server_send_ms> }
+func (endpoint *Endpoint) TimeHandler(w http.ResponseWriter, req *http.Request) {
+
+	received := time.Now()
+	if req.Method != http.MethodGet {
+		// Time requests must be Gets
+		return
 	}
+
+	t0, err := strconv.ParseInt(req.URL.Query().Get("t0"), 10, 64)
+	if err != nil {
+		messageError(w, "Time: Invalid t0", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	res := TimeResponse{T0: t0, T1: received.UnixNano() / int64(time.Millisecond)}
+	res.T2 = time.Now().UnixNano() / int64(time.Millisecond)
+	s, _ := json.Marshal(&res)
+	w.Write(s)
 }
 
 // SyncHandler handles SYNC JSON requests.
 // Headers:
 //    Content-Type: application/JSON
-//    Content-Version: 1
+//    Content-Version: 1 or 2
 //    User-Agent: string
 //    Services: [uuid1, uuid2, ...] (optional)
 // Request Body:
@@ -321,6 +706,9 @@ func (endpoint *Endpoint) Cleanup() {
 //     client {
 //         uuid: <UUID>
 //         time: <unix_time_epoch_sec>
+//         time_ms: <unix_time_epoch_ms> (version 2)
+//         offset_ms: <clock_offset_ms> (optional, from /api/v1/time)
+//         rtt_ms: <round_trip_ms> (optional, from /api/v1/time)
 //     }
 // }
 // Response Body:
@@ -332,6 +720,8 @@ func (endpoint *Endpoint) Cleanup() {
 //    }
 func (endpoint *Endpoint) SyncHandler(w http.ResponseWriter, req *http.Request) {
 
+	received := time.Now()
+
     if req.Method != http.MethodPost {
 		// Sync requests must be POST
 		return
@@ -352,8 +742,10 @@ func (endpoint *Endpoint) SyncHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-    if !inSync(postData.Time) {
-		messageError(w, "Sync: Client/Server time not synchronised", http.StatusBadRequest)
+	// Clients with bad clocks are not rejected, their beacons are corrected
+	offset, offsetErr := clockOffset(&postData, received)
+	if offsetErr != nil {
+		messageError(w, "Sync: " + offsetErr.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -371,6 +763,10 @@ func (endpoint *Endpoint) SyncHandler(w http.ResponseWriter, req *http.Request)
 		messageError(w, "Sync: Failed to create entity: " + entityErr.Error(), http.StatusForbidden)
 		return
 	}
+	entity.SetClockOffset(offset)
+	if offset > toleranceSec * time.Second || offset < -toleranceSec * time.Second {
+		log.Printf("Sync: Client %s clock offset %.3f seconds", postData.Uuid, offset.Seconds())
+	}
 
 	// Set the content-type of the response
 	w.Header().Set("Content-Type", "application/json")
@@ -378,6 +774,11 @@ func (endpoint *Endpoint) SyncHandler(w http.ResponseWriter, req *http.Request)
 	var syncRes SyncResponse
 	syncRes.TokenId = uuid.UUID(entity.tokenId).String()
 	syncRes.Groups = entity.groups
+	syncRes.OffsetMs = offset.Milliseconds()
+	syncRes.ShortId = endpoint.GetShortId(entity)
+	if config := &endpoint.ctx.GetTopology().config; config.udpAddr != "" {
+		syncRes.BeaconKey = beaconKey(config.udpKey, entity.tokenId)
+	}
 
 	//tokenStr := uuid.UUID(tokenId).String()
 
@@ -387,6 +788,20 @@ func (endpoint *Endpoint) SyncHandler(w http.ResponseWriter, req *http.Request)
 	fmt.Fprintf(w, string(s))
 }
 
+//
+// beaconError is the reason a beacon was not accepted, with the code
+// reported over the websocket and the status reported over HTTP.
+//
+type beaconError struct {
+	code    string
+	status  int
+	message string
+}
+
+func (e *beaconError) Error() string {
+	return e.message
+}
+
 //
 //
 //
@@ -405,26 +820,100 @@ func (endpoint *Endpoint) handleUserData(entity *Entity, w http.ResponseWriter,
 
 	decoder := json.NewDecoder(req.Body)
 
-	// Create the UserData
-	clientIdStr := uuid.UUID(entity.clientId).String()
-	userData := UserData{ClientId: clientIdStr}
-
 	// Decode the received user location
-	err := decoder.Decode(&userData.Location)
+	var loc Location
+	err := decoder.Decode(&loc)
 	if err != nil {
 		messageError(w, "Beacon: Invalid beacon location: " + err.Error(), http.StatusBadRequest)
 		return nil
 	}
 
-	if !inSync(userData.Location.Timestamp) {
-		messageError(w, "Beacon: Client/Server time not synchronised", http.StatusBadRequest)
+	userData, berr := endpoint.processLocation(entity, loc)
+	if berr != nil {
+		messageError(w, "Beacon: " + berr.message, berr.status)
 		return nil
 	}
+	return userData
+}
+
+//
+// Process the location 'loc' received from the entity 'entity', however it
+// was received. Return the user data to publish or the reason the location
+// was not accepted.
+//
+func (endpoint *Endpoint) processLocation(entity *Entity, loc Location) (*UserData, *beaconError) {
+
+	// Create the UserData
+	clientIdStr := uuid.UUID(entity.clientId).String()
+	userData := UserData{ClientId: clientIdStr, Location: loc}
+
+	// Correct the timestamp by the clock offset of the entity, keeping
+	// the raw timestamp for auditing
+	if offset := entity.ClockOffset(); offset != 0 {
+		userData.Location.RawMs = userData.Location.UnixMilli()
+		userData.Location.SetTime(userData.Location.Time().Add(-offset))
+	}
+
+	if !inSync(userData.Location.Time()) {
+		return nil, &beaconError{"not_synchronised", http.StatusBadRequest, "Client/Server time not synchronised"}
+	}
+
+	// Flag implausible beacons without rejecting them
+	endpoint.recordFlags(entity, endpoint.ctx.GetTopology().CheckPlausibility(entity, userData.Location))
+
+	// Validate and smooth the location before updating the entity
+	processed, perr := endpoint.pipeline.Process(entity, userData.Location)
+	if perr != nil {
+		return nil, &beaconError{"location_rejected", http.StatusUnprocessableEntity, "Location rejected: " + perr.Error()}
+	}
+	userData.Location = processed
 
 	// Update the entity's new location
 	entity.Update(userData.Location)
+	userData.Speed = entity.motion.Speed()
+	userData.Course = entity.motion.Course()
 
-	return &userData
+	return &userData, nil
+}
+
+// Record the plausibility flags 'flags' raised by the entity 'entity'
+func (endpoint *Endpoint) recordFlags(entity *Entity, flags []PlausibilityFlag) {
+	for _, flag := range flags {
+		log.Printf("Beacon: Plausibility flag for client %s: %s (%s)", uuid.UUID(entity.clientId).String(), flag.Type, flag.Detail)
+		ferr := endpoint.ctx.RecordFlag(entity, flag)
+		if ferr != nil {
+			log.Printf("Beacon: Failed to record plausibility flag: %v", ferr)
+		}
+	}
+}
+
+//
+// Publish the user data 'userData' of the entity 'entity', either as a
+// beacon or, if 'standby' is true, as the entity entering standby.
+//
+func (endpoint *Endpoint) publishUserData(entity *Entity, userData *UserData, standby bool) *beaconError {
+
+	entity.SetStandby(standby)
+
+	// Marshall the user data into a message to broadcast
+	userMsg, lerr := json.Marshal(userData)
+	if lerr != nil {
+		return &beaconError{"internal_error", http.StatusBadRequest, "Failure generating user data: " + lerr.Error()}
+	}
+
+	if standby {
+		err := endpoint.ctx.Standby(entity, userMsg)
+		if err != nil {
+			return &beaconError{"standby_failed", http.StatusBadRequest, "Standby error: " + err.Error()}
+		}
+		return nil
+	}
+
+	err := endpoint.ctx.Broadcast(entity, userMsg)
+	if err != nil {
+		return &beaconError{"broadcast_failed", http.StatusBadRequest, "Broadcast error: " + err.Error()}
+	}
+	return nil
 }
 
 //
@@ -449,17 +938,9 @@ func (endpoint *Endpoint) StandbyHandler(w http.ResponseWriter, req *http.Reques
 	}
 
 	log.Printf("Standby Location: " + ToJSONString(&userData.Location))
-
-	// Marshall the user data into a message to broadcast
-	userMsg, lerr := json.Marshal(userData)
-	if lerr != nil {
-		messageError(w, "Beacon: Failure generating user data: " + lerr.Error(), http.StatusBadRequest)
-		return
-	}
-
-	err = endpoint.ctx.Standby(entity, userMsg)
-	if err != nil {
-		messageError(w, "Standby error: " + err.Error(), http.StatusBadRequest)
+	berr := endpoint.publishUserData(entity, userData, true)
+	if berr != nil {
+		messageError(w, berr.message, berr.status)
 		return
 	}
 }
@@ -486,17 +967,9 @@ func (endpoint *Endpoint) BeaconHandler(w http.ResponseWriter, req *http.Request
 	}
 
 	log.Printf("Beacon Location: " + ToJSONString(&userData.Location))
-
-	// Marshall the user data into a message to broadcast
-	userMsg, lerr := json.Marshal(userData)
-	if lerr != nil {
-		messageError(w, "Beacon: Failure generating user data: " + lerr.Error(), http.StatusBadRequest)
-		return
-	}
-
-	err = endpoint.ctx.Broadcast(entity, userMsg)
-	if err != nil {
-		messageError(w, "Broadcast error: " + err.Error(), http.StatusBadRequest)
+	berr := endpoint.publishUserData(entity, userData, false)
+	if berr != nil {
+		messageError(w, berr.message, berr.status)
 		return
 	}
 }
@@ -524,7 +997,11 @@ func (endpoint *Endpoint) DataHandler(w http.ResponseWriter, req *http.Request)
 	}
 
 	// Make the WebSocket connection and tie it to the new entity
-	c := MakeWebSocketConnection(entity, endpoint, conn)
+	version := negotiateEventVersion(req)
+	c := MakeWebSocketConnection(entity, endpoint, conn, version)
+	if version >= eventVersionEnvelope {
+		c.Write(makeSystemEvent("welcome", version))
+	}
 
 	// Asynchronously, read from and write to the websocket
 	go c.ReadPump()
@@ -563,6 +1040,323 @@ func (endpoint *Endpoint) DownloadHandler(w http.ResponseWriter, req *http.Reque
 	fmt.Fprintf(w, string(js))
 }
 
+// NearbyHandler returns the last known positions of the entities near a point
+// that consented to being followed by the entity or share a group with it.
+// Query Parameters:
+//    lat, lng: the point to search around (optional, defaults to the entity's location)
+//    radius: the search radius in meters (optional, defaults to the cell group of the point)
+// Response Body:
+//    {
+//      entities: [ { clientid: <uuid>, location: {...} }, ... ]
+//    }
+func (endpoint *Endpoint) NearbyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// Nearby requests must be Gets
+		return
+	}
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Get the entity associated with this token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Nearby: Failed to acquire entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc := entity.location
+	query := req.URL.Query()
+	if query.Get("lat") != "" || query.Get("lng") != "" {
+		lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+		lng, lngErr := strconv.ParseFloat(query.Get("lng"), 64)
+		if latErr != nil || lngErr != nil {
+			messageError(w, "Nearby: Invalid lat/lng", http.StatusBadRequest)
+			return
+		}
+		loc = MakeLocation(lat, lng, 0, 0, 0)
+	}
+
+	t := endpoint.ctx.GetTopology()
+	var positions []UserData
+	if query.Get("radius") != "" {
+		radius, radiusErr := strconv.ParseFloat(query.Get("radius"), 64)
+		if radiusErr != nil || radius <= 0 || radius > maxNearbyRadiusMeters {
+			messageError(w, "Nearby: Invalid radius", http.StatusBadRequest)
+			return
+		}
+		positions, err = t.GetPositions(loc, radius)
+	} else {
+		cell := MakeCell(&t.config)
+		cell.Changed(&loc)
+		positions, err = t.GetCellGroupPositions(cell.cellGroup)
+	}
+	if err != nil {
+		messageError(w, "Nearby: " + err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Exclude the requesting entity and the clients it may not see
+	clientIds := make([]string, len(positions))
+	for i := range positions {
+		clientIds[i] = positions[i].ClientId
+	}
+	visible := endpoint.ctx.VisibleClients(entity, clientIds)
+	clientIdStr := uuid.UUID(entity.clientId).String()
+	response := NearbyResponse{Entities: make([]UserData, 0, len(positions))}
+	for _, p := range positions {
+		if p.ClientId != clientIdStr && visible[p.ClientId] {
+			response.Entities = append(response.Entities, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(&response)
+	if err != nil {
+		messageError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(js)
+}
+
+// NearestHandler returns the K nearest entities to a point that consented to
+// being followed by the entity or share a group with it, along with their
+// distance in meters and bearing in degrees from the point. The search
+// widens until K are found, up to about 1000km from the point.
+// Query Parameters:
+//    lat, lng: the point to search around (optional, defaults to the entity's location)
+//    k: the number of entities to return (optional, defaults to 10)
+// Response Body:
+//    {
+//      entities: [ { clientid: <uuid>, location: {...}, distance: <m>, bearing: <deg> }, ... ]
+//    }
+func (endpoint *Endpoint) NearestHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// Nearest requests must be Gets
+		return
+	}
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Get the entity associated with this token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Nearest: Failed to acquire entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc := entity.location
+	query := req.URL.Query()
+	if query.Get("lat") != "" || query.Get("lng") != "" {
+		lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+		lng, lngErr := strconv.ParseFloat(query.Get("lng"), 64)
+		if latErr != nil || lngErr != nil {
+			messageError(w, "Nearest: Invalid lat/lng", http.StatusBadRequest)
+			return
+		}
+		loc = MakeLocation(lat, lng, 0, 0, 0)
+	}
+
+	k := defaultNearestK
+	if query.Get("k") != "" {
+		var kErr error
+		k, kErr = strconv.Atoi(query.Get("k"))
+		if kErr != nil || k <= 0 || k > maxNearestK {
+			messageError(w, "Nearest: Invalid k", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Exclude the requesting entity and the clients it may not see
+	clientIdStr := uuid.UUID(entity.clientId).String()
+	visible := func(clientIds []string) map[string]bool {
+		permitted := endpoint.ctx.VisibleClients(entity, clientIds)
+		delete(permitted, clientIdStr)
+		return permitted
+	}
+	nearest, err := endpoint.ctx.GetTopology().GetNearest(loc, k, visible)
+	if err != nil {
+		messageError(w, "Nearest: " + err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := NearestResponse{Entities: nearest}
+
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(&response)
+	if err != nil {
+		messageError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(js)
+}
+
+// DensityHandler returns the density of entities and beacons per cell as a
+// GeoJSON FeatureCollection of cell polygons. Cells holding fewer than three
+// entities are left out, and level 15 is not served over the 1m window.
+// Query Parameters:
+//    level: the level of the cells, one of 10, 13 or 15 (optional, defaults to 13)
+//    window: one of 1m, 15m or 1h (optional, defaults to 15m)
+//    bbox: minLng,minLat,maxLng,maxLat (optional)
+func (endpoint *Endpoint) DensityHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// Density requests must be Gets
+		return
+	}
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Only entities may see the density
+	_, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Density: Failed to acquire entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+	level := 13
+	if query.Get("level") != "" {
+		var levelErr error
+		level, levelErr = strconv.Atoi(query.Get("level"))
+		if levelErr != nil || !isDensityLevel(level) {
+			messageError(w, "Density: Invalid level", http.StatusBadRequest)
+			return
+		}
+	}
+
+	windowStr := query.Get("window")
+	if windowStr == "" {
+		windowStr = "15m"
+	}
+	window, ok := densityWindows[windowStr]
+	if !ok {
+		messageError(w, "Density: Invalid window", http.StatusBadRequest)
+		return
+	}
+	if !densityServed(level, window) {
+		messageError(w, "Density: Level " + strconv.Itoa(level) + " is not served over the " + windowStr + " window", http.StatusForbidden)
+		return
+	}
+
+	bound := s2.EmptyRect()
+	if query.Get("bbox") != "" {
+		region := Region{}
+		err := region.parse([]byte("[" + query.Get("bbox") + "]"))
+		if err != nil || len(region.loops) > 0 {
+			messageError(w, "Density: Invalid bbox", http.StatusBadRequest)
+			return
+		}
+		bound = region.rect
+	}
+
+	data := endpoint.ctx.GetTopology().GetDensity(level, window, bound)
+	js, err := DensityToGeoJSON(data)
+	if err != nil {
+		messageError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(js)
+}
+
+// TileHandler renders the historical density of locations within an XYZ map
+// tile, either as a PNG heatmap or as a GeoJSON grid of point counts.
+// Tiles of all entities are limited to zoom 14, so individual tracks cannot
+// be told apart; tiles of a group of which the entity is a member may zoom
+// further.
+// Query Parameters:
+//    from, to: the time range in unix seconds (optional, defaults to the last 24 hours)
+//    group: the group id to restrict the locations to (optional)
+func (endpoint *Endpoint) TileHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// Tile requests must be Gets
+		return
+	}
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Get the entity associated with this token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Tile: Failed to acquire entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tile := Tile{}
+	tile.Z, _ = strconv.Atoi(vars["z"])
+	tile.X, _ = strconv.Atoi(vars["x"])
+	tile.Y, _ = strconv.Atoi(vars["y"])
+	if !tile.IsValid() {
+		messageError(w, "Tile: Invalid tile address", http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+	groupId := query.Get("group")
+	if groupId != "" {
+		err = endpoint.ctx.CheckGroupMember(entity, groupId)
+		if err == errNotGroupMember {
+			messageError(w, "Tile: " + err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			messageError(w, "Tile: " + err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if tile.Z > maxPublicTileZoom {
+		messageError(w, "Tile: Zoom too high without a group", http.StatusBadRequest)
+		return
+	}
+
+	to := tileRangeEnd(time.Now())
+	if query.Get("to") != "" {
+		ts, err := strconv.ParseInt(query.Get("to"), 10, 64)
+		if err != nil {
+			messageError(w, "Tile: Invalid to time", http.StatusBadRequest)
+			return
+		}
+		to = time.Unix(ts, 0)
+	}
+	from := to.Add(-24 * time.Hour)
+	if query.Get("from") != "" {
+		ts, err := strconv.ParseInt(query.Get("from"), 10, 64)
+		if err != nil {
+			messageError(w, "Tile: Invalid from time", http.StatusBadRequest)
+			return
+		}
+		from = time.Unix(ts, 0)
+	}
+
+	key := fmt.Sprintf("%s/%d/%d/%d/%d/%d/%s", vars["format"], tile.Z, tile.X, tile.Y, from.Unix(), to.Unix(), groupId)
+	data, ok := endpoint.tiles.get(key)
+	if !ok {
+		locations, err := endpoint.ctx.GetLocations(tile.QueryBound(), from, to, groupId)
+		if err != nil {
+			messageError(w, "Tile: " + err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if vars["format"] == "png" {
+			data, err = RenderTilePNG(tile, locations)
+		} else {
+			data, err = RenderTileGeoJSON(tile, locations)
+		}
+		if err != nil {
+			messageError(w, "Tile: " + err.Error(), http.StatusInternalServerError)
+			return
+		}
+		endpoint.tiles.put(key, data)
+	}
+
+	if vars["format"] == "png" {
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		w.Header().Set("Content-Type", "application/geo+json")
+	}
+	w.Write(data)
+}
+
 func (endpoint *Endpoint) Cleaner() {
 	ticker := time.NewTicker(cleanupPeriodSec)
 	defer func() {
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockOffsetVersion1(t *testing.T) {
+
+	received := time.Unix(1000, 400*int64(time.Millisecond))
+	tests := []struct {
+		time     int64
+		expected time.Duration
+	}{
+		// Within the quantisation of whole seconds no offset is applied
+		{1000, 0},
+		{1001, 0},
+
+		// Larger offsets are applied in whole seconds
+		{999, -time.Second},
+		{1010, 10 * time.Second},
+		{990, -10 * time.Second},
+	}
+	for _, test := range tests {
+		offset, err := clockOffset(&SyncRequest{Time: test.time}, received)
+		if err != nil || offset != test.expected {
+			t.Errorf("clockOffset(%d): expected %v, got %v, %v", test.time, test.expected, offset, err)
+		}
+	}
+
+	// An offset estimated by the client is applied as is
+	estimated := int64(250)
+	if offset, _ := clockOffset(&SyncRequest{Time: 1000, OffsetMs: &estimated}, received); offset != 250*time.Millisecond {
+		t.Errorf("clockOffset: expected the estimated offset, got %v", offset)
+	}
+}
+
+func TestClockOffsetVersion1Beacons(t *testing.T) {
+
+	// A version 1 client synchronised part way through a second
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	received := start.Add(600 * time.Millisecond)
+	offset, err := clockOffset(&SyncRequest{Time: start.Unix()}, received)
+	if err != nil {
+		t.Fatalf("clockOffset: %v", err)
+	}
+
+	c := MakeConfig(250, 15)
+	p := MakeLocationPipeline(&c)
+	plausibility := MakePlausibility(&c)
+	e := &Entity{}
+	e.kalman.variance = -1
+	e.SetClockOffset(offset)
+
+	// Walking north about 5m every half second, timestamped in whole seconds,
+	// is accepted and not flagged as moving implausibly
+	for i := int64(0); i < 6; i++ {
+		loc := MakeLocation(-34.9287+float64(i)*0.00005, 138.5999, 0, 0, start.Unix()+i/2)
+		if offset := e.ClockOffset(); offset != 0 {
+			loc.SetTime(loc.Time().Add(-offset))
+		}
+		processed, err := p.Process(e, loc)
+		if err != nil {
+			t.Fatalf("Process(%d): %v", i, err)
+		}
+		now := received.Add(time.Duration(i) * 500 * time.Millisecond)
+		for _, flag := range plausibility.Check(e.clientId, processed, now) {
+			if flag.Type != flagTimestamp {
+				t.Errorf("Check(%d): unexpected flag %+v", i, flag)
+			}
+		}
+		e.location = processed
+	}
+}
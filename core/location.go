@@ -4,40 +4,137 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"time"
 )
 
 // Location is the struct that describes a point in space and time.
-// Size: 32 bytes
+// Size: 32 bytes (serialized, the accuracy is not serialized)
+//
+// Version 1 locations carry a timestamp in whole seconds. Version 2
+// locations carry a timestamp in milliseconds, as 'timestamp_ms' in JSON and
+// in place of the seconds in the binary protocol. Both are held as the
+// seconds in Timestamp and the remainder in Nanos.
 type Location struct {
 	Lat       float64 `json:"lat"`
 	Lng       float64 `json:"lng"`
 	Alt       float32 `json:"alt"`
 	Heading   float32 `json:"heading"`
 	Timestamp int64 `json:"timestamp"`
+
+	// The sub-second part of the timestamp in nanoseconds
+	Nanos     int32 `json:"-"`
+
+	// The horizontal accuracy of the location in meters, zero if unknown
+	Accuracy  float32 `json:"accuracy,omitempty"`
+
+	// The timestamp in milliseconds as sent by the client, before it was
+	// corrected by the client's clock offset. Zero if not corrected.
+	RawMs     int64 `json:"-"`
 }
 
 // MakeLocation creates a new location in time and space
 func MakeLocation(lat float64, lng float64, alt float32, heading float32, t int64) Location {
-	loc := Location{lat, lng, alt, heading, t}
+	loc := Location{Lat: lat, Lng: lng, Alt: alt, Heading: heading, Timestamp: t}
 	return loc
 }
 
+// Time returns the timestamp of the location with full precision
+func (l *Location) Time() time.Time {
+	return time.Unix(l.Timestamp, int64(l.Nanos))
+}
+
+// SetTime sets the timestamp of the location with full precision
+func (l *Location) SetTime(t time.Time) {
+	l.Timestamp = t.Unix()
+	l.Nanos = int32(t.Nanosecond())
+}
+
+// UnixMilli returns the timestamp of the location in milliseconds
+func (l *Location) UnixMilli() int64 {
+	return l.Timestamp*1000 + int64(l.Nanos)/int64(time.Millisecond)
+}
+
+// SetUnixMilli sets the timestamp of the location from milliseconds
+func (l *Location) SetUnixMilli(ms int64) {
+	l.SetTime(time.Unix(0, ms*int64(time.Millisecond)))
+}
+
+// Return the seconds elapsed from the location 'prev' to this location
+func (l *Location) secondsSince(prev *Location) float64 {
+	return l.Time().Sub(prev.Time()).Seconds()
+}
+
+// locationJSON is a Location without its JSON methods
+type locationJSON Location
+
+// MarshalJSON writes the location with both the version 1 timestamp in
+// seconds and the version 2 timestamp in milliseconds.
+func (l Location) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		locationJSON
+		TimestampMs int64 `json:"timestamp_ms"`
+	}{locationJSON(l), l.UnixMilli()})
+}
+
+// UnmarshalJSON reads a version 1 or version 2 location. A version 2
+// timestamp in milliseconds takes precedence over the timestamp in seconds.
+func (l *Location) UnmarshalJSON(data []byte) error {
+	var v struct {
+		locationJSON
+		TimestampMs *int64 `json:"timestamp_ms"`
+	}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*l = Location(v.locationJSON)
+	if v.TimestampMs != nil {
+		l.SetUnixMilli(*v.TimestampMs)
+	}
+	return nil
+}
+
 func (l *Location) ToJSON() ([]byte, error) {
 	return json.Marshal(l)
 }
 
-// Serialize does ..
+// Serialize writes the location using the version 1 binary format
 func Serialize(location *Location, buf *bytes.Buffer) {
+	SerializeVersion(location, buf, 1)
+}
+
+// SerializeVersion writes the location using the binary format of the
+// message version 'version'.
+func SerializeVersion(location *Location, buf *bytes.Buffer, version uint8) {
 	binary.Write(buf, binary.BigEndian, location.Lat)
 	binary.Write(buf, binary.BigEndian, location.Lng)
 	binary.Write(buf, binary.BigEndian, location.Alt)
 	binary.Write(buf, binary.BigEndian, location.Heading)
-	binary.Write(buf, binary.BigEndian, location.Timestamp)
+	if version >= 2 {
+		binary.Write(buf, binary.BigEndian, location.UnixMilli())
+	} else {
+		binary.Write(buf, binary.BigEndian, location.Timestamp)
+	}
 }
 
-// Deserialize ..
+// Deserialize reads a location using the version 1 binary format
 func Deserialize(location *Location, buf *bytes.Buffer) {
-	binary.Read(buf, binary.BigEndian, location)
+	DeserializeVersion(location, buf, 1)
+}
+
+// DeserializeVersion reads a location using the binary format of the
+// message version 'version'.
+func DeserializeVersion(location *Location, buf *bytes.Buffer, version uint8) {
+	binary.Read(buf, binary.BigEndian, &location.Lat)
+	binary.Read(buf, binary.BigEndian, &location.Lng)
+	binary.Read(buf, binary.BigEndian, &location.Alt)
+	binary.Read(buf, binary.BigEndian, &location.Heading)
+	binary.Read(buf, binary.BigEndian, &location.Timestamp)
+	if version >= 2 {
+		location.SetUnixMilli(location.Timestamp)
+	} else {
+		location.Nanos = 0
+	}
 }
 
 // ToJSONString returns the location as a JSON string
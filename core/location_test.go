@@ -0,0 +1,45 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestLocationVersions(t *testing.T) {
+
+	// A version 1 location has whole seconds
+	var v1 Location
+	err := json.Unmarshal([]byte(`{"lat": -34.9287, "lng": 138.5999, "timestamp": 1700000000}`), &v1)
+	if err != nil || v1.UnixMilli() != 1700000000000 {
+		t.Errorf("Unmarshal v1: got %d, %v", v1.UnixMilli(), err)
+	}
+
+	// A version 2 location has milliseconds
+	var v2 Location
+	err = json.Unmarshal([]byte(`{"lat": -34.9287, "lng": 138.5999, "timestamp_ms": 1700000000123}`), &v2)
+	if err != nil || v2.Timestamp != 1700000000 || v2.UnixMilli() != 1700000000123 {
+		t.Errorf("Unmarshal v2: got %d, %v", v2.UnixMilli(), err)
+	}
+
+	js, _ := json.Marshal(v2)
+	var decoded map[string]interface{}
+	json.Unmarshal(js, &decoded)
+	if decoded["timestamp"] != float64(1700000000) || decoded["timestamp_ms"] != float64(1700000000123) {
+		t.Errorf("Marshal: got %s", js)
+	}
+
+	for version := uint8(MinVersion); version <= Version; version++ {
+		buf := new(bytes.Buffer)
+		SerializeVersion(&v2, buf, version)
+		var loc Location
+		DeserializeVersion(&loc, buf, version)
+		want := v2.UnixMilli()
+		if version == 1 {
+			want = v2.Timestamp * 1000
+		}
+		if loc.UnixMilli() != want || loc.Lat != v2.Lat {
+			t.Errorf("Serialize v%d: got %d, want %d", version, loc.UnixMilli(), want)
+		}
+	}
+}
@@ -9,8 +9,12 @@ import (
 	"github.com/google/uuid"
 )
 
-// Version ...
-const Version = 1
+// Version is the message version written by this package. Version 2
+// carries location timestamps in milliseconds.
+const Version = 2
+
+// MinVersion is the oldest message version still understood
+const MinVersion = 1
 
 const MsgTypeInvalid = 0
 const MsgTypeSyncRequest = 1
@@ -71,7 +75,7 @@ func (m *SyncRequestMsg) Write(c net.Conn) (int, error) {
 	m.Hdr.Length = 48                                   // payload only
 	serialize(&m.Hdr, buf)                              // write the header
 	binary.Write(buf, binary.BigEndian, &m.ServiceUUID) // 16 bytes
-	Serialize(&m.Location, buf)                         // 32 bytes
+	SerializeVersion(&m.Location, buf, m.Hdr.Version)   // 32 bytes
 	return c.Write(buf.Bytes())
 }
 
@@ -90,7 +94,7 @@ func (m *SyncRequestMsg) Read(c net.Conn) error {
 	}
 	buf := bytes.NewBuffer(msgBytes)
 	binary.Read(buf, binary.BigEndian, &m.ServiceUUID)
-	Deserialize(&m.Location, buf)
+	DeserializeVersion(&m.Location, buf, m.Hdr.Version)
 	return nil
 }
 
@@ -140,8 +144,11 @@ func (m *SyncResponseMsg) Read(c net.Conn) error {
 }
 
 // MakeSyncResponseMsg ...
-func MakeSyncResponseMsg(clientUUID uuid.UUID, tokenId TokenID) SyncResponseMsg {
+// The response carries the version 'version' of the request it replies to, so
+// older clients understand it.
+func MakeSyncResponseMsg(version uint8, clientUUID uuid.UUID, tokenId TokenID) SyncResponseMsg {
 	h := makeHeader(MsgTypeSyncResponse, 0)
+	h.Version = version
 	h.UUID = clientUUID
 	m := SyncResponseMsg{Hdr: h, TokenId: tokenId}
 	return m
@@ -158,7 +165,7 @@ func (m *DataRequestMsg) Write(c net.Conn) (int, error) {
 	buf := new(bytes.Buffer)
 	m.Hdr.Length = 32           // payload only
 	serialize(&m.Hdr, buf)      // write the header
-	Serialize(&m.Location, buf) // 32 bytes
+	SerializeVersion(&m.Location, buf, m.Hdr.Version) // 32 bytes
 	return c.Write(buf.Bytes())
 }
 
@@ -176,7 +183,7 @@ func (m *DataRequestMsg) Read(c net.Conn) error {
 		return err
 	}
 	buf := bytes.NewBuffer(msgBytes)
-	Deserialize(&m.Location, buf)
+	DeserializeVersion(&m.Location, buf, m.Hdr.Version)
 	return nil
 }
 
@@ -223,8 +230,11 @@ func (m *DataResponseMsg) Read(c net.Conn) error {
 }
 
 // MakeDataResponseMsg ...
-func MakeDataResponseMsg(tokenId TokenID) DataResponseMsg {
+// The response carries the version 'version' of the request it replies to;
+// any locations in Data must be serialized using that version.
+func MakeDataResponseMsg(version uint8, tokenId TokenID) DataResponseMsg {
 	h := makeHeader(MsgTypeDataResponse, 0)
+	h.Version = version
 	h.UUID = uuid.UUID(tokenId)
 	m := DataResponseMsg{Hdr: h}
 	m.Data = new(bytes.Buffer)
@@ -242,7 +252,7 @@ func ReadHeader(hdr *Header, c net.Conn) error {
 
 	buf := bytes.NewBuffer(hdrBytes)
 	err = binary.Read(buf, binary.BigEndian, hdr)
-	if hdr.Magic != 101 || hdr.Version != 1 {
+	if hdr.Magic != 101 || hdr.Version < MinVersion || hdr.Version > Version {
 		err = errors.New("Incorrect Magic bytes or incorrect message version")
 	}
 
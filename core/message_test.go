@@ -0,0 +1,43 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestResponseVersions(t *testing.T) {
+
+	clientUUID := uuid.New()
+	tokenId := TokenID(uuid.New())
+	for version := uint8(MinVersion); version <= Version; version++ {
+
+		// Responses carry the version of the request they reply to
+		server, client := net.Pipe()
+		sync := MakeSyncResponseMsg(version, clientUUID, tokenId)
+		go func(server net.Conn) {
+			sync.Write(server)
+			server.Close()
+		}(server)
+		received := SyncResponseMsg{}
+		if err := received.Read(client); err != nil || received.Hdr.Version != version || received.TokenId != tokenId {
+			t.Errorf("SyncResponseMsg v%d: unexpected response %+v, %v", version, received, err)
+		}
+		client.Close()
+
+		server, client = net.Pipe()
+		data := MakeDataResponseMsg(version, tokenId)
+		data.Data.WriteString("data")
+		go func(server net.Conn) {
+			data.Write(server)
+			server.Close()
+		}(server)
+		response := DataResponseMsg{}
+		if err := response.Read(client); err != nil || response.Hdr.Version != version || !bytes.Equal(response.Data.Bytes(), []byte("data")) {
+			t.Errorf("DataResponseMsg v%d: unexpected response %+v, %v", version, response.Hdr, err)
+		}
+		client.Close()
+	}
+}
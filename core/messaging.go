@@ -0,0 +1,260 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// The kinds of message sent between clients
+const (
+	// A text message
+	messageText = "text"
+
+	// A structured message, carrying arbitrary JSON data
+	messageData = "data"
+
+	// An announcement to a group, only sent by the group's organisers
+	messageAnnouncement = "announcement"
+)
+
+// The targets of a message
+const (
+	// The members of a group
+	targetGroup = "group"
+
+	// The entities in the cells around the sender
+	targetLocal = "local"
+
+	// A single client
+	targetClient = "client"
+)
+
+const (
+	// The longest text of a message, in characters
+	maxMessageText = 1000
+
+	// The largest data of a structured message, in bytes
+	maxMessageData = 2048
+
+	// The number of messages of a group history page, by default and at most
+	defaultMessageHistory = 50
+	maxMessageHistory     = 200
+
+	// The role of the group members permitted to make announcements
+	roleOrganiser = "organiser"
+
+	// The messages per second and burst an entity may send to single
+	// clients and to the entities around it
+	messageRatePerSec = 0.2
+	messageBurst      = 5
+)
+
+var (
+	errNotGroupMember = errors.New("Not a member of the group")
+	errNotOrganiser   = errors.New("Only organisers may make announcements")
+	errNoConsent      = errors.New("The client does not accept messages from the sender")
+)
+
+// Every published message starts with its type, so it can be told apart
+// from user data without decoding it
+var messagePrefix = []byte(`{"type":"message"`)
+
+// MessageTarget is the recipient of a message
+type MessageTarget struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+//
+// ChatMessage is a message sent by a client to a group, to the entities
+// around it or to another client. For example:
+//
+//    {"to": {"type": "group", "value": "..."}, "text": "Hello"}
+//    {"kind": "data", "to": {"type": "local"}, "data": {...}}
+//
+// The type, id, sender and time of the message are set by the server.
+//
+type ChatMessage struct {
+
+	// Always "message", to distinguish messages from user data
+	Type string `json:"type"`
+
+	// The unique id of the message
+	Id string `json:"id"`
+
+	// The kind of message: text, data or announcement
+	Kind string `json:"kind"`
+
+	// The client id of the sender
+	From string `json:"from"`
+
+	// The recipient of the message
+	To MessageTarget `json:"to"`
+
+	// The text of the message
+	Text string `json:"text,omitempty"`
+
+	// The data of a structured message
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// The server time the message was sent, in milliseconds
+	Time int64 `json:"time_ms"`
+}
+
+// MessageHistory is a page of the message history of a group, newest first
+type MessageHistory struct {
+	Messages []ChatMessage `json:"messages"`
+
+	// The id to pass as 'before' to get the next page, if there may be one
+	Next string `json:"next,omitempty"`
+}
+
+//
+// Return true if the published data 'data' is a message rather than user data
+//
+func isMessage(data []byte) bool {
+	return bytes.HasPrefix(data, messagePrefix)
+}
+
+//
+// Validate the message 'msg' received from a client
+//
+func (msg *ChatMessage) validate() error {
+
+	switch msg.Kind {
+	case "":
+		msg.Kind = messageText
+	case messageText, messageData, messageAnnouncement:
+	default:
+		return errors.New("Unknown message kind: " + msg.Kind)
+	}
+
+	switch msg.To.Type {
+	case targetGroup:
+		if msg.To.Value == "" {
+			return errors.New("Missing group")
+		}
+	case targetLocal:
+		msg.To.Value = ""
+	case targetClient:
+		clientUUID, err := uuid.Parse(msg.To.Value)
+		if err != nil {
+			return errors.New("Invalid client id")
+		}
+		msg.To.Value = clientUUID.String()
+	default:
+		return errors.New("Unknown message target: " + msg.To.Type)
+	}
+
+	if msg.Kind == messageAnnouncement && msg.To.Type != targetGroup {
+		return errors.New("Announcements can only be made to a group")
+	}
+	if msg.Text == "" && len(msg.Data) == 0 {
+		return errors.New("Empty message")
+	}
+	if utf8.RuneCountInString(msg.Text) > maxMessageText {
+		return errors.New("Message text too long")
+	}
+	if len(msg.Data) > maxMessageData {
+		return errors.New("Message data too large")
+	}
+	return nil
+}
+
+//
+// Send the message 'msg' from the entity 'entity'. Return the reason the
+// message could not be sent, if any.
+//
+func (endpoint *Endpoint) sendMessage(entity *Entity, msg *ChatMessage) *beaconError {
+
+	err := msg.validate()
+	if err != nil {
+		return &beaconError{"invalid_message", http.StatusBadRequest, err.Error()}
+	}
+	if msg.To.Type == targetLocal && entity.location.Timestamp == 0 {
+		return &beaconError{"no_location", http.StatusBadRequest, "Local messages require a location"}
+	}
+	if msg.To.Type != targetGroup && !entity.allowMessage(time.Now()) {
+		// Members of a group chose to receive its messages, whereas
+		// clients and the entities around the sender did not
+		return &beaconError{"rate_limited", http.StatusTooManyRequests, "Too many messages"}
+	}
+
+	msg.Type = "message"
+	msg.Id = uuid.New().String()
+	msg.From = uuid.UUID(entity.clientId).String()
+	msg.Time = time.Now().UnixNano() / int64(time.Millisecond)
+
+	err = endpoint.ctx.SendMessage(entity, msg)
+	if err == errNotGroupMember || err == errNotOrganiser || err == errNoConsent {
+		return &beaconError{"not_permitted", http.StatusForbidden, err.Error()}
+	}
+	if err != nil {
+		return &beaconError{"send_failed", http.StatusBadRequest, "Send error: " + err.Error()}
+	}
+	return nil
+}
+
+// MessagesHandler returns a page of the message history of a group of which
+// the entity is a member, newest first.
+// Parameters:
+//    before: the id of the oldest message of the previous page (optional)
+//    limit: the number of messages (optional, at most 200)
+func (endpoint *Endpoint) MessagesHandler(w http.ResponseWriter, req *http.Request) {
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+	groupId := vars["groupid"]
+
+	// Get the entity associated with the token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Messages: Failed to get entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+	before := query.Get("before")
+	if before != "" {
+		if _, err = uuid.Parse(before); err != nil {
+			messageError(w, "Messages: Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultMessageHistory
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxMessageHistory {
+			messageError(w, "Messages: Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	messages, err := endpoint.ctx.GetMessages(entity, groupId, before, limit)
+	if err == errNotGroupMember {
+		messageError(w, "Messages: " + err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		messageError(w, "Messages: Failed to get messages: " + err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	history := MessageHistory{Messages: messages}
+	if len(messages) == limit {
+		history.Next = messages[len(messages)-1].Id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	js, _ := json.Marshal(&history)
+	w.Write(js)
+}
@@ -0,0 +1,287 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// messagesContext serves the history of groups of which it knows the members
+type messagesContext struct {
+	filterContext
+	members map[string]bool
+	history []ChatMessage
+	sent    []ChatMessage
+	before  string
+}
+
+func (ctx *messagesContext) CheckGroupMember(entity *Entity, groupId string) error {
+	if !ctx.members[groupId] {
+		return errNotGroupMember
+	}
+	return nil
+}
+
+func (ctx *messagesContext) SubscribeToGroup(conn Connection, groupId string) error {
+	if err := ctx.CheckGroupMember(conn.GetEntity(), groupId); err != nil {
+		return err
+	}
+	return ctx.filterContext.SubscribeToGroup(conn, groupId)
+}
+
+func (ctx *messagesContext) GetMessages(entity *Entity, groupId string, before string, limit int) ([]ChatMessage, error) {
+	if err := ctx.CheckGroupMember(entity, groupId); err != nil {
+		return nil, err
+	}
+	ctx.before = before
+	start := 0
+	for i, msg := range ctx.history {
+		if msg.Id == before {
+			start = i + 1
+		}
+	}
+	end := start + limit
+	if end > len(ctx.history) {
+		end = len(ctx.history)
+	}
+	return ctx.history[start:end], nil
+}
+
+func (ctx *messagesContext) SendMessage(entity *Entity, msg *ChatMessage) error {
+	if msg.To.Type == targetGroup && !ctx.members[msg.To.Value] {
+		return errNotGroupMember
+	}
+	if msg.To.Type == targetClient && !ctx.members["client:"+msg.To.Value] {
+		return errNoConsent
+	}
+	ctx.sent = append(ctx.sent, *msg)
+	return nil
+}
+
+func makeMessagesTest() (*messagesContext, *Endpoint, *Entity) {
+	topology := MakeTopology(MakeConfig(250, 15))
+	ctx := &messagesContext{
+		filterContext: filterContext{topology: &topology, subscribed: map[string]bool{}},
+		members:       map[string]bool{},
+	}
+	endpoint := MakeEndpoint(ctx)
+	entity := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	endpoint.entities["t1"] = entity
+	return ctx, &endpoint, entity
+}
+
+func TestChatMessageValidate(t *testing.T) {
+
+	client := uuid.New().String()
+	tests := []struct {
+		msg ChatMessage
+		ok  bool
+	}{
+		{ChatMessage{To: MessageTarget{Type: targetGroup, Value: "g1"}, Text: "Hello"}, true},
+		{ChatMessage{To: MessageTarget{Type: targetLocal, Value: "ignored"}, Text: "Hello"}, true},
+		{ChatMessage{To: MessageTarget{Type: targetClient, Value: strings.ToUpper(client)}, Text: "Hello"}, true},
+		{ChatMessage{Kind: messageData, To: MessageTarget{Type: targetLocal}, Data: json.RawMessage(`{"a":1}`)}, true},
+		{ChatMessage{Kind: messageAnnouncement, To: MessageTarget{Type: targetGroup, Value: "g1"}, Text: "Hi"}, true},
+		{ChatMessage{Text: strings.Repeat("é", maxMessageText), To: MessageTarget{Type: targetLocal}}, true},
+
+		{ChatMessage{Kind: "shout", To: MessageTarget{Type: targetLocal}, Text: "Hello"}, false},
+		{ChatMessage{To: MessageTarget{Type: targetGroup}, Text: "Hello"}, false},
+		{ChatMessage{To: MessageTarget{Type: targetClient, Value: "nobody"}, Text: "Hello"}, false},
+		{ChatMessage{To: MessageTarget{Type: "world"}, Text: "Hello"}, false},
+		{ChatMessage{Kind: messageAnnouncement, To: MessageTarget{Type: targetLocal}, Text: "Hi"}, false},
+		{ChatMessage{To: MessageTarget{Type: targetLocal}}, false},
+		{ChatMessage{Text: strings.Repeat("é", maxMessageText+1), To: MessageTarget{Type: targetLocal}}, false},
+		{ChatMessage{To: MessageTarget{Type: targetLocal}, Data: json.RawMessage(`"` + strings.Repeat("a", maxMessageData) + `"`)}, false},
+	}
+
+	for i, test := range tests {
+		msg := test.msg
+		err := msg.validate()
+		if (err == nil) != test.ok {
+			t.Errorf("validate(%d): expected ok %v, got %v", i, test.ok, err)
+		}
+		if err == nil && msg.Kind == "" {
+			t.Errorf("validate(%d): no default kind", i)
+		}
+	}
+
+	// Local messages have no target value and client ids are normalised
+	local := ChatMessage{To: MessageTarget{Type: targetLocal, Value: "g1"}, Text: "Hi"}
+	local.validate()
+	direct := ChatMessage{To: MessageTarget{Type: targetClient, Value: strings.ToUpper(client)}, Text: "Hi"}
+	direct.validate()
+	if local.To.Value != "" || direct.To.Value != client {
+		t.Errorf("validate: targets %+v and %+v", local.To, direct.To)
+	}
+}
+
+func TestMessagesHandlerPages(t *testing.T) {
+
+	ctx, endpoint, _ := makeMessagesTest()
+	ctx.members["g1"] = true
+	for i := 0; i < 120; i++ {
+		ctx.history = append(ctx.history, ChatMessage{Type: "message", Id: uuid.New().String(), Text: strconv.Itoa(i)})
+	}
+
+	get := func(group string, query string) (int, MessageHistory) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/entity/t1/groups/"+group+"/messages?"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"tokenid": "t1", "groupid": group})
+		w := httptest.NewRecorder()
+		endpoint.MessagesHandler(w, req)
+		var history MessageHistory
+		json.Unmarshal(w.Body.Bytes(), &history)
+		return w.Code, history
+	}
+
+	// Pages follow on from the oldest message of the previous page
+	var texts []string
+	query := ""
+	for page := 0; ; page++ {
+		code, history := get("g1", query)
+		if code != http.StatusOK {
+			t.Fatalf("Page %d: status %d", page, code)
+		}
+		for _, msg := range history.Messages {
+			texts = append(texts, msg.Text)
+		}
+		if history.Next == "" {
+			break
+		}
+		if history.Next != history.Messages[len(history.Messages)-1].Id {
+			t.Errorf("Page %d: next %s is not the last message", page, history.Next)
+		}
+		query = "before=" + history.Next
+	}
+	if len(texts) != 120 || texts[0] != "0" || texts[50] != "50" || texts[119] != "119" {
+		t.Errorf("Pages returned %d messages: %v", len(texts), texts)
+	}
+
+	if code, history := get("g1", "limit=200"); code != http.StatusOK || len(history.Messages) != 120 || history.Next != "" {
+		t.Errorf("limit=200: status %d, %d messages, next %q", code, len(history.Messages), history.Next)
+	}
+	if code, history := get("g1", "limit=120"); code != http.StatusOK || history.Next == "" {
+		t.Errorf("limit=120: status %d, next %q, want a next page that may be empty", code, history.Next)
+	}
+	for _, query := range []string{"limit=0", "limit=201", "limit=ten", "before=nobody"} {
+		if code, _ := get("g1", query); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+	if code, _ := get("g2", ""); code != http.StatusForbidden {
+		t.Errorf("History of another group: status %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestSendMessageLimits(t *testing.T) {
+
+	ctx, endpoint, entity := makeMessagesTest()
+	entity.location = MakeLocation(-34.9287, 138.5999, 0, 0, time.Now().Unix())
+	friend, stranger := uuid.New().String(), uuid.New().String()
+	ctx.members["g1"] = true
+	ctx.members["client:"+friend] = true
+
+	// Messages to a client require its consent
+	if berr := endpoint.sendMessage(entity, &ChatMessage{To: MessageTarget{Type: targetClient, Value: stranger}, Text: "Hi"}); berr == nil || berr.code != "not_permitted" {
+		t.Errorf("sendMessage to a stranger: %v", berr)
+	}
+	if berr := endpoint.sendMessage(entity, &ChatMessage{To: MessageTarget{Type: targetClient, Value: friend}, Text: "Hi"}); berr != nil {
+		t.Errorf("sendMessage to a friend: %v", berr)
+	}
+
+	// Messages to clients and around the sender are limited by rate
+	sent := 2
+	for ; sent < messageBurst+5; sent++ {
+		if berr := endpoint.sendMessage(entity, &ChatMessage{To: MessageTarget{Type: targetLocal}, Text: "Hi"}); berr != nil {
+			if berr.code != "rate_limited" {
+				t.Fatalf("sendMessage local: %v", berr)
+			}
+			break
+		}
+	}
+	if sent != messageBurst {
+		t.Errorf("sendMessage: rate limited after %d messages, want %d", sent, messageBurst)
+	}
+	if berr := endpoint.sendMessage(entity, &ChatMessage{To: MessageTarget{Type: targetClient, Value: friend}, Text: "Hi"}); berr == nil || berr.code != "rate_limited" {
+		t.Errorf("sendMessage to a friend after the burst: %v", berr)
+	}
+
+	// Group members chose to receive the messages of their group
+	if berr := endpoint.sendMessage(entity, &ChatMessage{To: MessageTarget{Type: targetGroup, Value: "g1"}, Text: "Hi"}); berr != nil {
+		t.Errorf("sendMessage to a group after the burst: %v", berr)
+	}
+	if berr := endpoint.sendMessage(entity, &ChatMessage{To: MessageTarget{Type: targetGroup, Value: "g2"}, Text: "Hi"}); berr == nil || berr.code != "not_permitted" {
+		t.Errorf("sendMessage to another group: %v", berr)
+	}
+	if len(ctx.sent) != messageBurst {
+		t.Errorf("%d messages sent, want %d", len(ctx.sent), messageBurst)
+	}
+}
+
+func TestInboxNotReadable(t *testing.T) {
+
+	// A group filter cannot be used to read the inbox of another client
+	topology := MakeTopology(MakeConfig(250, 15))
+	store := MakeDataStoreContext(&topology, MakeDataStore())
+	reader := MakeEntity(&store, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	conn := &testConnection{entity: reader}
+	victim := ClientID(uuid.New())
+	value := inboxChannel(victim)
+
+	if groupChannel(value) == inboxChannel(victim) {
+		t.Errorf("groupChannel: group %s shares the inbox of a client", value)
+	}
+	if err := reader.subscription.addFilter(conn, &UserFilter{Type: "group", Value: value}); err == nil {
+		t.Errorf("addFilter: subscribed to group %s without membership", value)
+	}
+	if len(topology.groupSubscriber.connections) != 0 || len(topology.entitySubscriber.connections) != 0 {
+		t.Errorf("addFilter: connection subscribed to a channel")
+	}
+
+	// Only members receive the live messages of a group, and only while
+	// they are members
+	ctx, _, member := makeMessagesTest()
+	conn = &testConnection{entity: member}
+	s := member.subscription
+	if err := s.addFilter(conn, &UserFilter{Type: "group", Value: "g1"}); err == nil {
+		t.Errorf("addFilter: subscribed to a group without membership")
+	}
+	ctx.members["g1"] = true
+	if err := s.addFilter(conn, &UserFilter{Type: "group", Value: "g1"}); err != nil {
+		t.Fatalf("addFilter: %v", err)
+	}
+	s.checkGroups(conn)
+	if !ctx.subscribed[groupChannel("g1")] {
+		t.Errorf("checkGroups: removed the group of a member")
+	}
+	ctx.members["g1"] = false
+	s.checkGroups(conn)
+	if ctx.subscribed[groupChannel("g1")] || s.filters["group:g1"] != nil {
+		t.Errorf("checkGroups: kept the group of a former member")
+	}
+}
+
+func TestBlocksSender(t *testing.T) {
+
+	sender := ClientID(uuid.New())
+	data, _ := json.Marshal(&ChatMessage{Type: "message", From: uuid.UUID(sender).String(), Text: "Hi"})
+
+	blocking := &Entity{}
+	blocking.SetBlocked([]ClientID{sender})
+	other := &Entity{}
+	other.SetBlocked([]ClientID{ClientID(uuid.New())})
+
+	shared := new(eventPayload)
+	if !blocksSender(&testConnection{entity: blocking}, shared, data) {
+		t.Errorf("blocksSender: delivered a message from a blocked client")
+	}
+	if blocksSender(&testConnection{entity: other}, shared, data) || blocksSender(&testConnection{entity: &Entity{}}, shared, data) {
+		t.Errorf("blocksSender: dropped a message from a client not blocked")
+	}
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// The weight given to each new velocity sample when smoothing
+	motionSmoothing = 0.5
+
+	// The speed below which the course is not updated, in meters/second
+	minCourseSpeed = 0.5
+
+	// The furthest time a position is predicted ahead of the last location
+	maxPredictionSec = 10
+
+	// The mean radius of the earth in meters
+	earthRadiusMeters = earthCircumferenceMeters / (2 * pi)
+
+	// The latitude in degrees beyond which predictions do not move east or
+	// west, as a meter spans ever more degrees of longitude at the poles
+	maxEastingLat = 89
+)
+
+//
+// Motion is the motion model of an Entity. It derives a smoothed velocity
+// from successive locations and predicts the position between locations.
+//
+type Motion struct {
+
+	// The last location given to the model
+	last Location
+
+	// True once the model has been given a location
+	valid bool
+
+	// The smoothed velocity towards the east and north in meters/second
+	east  float64
+	north float64
+
+	// The smoothed course in degrees clockwise from north
+	course float64
+}
+
+//
+// Update the motion model with the location 'loc'. Locations that are not
+// newer than the last location are ignored.
+//
+func (m *Motion) Update(loc Location) {
+
+	if !m.valid {
+		m.last = loc
+		m.course = float64(loc.Heading)
+		m.valid = true
+		return
+	}
+
+	dt := loc.secondsSince(&m.last)
+	if dt <= 0 {
+		return
+	}
+
+	// The velocity since the last location
+	lat := m.last.Lat * pi / 180
+	north := (loc.Lat - m.last.Lat) * pi / 180 * earthRadiusMeters / dt
+	east := wrapLng(loc.Lng-m.last.Lng) * pi / 180 * earthRadiusMeters * math.Cos(lat) / dt
+
+	m.east = motionSmoothing*east + (1-motionSmoothing)*m.east
+	m.north = motionSmoothing*north + (1-motionSmoothing)*m.north
+	if m.Speed() >= minCourseSpeed {
+		m.course = math.Mod(math.Atan2(m.east, m.north)*180/pi+360, 360)
+	} else if loc.Heading != 0 {
+		m.course = float64(loc.Heading)
+	}
+	m.last = loc
+}
+
+// Return the smoothed speed in meters/second
+func (m *Motion) Speed() float64 {
+	return math.Hypot(m.east, m.north)
+}
+
+// Return the smoothed course in degrees clockwise from north
+func (m *Motion) Course() float64 {
+	return m.course
+}
+
+//
+// Return the position predicted at the time 't' by dead reckoning from
+// the last location. Predictions are limited to a short time after the last
+// location.
+//
+func (m *Motion) Predict(t time.Time) Location {
+
+	loc := m.last
+	dt := t.Sub(m.last.Time()).Seconds()
+	if !m.valid || dt <= 0 {
+		return loc
+	}
+	if dt > maxPredictionSec {
+		dt = maxPredictionSec
+	}
+
+	loc = moveLocation(loc, m.north*dt, m.east*dt)
+	loc.Heading = float32(m.course)
+	loc.SetTime(m.last.Time().Add(time.Duration(dt * float64(time.Second))))
+	return loc
+}
+
+//
+// Return the location 'loc' moved 'north' and 'east' meters. The latitude
+// is kept within the poles and the longitude wrapped into [-180, 180).
+// Near the poles the location is only moved north or south.
+//
+func moveLocation(loc Location, north float64, east float64) Location {
+
+	lat := loc.Lat * pi / 180
+	if math.Abs(loc.Lat) < maxEastingLat {
+		loc.Lng += east / (earthRadiusMeters * math.Cos(lat)) * 180 / pi
+	}
+	loc.Lng = wrapLng(loc.Lng)
+	loc.Lat = math.Max(-90, math.Min(90, loc.Lat+north/earthRadiusMeters*180/pi))
+	return loc
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Return the location 'north' and 'east' meters from 'origin' at 'seconds'
+// after it
+func offsetLocation(origin Location, north float64, east float64, seconds float64) Location {
+	loc := origin
+	lat := origin.Lat * pi / 180
+	loc.Lat += north / earthRadiusMeters * 180 / pi
+	loc.Lng += east / (earthRadiusMeters * math.Cos(lat)) * 180 / pi
+	loc.SetTime(origin.Time().Add(time.Duration(seconds * float64(time.Second))))
+	return loc
+}
+
+func TestMotionSmoothing(t *testing.T) {
+
+	origin := MakeLocation(-34.9287, 138.5999, 0, 90, 1000)
+	m := Motion{}
+	m.Update(origin)
+	if m.Speed() != 0 || m.Course() != 90 {
+		t.Errorf("Update: expected the heading of the first location, got %v at %v", m.Speed(), m.Course())
+	}
+
+	// Moving north at 10 m/s, the speed converges by the smoothing weight
+	expected := 0.0
+	for i := 1; i <= 4; i++ {
+		m.Update(offsetLocation(origin, 10*float64(i), 0, float64(i)))
+		expected = motionSmoothing*10 + (1-motionSmoothing)*expected
+		if math.Abs(m.Speed()-expected) > 0.01 {
+			t.Errorf("Update %d: expected speed %v, got %v", i, expected, m.Speed())
+		}
+		if m.Course() > 0.5 && m.Course() < 359.5 {
+			t.Errorf("Update %d: expected course 0, got %v", i, m.Course())
+		}
+	}
+
+	// Turning east, the course follows the smoothed velocity
+	last := offsetLocation(origin, 40, 0, 4)
+	m.Update(offsetLocation(last, 0, 10, 1))
+	if c := m.Course(); c <= 0 || c >= 90 {
+		t.Errorf("Update: expected a course between north and east, got %v", c)
+	}
+
+	// Locations that are not newer are ignored
+	speed := m.Speed()
+	m.Update(origin)
+	if m.Speed() != speed {
+		t.Errorf("Update: older location changed the speed")
+	}
+}
+
+func TestMotionSlowCourse(t *testing.T) {
+
+	// Below the minimum speed the course follows the reported heading
+	origin := MakeLocation(-34.9287, 138.5999, 0, 0, 1000)
+	m := Motion{}
+	m.Update(origin)
+	slow := offsetLocation(origin, 0.1, 0, 1)
+	slow.Heading = 180
+	m.Update(slow)
+	if m.Speed() >= minCourseSpeed || m.Course() != 180 {
+		t.Errorf("Update: expected the reported heading, got %v at %v", m.Course(), m.Speed())
+	}
+}
+
+func TestMotionPredict(t *testing.T) {
+
+	origin := MakeLocation(-34.9287, 138.5999, 0, 0, 1000)
+	m := Motion{}
+
+	// Nothing is predicted without a location
+	if p := m.Predict(time.Unix(1000, 0)); p.Lat != 0 || p.Lng != 0 {
+		t.Errorf("Predict: expected no prediction, got %+v", p)
+	}
+
+	m.Update(origin)
+	for i := 1; i <= 8; i++ {
+		m.Update(offsetLocation(origin, 0, 20*float64(i), float64(i)))
+	}
+	last := offsetLocation(origin, 0, 160, 8)
+
+	// Predictions are dead reckoned from the last location, up to the cap
+	for _, dt := range []float64{0, 5, maxPredictionSec, 60} {
+		p := m.Predict(last.Time().Add(time.Duration(dt * float64(time.Second))))
+		ahead := math.Min(dt, maxPredictionSec)
+		expected := offsetLocation(last, 0, m.Speed()*ahead, ahead)
+		if math.Abs(p.Lng-expected.Lng) > 1e-6 || math.Abs(p.Lat-last.Lat) > 1e-6 {
+			t.Errorf("Predict(%vs): expected %v, %v, got %v, %v", dt, expected.Lat, expected.Lng, p.Lat, p.Lng)
+		}
+		if !p.Time().Equal(expected.Time()) {
+			t.Errorf("Predict(%vs): expected time %v, got %v", dt, expected.Time(), p.Time())
+		}
+	}
+}
+
+func TestMotionAntimeridian(t *testing.T) {
+
+	// Heading east at 20 meters/second across the antimeridian
+	origin := MakeLocation(-16.5, 179.999, 0, 0, 1000)
+	m := Motion{}
+	m.Update(origin)
+	for i := 1; i <= 8; i++ {
+		loc := offsetLocation(origin, 0, 20*float64(i), float64(i))
+		loc.Lng = wrapLng(loc.Lng)
+		m.Update(loc)
+	}
+	if math.Abs(m.Speed()-20) > 0.1 || math.Abs(m.Course()-90) > 0.1 {
+		t.Errorf("Update: speed %v and course %v, want 20 and 90", m.Speed(), m.Course())
+	}
+
+	last := offsetLocation(origin, 0, 160, 8)
+	p := m.Predict(last.Time().Add(maxPredictionSec * time.Second))
+	expected := wrapLng(offsetLocation(last, 0, m.Speed()*maxPredictionSec, maxPredictionSec).Lng)
+	if p.Lng < -180 || p.Lng >= 180 || math.Abs(p.Lng-expected) > 1e-6 {
+		t.Errorf("Predict: longitude %v, want %v", p.Lng, expected)
+	}
+}
+
+func TestMovePole(t *testing.T) {
+
+	// Moving east near a pole does not spin around it
+	loc := moveLocation(MakeLocation(89.9999, 10, 0, 0, 0), 0, 1000)
+	if loc.Lng != 10 {
+		t.Errorf("moveLocation: moved to longitude %v near the pole", loc.Lng)
+	}
+
+	// Moving north past a pole stops at it
+	loc = moveLocation(MakeLocation(89.9999, 10, 0, 0, 0), 1000, 0)
+	if loc.Lat != 90 || loc.Lng != 10 {
+		t.Errorf("moveLocation: moved past the pole to %v, %v", loc.Lat, loc.Lng)
+	}
+	loc = moveLocation(MakeLocation(-89.9999, 10, 0, 0, 0), -1000, 0)
+	if loc.Lat != -90 {
+		t.Errorf("moveLocation: moved past the pole to %v", loc.Lat)
+	}
+}
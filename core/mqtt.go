@@ -0,0 +1,237 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The MQTT 3.1.1 control packet types used by mqttClient
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// The keep alive of the MQTT connection
+const mqttKeepAlive = 60 * time.Second
+
+//
+// mqttClient is a minimal MQTT 3.1.1 client supporting only what the
+// bridge needs: a clean session, QoS 0 publish and subscribe, and keep
+// alive pings.
+//
+type mqttClient struct {
+
+	// The connection to the broker
+	conn net.Conn
+
+	// A buffered reader of the connection
+	reader *bufio.Reader
+
+	// The id of the last subscribe packet
+	packetId uint16
+
+	// A mutex serialising writes to the connection
+	lock sync.Mutex
+}
+
+//
+// Connect to the MQTT broker at the address 'addr' as the client
+// 'clientId'. Return an error if the broker refused the connection.
+//
+func dialMQTT(addr string, clientId string) (*mqttClient, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, writeWait)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	body := new(bytes.Buffer)
+	writeMQTTString(body, "MQTT")
+	body.WriteByte(4)    // protocol level 3.1.1
+	body.WriteByte(0x02) // clean session
+	binary.Write(body, binary.BigEndian, uint16(mqttKeepAlive/time.Second))
+	writeMQTTString(body, clientId)
+	err = c.writePacket(mqttConnect<<4, body.Bytes())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(writeWait))
+	header, payload, err := c.readPacket()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if header>>4 != mqttConnack || len(payload) < 2 || payload[1] != 0 {
+		conn.Close()
+		return nil, errors.New("MQTT connection refused")
+	}
+	return c, nil
+}
+
+// Subscribe to the topic filter 'topic' at QoS 0
+func (c *mqttClient) Subscribe(topic string) error {
+	c.lock.Lock()
+	c.packetId++
+	id := c.packetId
+	c.lock.Unlock()
+
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.BigEndian, id)
+	writeMQTTString(body, topic)
+	body.WriteByte(0) // QoS 0
+	return c.writePacket(mqttSubscribe<<4|0x02, body.Bytes())
+}
+
+// Publish the payload 'payload' to the topic 'topic' at QoS 0
+func (c *mqttClient) Publish(topic string, payload []byte) error {
+	body := new(bytes.Buffer)
+	writeMQTTString(body, topic)
+	body.Write(payload)
+	return c.writePacket(mqttPublish<<4, body.Bytes())
+}
+
+//
+// Read packets from the broker, calling 'handler' with the topic and
+// payload of each message published to a subscribed topic, until the
+// connection fails.
+//
+func (c *mqttClient) Run(handler func(topic string, payload []byte)) error {
+
+	go c.ping()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		header, payload, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if header>>4 != mqttPublish {
+			// Acknowledgements and ping responses need no handling
+			continue
+		}
+
+		topic, message, perr := parseMQTTPublish(header, payload)
+		if perr != nil {
+			return perr
+		}
+		handler(topic, message)
+	}
+}
+
+//
+// Return the topic and message of the publish packet with the first byte
+// 'header' and the remainder 'payload'
+//
+func parseMQTTPublish(header byte, payload []byte) (string, []byte, error) {
+
+	if len(payload) < 2 {
+		return "", nil, errors.New("MQTT publish too short")
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+n {
+		return "", nil, errors.New("MQTT publish too short")
+	}
+	topic := string(payload[2 : 2+n])
+	payload = payload[2+n:]
+	if (header>>1)&0x03 > 0 {
+		// Skip the packet id of a QoS 1 or 2 publish
+		if len(payload) < 2 {
+			return "", nil, errors.New("MQTT publish too short")
+		}
+		payload = payload[2:]
+	}
+	return topic, payload, nil
+}
+
+// Ping the broker within the keep alive until the connection fails
+func (c *mqttClient) ping() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if c.writePacket(mqttPingreq<<4, nil) != nil {
+			return
+		}
+	}
+}
+
+// Disconnect from the broker
+func (c *mqttClient) Close() {
+	c.writePacket(mqttDisconnect<<4, nil)
+	c.conn.Close()
+}
+
+func (c *mqttClient) writePacket(header byte, body []byte) error {
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(header)
+
+	// The remaining length is a variable length integer
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	buf.Write(body)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// Return the first byte and the remainder of the next packet
+func (c *mqttClient) readPacket() (byte, []byte, error) {
+
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, berr := c.reader.ReadByte()
+		if berr != nil {
+			return 0, nil, berr
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("MQTT remaining length too long")
+		}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	return header, payload, err
+}
+
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Return the two ends of a connection between MQTT clients
+func makeMQTTPipe() (*mqttClient, *mqttClient) {
+	a, b := net.Pipe()
+	return &mqttClient{conn: a, reader: bufio.NewReader(a)}, &mqttClient{conn: b, reader: bufio.NewReader(b)}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+
+	writer, reader := makeMQTTPipe()
+	defer writer.conn.Close()
+	defer reader.conn.Close()
+
+	// The lengths either side of each size of the variable length integer
+	for _, n := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		body := bytes.Repeat([]byte{byte(n)}, n)
+		errc := make(chan error, 1)
+		go func() { errc <- writer.writePacket(mqttPublish<<4, body) }()
+		header, payload, err := reader.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket(%d): %v", n, err)
+		}
+		if werr := <-errc; werr != nil {
+			t.Fatalf("writePacket(%d): %v", n, werr)
+		}
+		if header != mqttPublish<<4 || !bytes.Equal(payload, body) {
+			t.Errorf("Packet of %d bytes read as %d bytes with header %x", n, len(payload), header)
+		}
+	}
+
+	// The encoding of the remaining length
+	for _, c := range []struct {
+		n      int
+		length []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	} {
+		go writer.writePacket(mqttPingreq<<4, make([]byte, c.n))
+		raw := make([]byte, 1+len(c.length))
+		io.ReadFull(reader.reader, raw)
+		io.CopyN(io.Discard, reader.reader, int64(c.n))
+		if raw[0] != mqttPingreq<<4 || !bytes.Equal(raw[1:], c.length) {
+			t.Errorf("Length %d encoded as % x, want % x", c.n, raw[1:], c.length)
+		}
+	}
+
+	// A remaining length of more than four bytes is invalid
+	go writer.conn.Write([]byte{mqttPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01})
+	if _, _, err := reader.readPacket(); err == nil {
+		t.Errorf("readPacket: expected a remaining length too long")
+	}
+}
+
+func TestParseMQTTPublish(t *testing.T) {
+
+	topic := "envisilab/s1/t1/beacon"
+	body := new(bytes.Buffer)
+	writeMQTTString(body, topic)
+	body.WriteString(`{"lat":1}`)
+	qos0 := body.Bytes()
+	qos1 := append(append(append([]byte{}, qos0[:2+len(topic)]...), 0x00, 0x07), qos0[2+len(topic):]...)
+
+	for _, c := range []struct {
+		header  byte
+		payload []byte
+		topic   string
+		message string
+		ok      bool
+	}{
+		{mqttPublish << 4, qos0, topic, `{"lat":1}`, true},
+		{mqttPublish<<4 | 0x02, qos1, topic, `{"lat":1}`, true},
+		{mqttPublish << 4, qos0[:2+len(topic)], topic, "", true},
+		{mqttPublish << 4, qos0[:1], "", "", false},
+		{mqttPublish << 4, qos0[:len(topic)], "", "", false},
+		{mqttPublish<<4 | 0x02, qos0[:2+len(topic)+1], "", "", false},
+	} {
+		topic, message, err := parseMQTTPublish(c.header, c.payload)
+		if (err == nil) != c.ok || topic != c.topic || string(message) != c.message {
+			t.Errorf("parseMQTTPublish(%x, % x): %q %q %v", c.header, c.payload, topic, message, err)
+		}
+	}
+}
+
+func TestDialMQTT(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+
+	// A broker accepting the first connection and refusing the second
+	go func() {
+		for _, code := range []byte{0, 5} {
+			conn, aerr := listener.Accept()
+			if aerr != nil {
+				return
+			}
+			broker := &mqttClient{conn: conn, reader: bufio.NewReader(conn)}
+			header, payload, rerr := broker.readPacket()
+			if rerr != nil || header != mqttConnect<<4 || !bytes.Contains(payload, []byte("bridge-1")) {
+				conn.Close()
+				continue
+			}
+			broker.writePacket(mqttConnack<<4, []byte{0, code})
+			if code == 0 {
+				body := new(bytes.Buffer)
+				writeMQTTString(body, "envisilab/s1/t1/beacon")
+				body.WriteString("hello")
+				broker.writePacket(mqttPublish<<4, body.Bytes())
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client, err := dialMQTT(listener.Addr().String(), "bridge-1")
+	if err != nil {
+		t.Fatalf("dialMQTT: %v", err)
+	}
+	received := make(chan string, 1)
+	go client.Run(func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+	if r := <-received; r != "envisilab/s1/t1/beacon hello" {
+		t.Errorf("Received %q", r)
+	}
+	client.Close()
+
+	if _, err = dialMQTT(listener.Addr().String(), "bridge-1"); err == nil {
+		t.Errorf("dialMQTT: expected the connection to be refused")
+	}
+}
+
+func TestMQTTBridgeUnknownToken(t *testing.T) {
+
+	endpoint := &Endpoint{entities: make(map[string]*Entity)}
+	b := MakeMQTTBridge(endpoint, "s1")
+
+	// Devices that have not synced are not bridged, whatever their topic
+	for _, topic := range []string{
+		"envisilab/s1/" + uuid.New().String() + "/beacon",
+		"envisilab/s1/" + uuid.New().String() + "/command",
+		"envisilab/s1/" + uuid.New().String() + "/data",
+		"envisilab/s2/" + uuid.New().String() + "/beacon",
+		"envisilab/s1/not-a-token/beacon",
+		"envisilab/s1/beacon",
+	} {
+		b.handle(topic, []byte(`{"type":"sos"}`))
+	}
+	if len(b.conns) != 0 {
+		t.Errorf("%d devices bridged without a token", len(b.conns))
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+)
+
+//
+// Return the JSON value 'js' encoded as MessagePack. Integers are encoded
+// as integers, all other numbers as 64 bit floats and object keys in
+// sorted order.
+//
+func jsonToMsgpack(js []byte) ([]byte, error) {
+
+	v, err := decodeJSON(js)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = writeMsgpack(buf, v)
+	return buf.Bytes(), err
+}
+
+// Return the JSON value 'js' decoded, keeping numbers as json.Number
+func decodeJSON(js []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.UseNumber()
+	var v interface{}
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+		} else {
+			f, ferr := v.Float64()
+			if ferr != nil {
+				return ferr
+			}
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLength(buf, len(v), 0x90, 0xdc)
+		for _, e := range v {
+			if err := writeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeMsgpackLength(buf, len(v), 0x80, 0xde)
+		for _, k := range keys {
+			writeMsgpack(buf, k)
+			if err := writeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("Unsupported value for MessagePack")
+	}
+	return nil
+}
+
+// Write the length of an array or map, using the fix format below 16
+func writeMsgpackLength(buf *bytes.Buffer, n int, fix byte, prefix16 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(prefix16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		// The 32 bit format immediately follows the 16 bit format
+		buf.WriteByte(prefix16 + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Return the MessagePack value read from 'r', with integers as int64 and
+// the formats written by writeMsgpack only
+//
+func readMsgpack(r *bytes.Reader) (interface{}, error) {
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	readLength := func(size int) (int, error) {
+		switch size {
+		case 1:
+			n, err := r.ReadByte()
+			return int(n), err
+		case 2:
+			var n uint16
+			err := binary.Read(r, binary.BigEndian, &n)
+			return int(n), err
+		}
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	}
+	readString := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		s := make([]byte, n)
+		if _, err := r.Read(s); err != nil && n > 0 {
+			return nil, err
+		}
+		return string(s), nil
+	}
+	readArray := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = readMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	readMap := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := readMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			if m[k.(string)], err = readMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	switch {
+	case b < 0x80:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return readString(int(b&0x1f), nil)
+	case b&0xf0 == 0x90:
+		return readArray(int(b&0x0f), nil)
+	case b&0xf0 == 0x80:
+		return readMap(int(b&0x0f), nil)
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcb:
+		var bits uint64
+		err := binary.Read(r, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	case 0xd2:
+		var i int32
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd3:
+		var i int64
+		err := binary.Read(r, binary.BigEndian, &i)
+		return i, err
+	case 0xd9:
+		return readString(readLength(1))
+	case 0xda:
+		return readString(readLength(2))
+	case 0xdb:
+		return readString(readLength(4))
+	case 0xdc:
+		return readArray(readLength(2))
+	case 0xdd:
+		return readArray(readLength(4))
+	case 0xde:
+		return readMap(readLength(2))
+	case 0xdf:
+		return readMap(readLength(4))
+	}
+	return nil, errors.New("Unexpected MessagePack format")
+}
+
+//
+// Return the JSON 'js' with the numbers decoded as readMsgpack decodes them
+//
+func normalizeJSON(t *testing.T, js string) interface{} {
+
+	v, err := decodeJSON([]byte(js))
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %v", js, err)
+	}
+	var normalize func(v interface{}) interface{}
+	normalize = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				return i
+			}
+			f, _ := v.Float64()
+			return f
+		case []interface{}:
+			for i := range v {
+				v[i] = normalize(v[i])
+			}
+		case map[string]interface{}:
+			for k := range v {
+				v[k] = normalize(v[k])
+			}
+		}
+		return v
+	}
+	return normalize(v)
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+
+	keys := make([]string, 17)
+	for i := range keys {
+		keys[i] = `"k` + string(rune('a'+i)) + `":` + string(rune('0'+i%10))
+	}
+
+	for _, js := range []string{
+		`null`,
+		`true`,
+		`false`,
+		`0`,
+		`-1`,
+		`-32`,
+		`-33`,
+		`127`,
+		`128`,
+		`2147483647`,
+		`2147483648`,
+		`-2147483648`,
+		`-2147483649`,
+		`9007199254740993`,
+		`1.5`,
+		`-0.25`,
+		`1e300`,
+		`""`,
+		`"` + strings.Repeat("a", 31) + `"`,
+		`"` + strings.Repeat("a", 32) + `"`,
+		`"` + strings.Repeat("a", 256) + `"`,
+		`"` + strings.Repeat("a", 65536) + `"`,
+		`[]`,
+		`[1,"two",[3],{"four":4}]`,
+		`{"` + strings.Repeat("k", 40) + `":{"nested":[null,true]}}`,
+		`{` + strings.Join(keys[:15], ",") + `}`,
+		`{` + strings.Join(keys, ",") + `}`,
+		`{"clientid":"ad4e6d44-4c2d-4a6b-8a3a-5d4b3a6f6f01","location":{"lat":51.5,"lng":-0.125,"alt":-12},"speed":0}`,
+	} {
+		mp, err := jsonToMsgpack([]byte(js))
+		if err != nil {
+			t.Fatalf("Failed to encode %.40s: %v", js, err)
+		}
+		r := bytes.NewReader(mp)
+		v, err := readMsgpack(r)
+		if err != nil {
+			t.Fatalf("Failed to decode %.40s: %v", js, err)
+		}
+		if r.Len() != 0 {
+			t.Errorf("%.40s: %d bytes left after decoding", js, r.Len())
+		}
+		if want := normalizeJSON(t, js); !reflect.DeepEqual(v, want) {
+			t.Errorf("%.40s: decoded %.60v, want %.60v", js, v, want)
+		}
+	}
+}
+
+func TestMsgpackFormats(t *testing.T) {
+
+	tests := []struct {
+		value  interface{}
+		prefix []byte
+	}{
+		{json.Number("127"), []byte{0x7f}},
+		{json.Number("128"), []byte{0xd2, 0, 0, 0, 0x80}},
+		{json.Number("-1"), []byte{0xff}},
+		{json.Number("-32"), []byte{0xe0}},
+		{json.Number("-33"), []byte{0xd2, 0xff, 0xff, 0xff, 0xdf}},
+		{json.Number("-2147483648"), []byte{0xd2, 0x80, 0, 0, 0}},
+		{json.Number("-2147483649"), []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff}},
+		{json.Number("2147483648"), []byte{0xd3, 0, 0, 0, 0, 0x80, 0, 0, 0}},
+		{json.Number("0.5"), []byte{0xcb, 0x3f, 0xe0}},
+		{strings.Repeat("a", 31), []byte{0xbf}},
+		{strings.Repeat("a", 32), []byte{0xd9, 32}},
+		{strings.Repeat("a", 255), []byte{0xd9, 0xff}},
+		{strings.Repeat("a", 256), []byte{0xda, 0x01, 0x00}},
+		{strings.Repeat("a", 65535), []byte{0xda, 0xff, 0xff}},
+		{strings.Repeat("a", 65536), []byte{0xdb, 0, 0x01, 0, 0}},
+		{make([]interface{}, 15), []byte{0x9f}},
+		{make([]interface{}, 16), []byte{0xdc, 0, 16}},
+		{make([]interface{}, 65536), []byte{0xdd, 0, 0x01, 0, 0}},
+		{msgpackTestMap(15), []byte{0x8f}},
+		{msgpackTestMap(16), []byte{0xde, 0, 16}},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		if err := writeMsgpack(buf, test.value); err != nil {
+			t.Fatalf("Failed to encode %.40v: %v", test.value, err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), test.prefix) {
+			t.Errorf("%.40v: encoded as % x..., want % x...", test.value, buf.Bytes()[:len(test.prefix)], test.prefix)
+		}
+	}
+
+	if err := writeMsgpack(new(bytes.Buffer), 1); err == nil {
+		t.Errorf("Encoded a value JSON does not decode to")
+	}
+}
+
+// Return a map of 'n' entries
+func msgpackTestMap(n int) map[string]interface{} {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		m[strings.Repeat("k", i+1)] = nil
+	}
+	return m
+}
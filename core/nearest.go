@@ -0,0 +1,142 @@
+package core
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+)
+
+const (
+	// The radius first searched for the nearest entities, doubled until
+	// enough are found or the farthest radius is searched
+	nearestFirstRadiusMeters = 1000
+	maxNearestRadiusMeters   = 1024000
+)
+
+//
+// Neighbour is an entity found near a location along with its distance and
+// initial bearing from that location.
+//
+type Neighbour struct {
+	ClientId  string   `json:"clientid"`
+	Location  Location `json:"location"`
+	Predicted Location `json:"predicted"`
+	Speed     float64  `json:"speed"`
+	Course    float64  `json:"course"`
+	Distance  float64  `json:"distance"`
+	Bearing   float64  `json:"bearing"`
+}
+
+//
+// Return the neighbour at the location 'origin' of the entity whose last
+// known user data is 'userData', at its position predicted at the time 'now'
+//
+func makeNeighbour(origin Location, userData *UserData, now time.Time) Neighbour {
+
+	// Use the predicted position, so fast movers are placed correctly
+	predicted := predictPosition(userData.Location, userData.Speed, userData.Course, now)
+	from := s2.PointFromLatLng(s2.LatLngFromDegrees(origin.Lat, origin.Lng))
+	to := s2.PointFromLatLng(s2.LatLngFromDegrees(predicted.Lat, predicted.Lng))
+	return Neighbour{
+		ClientId:  userData.ClientId,
+		Location:  userData.Location,
+		Predicted: predicted,
+		Speed:     userData.Speed,
+		Course:    userData.Course,
+		Distance:  earthRadiansToMeters(from.Distance(to).Radians()),
+		Bearing:   bearingDegrees(origin, predicted),
+	}
+}
+
+//
+// Return the position predicted at the time 't' by dead reckoning from the
+// location 'loc' at the speed 'speed' (meters/second) and course 'course'
+// (degrees). Like Motion.Predict, predictions are limited to a short time
+// after the location.
+//
+func predictPosition(loc Location, speed float64, course float64, t time.Time) Location {
+
+	dt := t.Sub(loc.Time()).Seconds()
+	if dt <= 0 || speed == 0 {
+		return loc
+	}
+	if dt > maxPredictionSec {
+		dt = maxPredictionSec
+	}
+
+	heading := course * pi / 180
+	last := loc.Time()
+	loc = moveLocation(loc, speed*math.Cos(heading)*dt, speed*math.Sin(heading)*dt)
+	loc.Heading = float32(course)
+	loc.SetTime(last.Add(time.Duration(dt * float64(time.Second))))
+	return loc
+}
+
+//
+// Return the initial bearing in degrees clockwise from north from 'from' to 'to'
+//
+func bearingDegrees(from Location, to Location) float64 {
+	lat1 := s1.Angle(from.Lat) * s1.Degree
+	lat2 := s1.Angle(to.Lat) * s1.Degree
+	dLng := (s1.Angle(to.Lng) * s1.Degree) - (s1.Angle(from.Lng) * s1.Degree)
+
+	y := math.Sin(dLng.Radians()) * math.Cos(lat2.Radians())
+	x := math.Cos(lat1.Radians())*math.Sin(lat2.Radians()) -
+		math.Sin(lat1.Radians())*math.Cos(lat2.Radians())*math.Cos(dLng.Radians())
+	bearing := math.Atan2(y, x) * 180 / math.Pi
+	return math.Mod(bearing+360, 360)
+}
+
+//
+// Return the 'k' nearest entities to the location 'loc' at the time 'now',
+// nearest first, of the last known positions returned by 'positions' within
+// a radius of the location. The radius doubles from the first nearest radius
+// until 'k' entities returned by 'visible' are found, or the farthest
+// radius is searched.
+//
+func findNearest(loc Location, k int, visible func(clientIds []string) map[string]bool,
+	positions func(loc Location, radiusMeters float64) ([]UserData, error), now time.Time) ([]Neighbour, error) {
+
+	// The visibility of each client is only asked once
+	permitted := make(map[string]bool)
+	var found []Neighbour
+	for radius := float64(nearestFirstRadiusMeters); ; radius *= 2 {
+		within, err := positions(loc, radius)
+		if err != nil {
+			return nil, err
+		}
+
+		unknown := make([]string, 0, len(within))
+		for i := range within {
+			if _, ok := permitted[within[i].ClientId]; !ok {
+				unknown = append(unknown, within[i].ClientId)
+			}
+		}
+		if len(unknown) > 0 {
+			allowed := visible(unknown)
+			for _, clientId := range unknown {
+				permitted[clientId] = allowed[clientId]
+			}
+		}
+
+		found = make([]Neighbour, 0, k)
+		for i := range within {
+			if permitted[within[i].ClientId] {
+				found = append(found, makeNeighbour(loc, &within[i], now))
+			}
+		}
+		if len(found) >= k || radius >= maxNearestRadiusMeters {
+			break
+		}
+	}
+
+	// The positions are nearest first, but predictions may reorder them
+	sort.Slice(found, func(i, j int) bool { return found[i].Distance < found[j].Distance })
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found, nil
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/geo/s2"
+)
+
+func TestMakeNeighbour(t *testing.T) {
+
+	origin := MakeLocation(51.5, -0.1, 0, 0, 0)
+	start := time.Unix(1000, 0)
+	loc := origin
+	loc.SetTime(start)
+
+	// Moving north at 10 m/s, predicted at most maxPredictionSec ahead
+	userData := UserData{ClientId: "a", Location: loc, Speed: 10, Course: 0}
+	for _, dt := range []float64{5, maxPredictionSec, 60} {
+		now := start.Add(time.Duration(dt * float64(time.Second)))
+		n := makeNeighbour(origin, &userData, now)
+		expected := 10 * math.Min(dt, maxPredictionSec)
+		if math.Abs(n.Distance-expected) > 0.5 {
+			t.Errorf("makeNeighbour(%vs): expected distance %v, got %v", dt, expected, n.Distance)
+		}
+		if n.Bearing > 0.01 && n.Bearing < 359.99 {
+			t.Errorf("makeNeighbour(%vs): expected bearing 0, got %v", dt, n.Bearing)
+		}
+	}
+
+	// A stationary entity is found at its last known position
+	userData.Speed = 0
+	if n := makeNeighbour(origin, &userData, start.Add(time.Minute)); n.Distance > 0.01 || n.Predicted != loc {
+		t.Errorf("makeNeighbour: stationary entity predicted at %+v", n.Predicted)
+	}
+}
+
+func TestPredictPositionAntimeridian(t *testing.T) {
+
+	// Heading west at 50 meters/second from just east of the antimeridian
+	loc := MakeLocation(-16.5, -179.9995, 0, 0, 1000)
+	p := predictPosition(loc, 50, 270, time.Unix(1000+maxPredictionSec, 0))
+	if p.Lng < 179 || p.Lng >= 180 {
+		t.Errorf("predictPosition: longitude %v, want just west of the antimeridian", p.Lng)
+	}
+
+	origin := MakeLocation(-16.5, 179.999, 0, 0, 0)
+	n := makeNeighbour(origin, &UserData{ClientId: "a", Location: loc, Speed: 50, Course: 270}, time.Unix(1000+maxPredictionSec, 0))
+	if n.Distance > 500 {
+		t.Errorf("makeNeighbour: predicted %v meters away across the antimeridian", n.Distance)
+	}
+}
+
+func TestFindNearest(t *testing.T) {
+
+	origin := MakeLocation(-34.9287, 138.5999, 0, 0, 0)
+	place := func(clientId string, north float64) UserData {
+		return UserData{ClientId: clientId, Location: offsetLocation(origin, north, 0, 0)}
+	}
+
+	// Two entities nearby, one of them hidden, and the rest hundreds of
+	// kilometers beyond the first radius searched
+	all := []UserData{
+		place("a", 100), place("hidden", 200), place("b", 600),
+		place("c", 150000), place("d", 300000), place("e", 2000000),
+	}
+	queries := 0
+	positions := func(loc Location, radiusMeters float64) ([]UserData, error) {
+		queries++
+		from := s2.LatLngFromDegrees(loc.Lat, loc.Lng)
+		within := make([]UserData, 0)
+		for _, p := range all {
+			to := s2.LatLngFromDegrees(p.Location.Lat, p.Location.Lng)
+			if earthRadiansToMeters(from.Distance(to).Radians()) <= radiusMeters {
+				within = append(within, p)
+			}
+		}
+		return within, nil
+	}
+	asked := map[string]int{}
+	visible := func(clientIds []string) map[string]bool {
+		permitted := map[string]bool{}
+		for _, clientId := range clientIds {
+			asked[clientId]++
+			permitted[clientId] = clientId != "hidden"
+		}
+		return permitted
+	}
+
+	// The search widens until the 4th nearest visible entity is found
+	found, err := findNearest(origin, 4, visible, positions, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("findNearest: %v", err)
+	}
+	ids := ""
+	for _, n := range found {
+		ids += n.ClientId
+	}
+	if ids != "abcd" || math.Abs(found[3].Distance-300000) > 1 {
+		t.Errorf("findNearest: found %q, the last at %vm", ids, found[len(found)-1].Distance)
+	}
+	if queries < 2 {
+		t.Errorf("findNearest: the search did not widen beyond the first radius")
+	}
+	for clientId, n := range asked {
+		if n != 1 {
+			t.Errorf("findNearest: visibility of %s asked %d times", clientId, n)
+		}
+	}
+
+	// Fewer are found than asked for when the farthest radius is searched
+	queries = 0
+	if found, _ = findNearest(origin, 10, visible, positions, time.Unix(0, 0)); len(found) != 4 {
+		t.Errorf("findNearest: found %d entities within the farthest radius, want 4", len(found))
+	}
+	if math.Exp2(float64(queries-1))*nearestFirstRadiusMeters != maxNearestRadiusMeters {
+		t.Errorf("findNearest: %d queries to reach the farthest radius", queries)
+	}
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"math"
+
+	"github.com/golang/geo/s2"
+	"github.com/google/uuid"
+)
+
+const (
+	// The default fastest plausible speed of an entity in meters/second
+	defaultMaxSpeedMetersPerSec = 100
+
+	// The accuracy assumed for locations without one, in meters
+	defaultAccuracyMeters = 10
+
+	// The process noise of the Kalman filter in meters/second
+	kalmanProcessNoise = 3
+)
+
+//
+// kalmanFilter is the state of a Kalman filter smoothing the locations of a
+// single entity. It models the position as constant with noise growing over
+// time, weighing each location by its accuracy.
+//
+type kalmanFilter struct {
+
+	// The filtered position in degrees
+	lat float64
+	lng float64
+
+	// The variance of the filtered position in meters squared, negative
+	// before the first location
+	variance float64
+
+	// The location last given to the filter
+	last Location
+}
+
+func (kf *kalmanFilter) process(loc Location, accuracy float64) Location {
+
+	if kf.variance < 0 {
+		kf.lat, kf.lng = loc.Lat, loc.Lng
+		kf.variance = accuracy * accuracy
+		kf.last = loc
+		return loc
+	}
+
+	dt := loc.secondsSince(&kf.last)
+	if dt > 0 {
+		kf.variance += dt * kalmanProcessNoise * kalmanProcessNoise
+		kf.last = loc
+	}
+
+	// The longitude is filtered by the shorter way around the globe, so a
+	// track crossing the antimeridian stays on its side
+	k := kf.variance / (kf.variance + accuracy*accuracy)
+	kf.lat += k * (loc.Lat - kf.lat)
+	kf.lng = wrapLng(kf.lng + k*wrapLng(loc.Lng-kf.lng))
+	kf.variance = (1 - k) * kf.variance
+
+	loc.Lat, loc.Lng = kf.lat, kf.lng
+	return loc
+}
+
+//
+// Return the longitude 'lng' in degrees wrapped into [-180, 180)
+//
+func wrapLng(lng float64) float64 {
+	return lng - 360*math.Floor((lng+180)/360)
+}
+
+//
+// LocationPipeline validates and smooths the locations received from
+// entities before they are applied with Entity.Update.
+//
+type LocationPipeline struct {
+
+	// The fastest plausible speed of an entity in meters/second
+	maxSpeedMetersPerSec float64
+
+	// Locations less accurate than this are rejected, zero accepts all
+	maxAccuracyMeters float64
+
+	// True if locations are smoothed with a Kalman filter
+	kalman bool
+}
+
+func MakeLocationPipeline(config *Config) LocationPipeline {
+	p := LocationPipeline{
+		maxSpeedMetersPerSec: config.maxSpeedMetersPerSec,
+		maxAccuracyMeters:    config.maxAccuracyMeters,
+		kalman:               config.kalman,
+	}
+	return p
+}
+
+//
+// Process the location 'loc' received from the entity 'entity'. Return the
+// location to apply to the entity, or an error giving the reason the
+// location was rejected.
+//
+func (p *LocationPipeline) Process(entity *Entity, loc Location) (Location, error) {
+
+	err := p.validate(&entity.location, &loc)
+	if err != nil {
+		log.Printf("Pipeline: rejected location for client %s: %v",
+			uuid.UUID(entity.clientId).String(), err)
+		return loc, err
+	}
+
+	if p.kalman {
+		accuracy := float64(loc.Accuracy)
+		if accuracy <= 0 {
+			accuracy = defaultAccuracyMeters
+		}
+		loc = entity.kalman.process(loc, accuracy)
+	}
+	return loc, nil
+}
+
+//
+// Validate the location 'loc' received after the location 'prev'. Return an
+// error giving the reason the location is not valid. A heading out of range
+// is cleared, as clients report a heading of -1 when it is not known.
+//
+func (p *LocationPipeline) validate(prev *Location, loc *Location) error {
+
+	heading := float64(loc.Heading)
+	if math.IsNaN(heading) || heading < 0 || heading >= 360 {
+		loc.Heading = 0
+	}
+
+	values := []float64{loc.Lat, loc.Lng, float64(loc.Alt), float64(loc.Accuracy)}
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("Location contains NaN or infinite values")
+		}
+	}
+	if loc.Lat < -90 || loc.Lat > 90 {
+		return errors.New("Latitude out of range")
+	}
+	if loc.Lng < -180 || loc.Lng > 180 {
+		return errors.New("Longitude out of range")
+	}
+	if loc.Accuracy < 0 {
+		return errors.New("Accuracy is negative")
+	}
+	if p.maxAccuracyMeters > 0 && float64(loc.Accuracy) > p.maxAccuracyMeters {
+		return errors.New("Location is not accurate enough")
+	}
+
+	// The first location of an entity cannot be checked for a jump
+	if prev.Timestamp == 0 {
+		return nil
+	}
+
+	dt := loc.secondsSince(prev)
+	if dt < 0 {
+		return errors.New("Location is older than the previous location")
+	}
+	if dt < 1 && loc.Nanos == 0 && prev.Nanos == 0 {
+		// Version 1 timestamps are whole seconds, so allow for up to one second
+		dt = 1
+	}
+
+	a := s2.PointFromLatLng(s2.LatLngFromDegrees(prev.Lat, prev.Lng))
+	b := s2.PointFromLatLng(s2.LatLngFromDegrees(loc.Lat, loc.Lng))
+	dist := earthRadiansToMeters(a.Distance(b).Radians())
+
+	// Allow for the inaccuracy of both locations before judging the speed
+	dist -= float64(prev.Accuracy) + float64(loc.Accuracy)
+	if p.maxSpeedMetersPerSec > 0 && dist > p.maxSpeedMetersPerSec*dt {
+		return errors.New("Implausible jump from the previous location")
+	}
+	return nil
+}
+
+// SetMaxSpeedMetersPerSec sets the fastest plausible speed of an entity.
+// Locations implying a faster speed are rejected. Zero disables the check.
+func (c *Config) SetMaxSpeedMetersPerSec(maxSpeedMetersPerSec float64) {
+	c.maxSpeedMetersPerSec = maxSpeedMetersPerSec
+}
+
+// SetMaxAccuracyMeters rejects locations less accurate than the given
+// accuracy. Zero accepts locations of any accuracy.
+func (c *Config) SetMaxAccuracyMeters(maxAccuracyMeters float64) {
+	c.maxAccuracyMeters = maxAccuracyMeters
+}
+
+// SetKalmanSmoothing enables or disables Kalman smoothing of locations.
+func (c *Config) SetKalmanSmoothing(kalman bool) {
+	c.kalman = kalman
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLocationPipeline(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	c.SetKalmanSmoothing(true)
+	p := MakeLocationPipeline(&c)
+	e := &Entity{}
+	e.kalman.variance = -1
+
+	invalid := []Location{
+		MakeLocation(math.NaN(), 138.5999, 0, 0, 100),
+		MakeLocation(-91, 138.5999, 0, 0, 100),
+		MakeLocation(-34.9287, 181, 0, 0, 100),
+	}
+	for _, loc := range invalid {
+		if _, err := p.Process(e, loc); err == nil {
+			t.Errorf("Process(%v): expected location to be rejected", loc)
+		}
+	}
+
+	first, err := p.Process(e, MakeLocation(-34.9287, 138.5999, 0, 0, 100))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	e.location = first
+
+	// About 1.1km in a second is not plausible
+	if _, err = p.Process(e, MakeLocation(-34.9187, 138.5999, 0, 0, 101)); err == nil {
+		t.Errorf("Process: expected jump to be rejected")
+	}
+	if _, err = p.Process(e, MakeLocation(-34.9287, 138.5999, 0, 0, 99)); err == nil {
+		t.Errorf("Process: expected older location to be rejected")
+	}
+
+	// A small move is accepted and smoothed towards the previous location
+	next, err := p.Process(e, MakeLocation(-34.9286, 138.5999, 0, 0, 101))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if next.Lat <= first.Lat || next.Lat >= -34.9286 {
+		t.Errorf("Process: expected smoothed latitude, got %v", next.Lat)
+	}
+}
+
+func TestLocationPipelineHeading(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	p := MakeLocationPipeline(&c)
+
+	// Headings out of range are unknown, not invalid
+	for _, heading := range []float32{-1, 360, float32(math.NaN()), float32(math.Inf(1))} {
+		e := &Entity{}
+		e.kalman.variance = -1
+		loc, err := p.Process(e, MakeLocation(-34.9287, 138.5999, 0, heading, 100))
+		if err != nil || loc.Heading != 0 || loc.Lat != -34.9287 {
+			t.Errorf("Process(heading %v): %+v, %v", heading, loc, err)
+		}
+	}
+
+	e := &Entity{}
+	e.kalman.variance = -1
+	if loc, err := p.Process(e, MakeLocation(-34.9287, 138.5999, 0, 359.5, 100)); err != nil || loc.Heading != 359.5 {
+		t.Errorf("Process(heading 359.5): %+v, %v", loc, err)
+	}
+}
+
+func TestKalmanAntimeridian(t *testing.T) {
+
+	// A track heading east across the antimeridian is smoothed along it,
+	// not across the globe
+	var kf kalmanFilter
+	kf.variance = -1
+	for i, lng := range []float64{179.9990, 179.9995, -179.9999, -179.9994, -179.9989} {
+		loc := kf.process(MakeLocation(0, lng, 0, 90, int64(100+i)), 10)
+		if d := math.Abs(wrapLng(loc.Lng - lng)); d > 0.001 || loc.Lng < -180 || loc.Lng >= 180 {
+			t.Errorf("process(%v): smoothed to %v", lng, loc.Lng)
+		}
+	}
+
+	for _, c := range []struct{ lng, wrapped float64 }{
+		{0, 0}, {180, -180}, {-180, -180}, {190, -170}, {-190, 170}, {540, -180}, {359.5, -0.5},
+	} {
+		if got := wrapLng(c.lng); math.Abs(got-c.wrapped) > 1e-9 {
+			t.Errorf("wrapLng(%v): %v, want %v", c.lng, got, c.wrapped)
+		}
+	}
+}
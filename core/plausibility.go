@@ -0,0 +1,339 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/google/uuid"
+)
+
+const (
+	// The types of plausibility flags raised against a client
+	flagSpeed        = "speed"
+	flagAcceleration = "acceleration"
+	flagTeleport     = "teleport"
+	flagTimestamp    = "timestamp"
+	flagReplay       = "replay"
+
+	// The largest plausible acceleration in meters/second^2
+	maxAccelerationMetersPerSec2 = 20
+
+	// A jump further than this distance is a teleport rather than a speed
+	teleportMeters = 10000
+
+	// The largest difference in seconds between the time elapsed at the
+	// client and at the server between two beacons
+	maxTimestampDriftSec = 3
+
+	// The number of consecutive positions matching those of another client
+	// before a client is flagged as replaying the other's track
+	replayMinPoints = 5
+
+	// The time in seconds positions are remembered to detect replayed tracks
+	replayWindowSec = 3600
+
+	// The time in seconds after which the state of an idle client is dropped
+	trustRetentionSec = 24 * 3600
+
+	// The period between expiring positions and idle clients
+	plausibilityPeriod = time.Minute
+
+	// A client with a trust score below this threshold is flagged
+	defaultTrustThreshold = 0.5
+
+	// The trust regained by a client for each plausible beacon
+	trustRecovery = 0.005
+)
+
+// The trust lost by a client for each type of flag
+var flagPenalties = map[string]float64{
+	flagSpeed:        0.1,
+	flagAcceleration: 0.05,
+	flagTeleport:     0.3,
+	flagTimestamp:    0.05,
+	flagReplay:       0.6,
+}
+
+// PlausibilityFlag describes a single implausible beacon from a client
+type PlausibilityFlag struct {
+	Type   string  `json:"type"`
+	Detail string  `json:"detail"`
+	Score  float64 `json:"score"`
+	Time   int64   `json:"time"`
+}
+
+// clientTrust holds the trust score and the state needed to judge the next
+// beacon of a single client.
+type clientTrust struct {
+
+	// The trust score of the client, from 0 (untrusted) to 1 (trusted)
+	score float64
+
+	// The last raw location received from the client, the speed reached at
+	// it (negative if unknown) and the server time it was received
+	location Location
+	speed    float64
+	received time.Time
+
+	// The other client whose positions this client has been matching and
+	// the number of consecutive matches
+	replayOf      ClientID
+	replayMatches int
+}
+
+// replayPoint records the first client seen at a position
+type replayPoint struct {
+	clientId ClientID
+	seen     int64
+}
+
+//
+// Plausibility judges the beacons received from clients, flagging those
+// that could not have been produced by a real device and keeping a trust
+// score for each client. Beacons are flagged rather than rejected so that
+// the flags can be reviewed and flagged clients excluded from rankings.
+//
+type Plausibility struct {
+
+	// Map of clients to their trust
+	clients map[ClientID]*clientTrust
+
+	// Map of quantized positions to the client first seen there
+	points map[[2]int64]replayPoint
+
+	// A client with a trust score below this threshold is flagged
+	threshold float64
+
+	// The fastest plausible speed of an entity in meters/second
+	maxSpeedMetersPerSec float64
+
+	// A mutex for synchronising the trust between threads
+	lock sync.Mutex
+}
+
+func MakePlausibility(config *Config) *Plausibility {
+	p := &Plausibility{
+		clients:              make(map[ClientID]*clientTrust),
+		points:               make(map[[2]int64]replayPoint),
+		threshold:            config.trustThreshold,
+		maxSpeedMetersPerSec: config.maxSpeedMetersPerSec,
+	}
+	return p
+}
+
+// Quantize a location to about 10cm so that replayed positions match exactly
+func replayKey(loc *Location) [2]int64 {
+	return [2]int64{int64(math.Round(loc.Lat * 1e6)), int64(math.Round(loc.Lng * 1e6))}
+}
+
+//
+// Check the raw location 'loc' received from the client 'clientId' at the
+// server time 'now'. Return the flags raised by the location, if any.
+//
+func (p *Plausibility) Check(clientId ClientID, loc Location, now time.Time) []PlausibilityFlag {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ct, ok := p.clients[clientId]
+	if !ok {
+		ct = &clientTrust{score: 1, speed: -1}
+		p.clients[clientId] = ct
+	}
+
+	flags := make([]PlausibilityFlag, 0)
+	raise := func(flagType string, detail string) {
+		ct.score = math.Max(0, ct.score-flagPenalties[flagType])
+		flags = append(flags, PlausibilityFlag{Type: flagType, Detail: detail, Score: ct.score, Time: now.Unix()})
+	}
+
+	if ok {
+		p.checkMotion(ct, &loc, now.Sub(ct.received).Seconds(), raise)
+	}
+	p.checkReplay(clientId, ct, &loc, now, raise)
+
+	if len(flags) == 0 {
+		ct.score = math.Min(1, ct.score+trustRecovery)
+	}
+	ct.location = loc
+	ct.received = now
+	return flags
+}
+
+//
+// Return the flags raised by the location 'loc' recorded by the client
+// 'clientId' before it was received at 'now', such as while offline. Its
+// motion is judged by its timestamp, as the time it was received says
+// nothing of when it was recorded, and only if it is newer than the latest
+// location checked. Recorded locations do not recover the trust score, so
+// a batch of old locations cannot restore the trust of a flagged client.
+//
+func (p *Plausibility) CheckRecorded(clientId ClientID, loc Location, now time.Time) []PlausibilityFlag {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ct, ok := p.clients[clientId]
+	if !ok {
+		ct = &clientTrust{score: 1, speed: -1}
+		p.clients[clientId] = ct
+	}
+
+	flags := make([]PlausibilityFlag, 0)
+	raise := func(flagType string, detail string) {
+		ct.score = math.Max(0, ct.score-flagPenalties[flagType])
+		flags = append(flags, PlausibilityFlag{Type: flagType, Detail: detail, Score: ct.score, Time: now.Unix()})
+	}
+
+	newer := !ok || loc.secondsSince(&ct.location) > 0
+	if ok && newer {
+		p.checkMotion(ct, &loc, loc.secondsSince(&ct.location), raise)
+	}
+	p.checkReplay(clientId, ct, &loc, now, raise)
+
+	if newer {
+		ct.location = loc
+		ct.received = loc.Time()
+	}
+	return flags
+}
+
+//
+// Check the motion from the last location of the client to the location
+// 'loc', received 'serverDt' seconds after the last
+//
+func (p *Plausibility) checkMotion(ct *clientTrust, loc *Location, serverDt float64, raise func(string, string)) {
+
+	prev := ct.location
+	dt := loc.secondsSince(&prev)
+	if dt <= 0 {
+		raise(flagTimestamp, fmt.Sprintf("timestamp did not advance (%.3f seconds)", dt))
+	} else if drift := dt - serverDt; math.Abs(drift) > maxTimestampDriftSec {
+		raise(flagTimestamp, fmt.Sprintf("client clock drifted %.3f seconds between beacons", drift))
+	}
+
+	// Judge the motion against the server time if the timestamps cannot be trusted
+	elapsed := dt
+	if dt <= 0 {
+		elapsed = serverDt
+	}
+	if elapsed < 1 && (dt <= 0 || (loc.Nanos == 0 && prev.Nanos == 0)) {
+		// Version 1 timestamps are whole seconds, so allow for up to one second
+		elapsed = 1
+	}
+
+	a := s2.PointFromLatLng(s2.LatLngFromDegrees(prev.Lat, prev.Lng))
+	b := s2.PointFromLatLng(s2.LatLngFromDegrees(loc.Lat, loc.Lng))
+	dist := earthRadiansToMeters(a.Distance(b).Radians())
+	dist = math.Max(0, dist-float64(prev.Accuracy)-float64(loc.Accuracy))
+	speed := dist / elapsed
+
+	if p.maxSpeedMetersPerSec > 0 && speed > p.maxSpeedMetersPerSec {
+		if dist > teleportMeters {
+			raise(flagTeleport, fmt.Sprintf("moved %.0f meters in %.0f seconds", dist, elapsed))
+		} else {
+			raise(flagSpeed, fmt.Sprintf("speed of %.1f meters/second", speed))
+		}
+
+		// The speed is not real, so the next acceleration cannot be judged
+		ct.speed = -1
+		return
+	}
+
+	if ct.speed >= 0 {
+		if accel := math.Abs(speed-ct.speed) / elapsed; accel > maxAccelerationMetersPerSec2 {
+			raise(flagAcceleration, fmt.Sprintf("acceleration of %.1f meters/second^2", accel))
+		}
+	}
+	ct.speed = speed
+}
+
+func (p *Plausibility) checkReplay(clientId ClientID, ct *clientTrust, loc *Location, now time.Time, raise func(string, string)) {
+
+	key := replayKey(loc)
+	point, ok := p.points[key]
+	if !ok || now.Unix()-point.seen > replayWindowSec {
+		p.points[key] = replayPoint{clientId: clientId, seen: now.Unix()}
+		ct.replayMatches = 0
+		return
+	}
+	if point.clientId == clientId {
+		ct.replayMatches = 0
+		return
+	}
+
+	if point.clientId != ct.replayOf {
+		ct.replayOf = point.clientId
+		ct.replayMatches = 0
+	}
+	ct.replayMatches++
+	if ct.replayMatches == replayMinPoints {
+		raise(flagReplay, fmt.Sprintf("track matches client %s", uuid.UUID(point.clientId).String()))
+	}
+}
+
+//
+// Return the trust score of the client 'clientId' and whether the client is
+// flagged. Unknown clients are fully trusted.
+//
+func (p *Plausibility) GetTrust(clientId ClientID) (float64, bool) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ct, ok := p.clients[clientId]
+	if !ok {
+		return 1, false
+	}
+	return ct.score, ct.score < p.threshold
+}
+
+//
+// Return the clients of 'clientIds' that are not flagged, for building
+// rankings such as group leaderboards.
+//
+func (p *Plausibility) ExcludeFlagged(clientIds []ClientID) []ClientID {
+
+	trusted := make([]ClientID, 0, len(clientIds))
+	for _, clientId := range clientIds {
+		if _, flagged := p.GetTrust(clientId); !flagged {
+			trusted = append(trusted, clientId)
+		}
+	}
+	return trusted
+}
+
+// Remove the positions older than the replay window and idle clients
+func (p *Plausibility) expire(now time.Time) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for key, point := range p.points {
+		if now.Unix()-point.seen > replayWindowSec {
+			delete(p.points, key)
+		}
+	}
+	for clientId, ct := range p.clients {
+		if now.Sub(ct.received) > trustRetentionSec*time.Second {
+			delete(p.clients, clientId)
+		}
+	}
+}
+
+// Periodically expire the state of this Plausibility
+func (p *Plausibility) Run() {
+	ticker := time.NewTicker(plausibilityPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.expire(now)
+	}
+}
+
+// SetTrustThreshold sets the trust score below which a client is flagged.
+func (c *Config) SetTrustThreshold(threshold float64) {
+	c.trustThreshold = threshold
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPlausibility(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	p := MakePlausibility(&c)
+	a, b := ClientID(uuid.New()), ClientID(uuid.New())
+	start := time.Unix(1000, 0)
+
+	// A client walking north is plausible
+	for i := 0; i < replayMinPoints; i++ {
+		loc := MakeLocation(-34.9287+float64(i)*0.00001, 138.5999, 0, 0, start.Unix()+int64(i))
+		if flags := p.Check(a, loc, start.Add(time.Duration(i)*time.Second)); len(flags) != 0 {
+			t.Errorf("Check: unexpected flags %v", flags)
+		}
+	}
+
+	// Another client replaying the same track is flagged
+	var flags []PlausibilityFlag
+	for i := 0; i < replayMinPoints; i++ {
+		loc := MakeLocation(-34.9287+float64(i)*0.00001, 138.5999, 0, 0, start.Unix()+int64(i)+60)
+		flags = p.Check(b, loc, start.Add(time.Duration(i+60)*time.Second))
+	}
+	if len(flags) != 1 || flags[0].Type != flagReplay {
+		t.Errorf("Check: expected replay flag, got %v", flags)
+	}
+
+	// A jump across the city in a second is a teleport
+	flags = p.Check(a, MakeLocation(-34.8287, 138.5999, 0, 0, start.Unix()+5), start.Add(5*time.Second))
+	if len(flags) != 1 || flags[0].Type != flagTeleport {
+		t.Errorf("Check: expected teleport flag, got %v", flags)
+	}
+
+	// A timestamp that does not advance is flagged
+	flags = p.Check(a, MakeLocation(-34.8287, 138.5999, 0, 0, start.Unix()+5), start.Add(6*time.Second))
+	if len(flags) != 1 || flags[0].Type != flagTimestamp {
+		t.Errorf("Check: expected timestamp flag, got %v", flags)
+	}
+
+	if _, flagged := p.GetTrust(b); !flagged {
+		t.Errorf("GetTrust: expected replaying client to be flagged")
+	}
+	if trusted := p.ExcludeFlagged([]ClientID{a, b}); len(trusted) != 1 || trusted[0] != a {
+		t.Errorf("ExcludeFlagged: expected only the first client, got %v", trusted)
+	}
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The presence states of an entity
+const (
+	// Beaconing or connected
+	presenceOnline = "online"
+
+	// In standby mode
+	presenceStandby = "standby"
+
+	// No longer connected
+	presenceOffline = "offline"
+)
+
+// The crossings of a region reported by a geofence event
+const (
+	geofenceEnter = "enter"
+	geofenceExit  = "exit"
+)
+
+// Every published presence starts with its type, so it can be told apart
+// from user data without decoding it
+var presencePrefix = []byte(`{"type":"presence"`)
+
+//
+// Presence is published whenever an entity comes online, enters standby or
+// goes offline. It is written to the same connections as the entity's
+// locations, and carries the entity's last known location.
+//
+type Presence struct {
+
+	// Always "presence", to distinguish presence from user data
+	Type string `json:"type"`
+
+	// The client id of the entity
+	ClientId string `json:"clientid"`
+
+	// The state of the entity: online, standby or offline
+	State string `json:"state"`
+
+	// The last known location of the entity
+	Location Location `json:"location"`
+
+	// The server time the state changed, in milliseconds
+	Time int64 `json:"time_ms"`
+}
+
+//
+// GeofenceEvent is written to a connection watching a region whenever an
+// entity enters or leaves the region
+//
+type GeofenceEvent struct {
+
+	// The crossing: enter or exit
+	Event string `json:"event"`
+
+	// The value of the region filter crossed
+	Region string `json:"region"`
+
+	// The client id and location of the entity crossing the region
+	ClientId string   `json:"clientid"`
+	Location Location `json:"location"`
+}
+
+//
+// Return true if the published data 'data' is a presence rather than user data
+//
+func isPresence(data []byte) bool {
+	return bytes.HasPrefix(data, presencePrefix)
+}
+
+//
+// Return the presence 'state' of the entity 'entity' at the time 'now'
+//
+func makePresence(entity *Entity, state string, now time.Time) Presence {
+	return Presence{
+		Type:     "presence",
+		ClientId: uuid.UUID(entity.clientId).String(),
+		State:    state,
+		Location: entity.location,
+		Time:     now.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+//
+// Return the geofence event of the entity of 'userData' crossing the region
+// of the filter channels 'fc', given whether its location is now 'inside'
+// the region, or nil if it did not cross the region
+//
+func (fc *filterChannels) crossed(userData *UserData, inside bool) *Event {
+
+	if fc.inside == nil {
+		fc.inside = make(map[string]bool)
+	}
+	crossing := ""
+	if inside && !fc.inside[userData.ClientId] {
+		fc.inside[userData.ClientId] = true
+		crossing = geofenceEnter
+	} else if !inside && fc.inside[userData.ClientId] {
+		delete(fc.inside, userData.ClientId)
+		crossing = geofenceExit
+	}
+	if crossing == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(&GeofenceEvent{
+		Event:    crossing,
+		Region:   fc.filter.Value,
+		ClientId: userData.ClientId,
+		Location: userData.Location,
+	})
+	if err != nil {
+		return nil
+	}
+	return &Event{Type: EventGeofence, Source: []UserFilter{fc.filter}, Payload: payload}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"errors"
+	"strconv"
 	"time"
 	"github.com/google/uuid"
 	"github.com/gomodule/redigo/redis"
@@ -121,3 +122,117 @@ func (self *Publisher) TokenExpired(tokenId TokenID) bool {
 	val, _ := conn.Do("GET", uuid.UUID(tokenId).String())
 	return val == nil
 }
+
+//
+// Set the last known position 'loc' of client 'clientId' for the service
+// 'service' along with the user data 'userData' describing the client.
+//
+func (self *Publisher) SetPosition(service string, clientId ClientID, loc Location, userData []byte) error {
+
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	member := uuid.UUID(clientId).String()
+	conn.Send("MULTI")
+	conn.Send("GEOADD", "positions:" + service, loc.Lng, loc.Lat, member)
+	conn.Send("ZADD", "lastseen:" + service, time.Now().Unix(), member)
+	conn.Send("HSET", "userdata:" + service, member, userData)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+//
+// Remove the last known position of client 'clientId' for the service 'service'
+//
+func (self *Publisher) RemovePosition(service string, clientId ClientID) error {
+
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	member := uuid.UUID(clientId).String()
+	conn.Send("MULTI")
+	conn.Send("ZREM", "positions:" + service, member)
+	conn.Send("ZREM", "lastseen:" + service, member)
+	conn.Send("HDEL", "userdata:" + service, member)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+//
+// Get the user data of all clients of the service 'service' whose last known
+// position lies within 'radiusMeters' of the location 'loc', nearest first.
+// Positions not updated within 'timeoutSec' seconds are not returned.
+//
+func (self *Publisher) GetPositions(service string, loc Location, radiusMeters float64, timeoutSec int) ([][]byte, error) {
+
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	positionsKey := "positions:" + service
+	lastSeenKey := "lastseen:" + service
+	userDataKey := "userdata:" + service
+
+	members, err := redis.Strings(conn.Do("GEORADIUS", positionsKey, loc.Lng, loc.Lat, radiusMeters, "m", "ASC"))
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	// Skip the positions of clients that have not been seen recently, which
+	// are yet to be removed by ExpirePositions
+	for _, member := range members {
+		conn.Send("ZSCORE", lastSeenKey, member)
+	}
+	conn.Flush()
+	expiry := time.Now().Unix() - int64(timeoutSec)
+	fresh := members[:0]
+	for _, member := range members {
+		lastSeen, serr := redis.Int64(conn.Receive())
+		if serr == nil && lastSeen >= expiry {
+			fresh = append(fresh, member)
+		}
+	}
+	members = fresh
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	values, err := redis.ByteSlices(conn.Do("HMGET", redis.Args{}.Add(userDataKey).AddFlat(members)...))
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make([][]byte, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			positions = append(positions, v)
+		}
+	}
+	return positions, nil
+}
+
+//
+// Remove the last known positions of the clients of the service 'service'
+// that have not been seen within 'timeoutSec' seconds
+//
+func (self *Publisher) ExpirePositions(service string, timeoutSec int) error {
+
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	positionsKey := "positions:" + service
+	lastSeenKey := "lastseen:" + service
+	userDataKey := "userdata:" + service
+
+	expiry := strconv.FormatInt(time.Now().Unix() - int64(timeoutSec), 10)
+	stale, err := redis.Strings(conn.Do("ZRANGEBYSCORE", lastSeenKey, "-inf", "(" + expiry))
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", redis.Args{}.Add(lastSeenKey).AddFlat(stale)...)
+	conn.Send("ZREM", redis.Args{}.Add(positionsKey).AddFlat(stale)...)
+	conn.Send("HDEL", redis.Args{}.Add(userDataKey).AddFlat(stale)...)
+	_, err = conn.Do("EXEC")
+	return err
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/golang/geo/s2"
+)
+
+// The maximum number of topology cells a single region may cover
+const maxRegionCells = 256
+
+//
+// Region is a fixed area of the topology described by either a GeoJSON
+// polygon or a bounding box. It is used to watch an area independently of
+// the position of the watching entity.
+//
+type Region struct {
+
+	// The GeoJSON polygon or bbox the region was made from
+	value string
+
+	// The loops describing the region. The first loop is the exterior of the
+	// region, any further loops are holes. Empty when the region is a bbox.
+	loops []*s2.Loop
+
+	// The bounding box of the region. Only used when the region is a bbox.
+	rect s2.Rect
+
+	// The ids of the cells covering the region at the topology level
+	cellGroup []s2.CellID
+
+	// The clients whose data the region admits, or nil to admit all clients
+	visible *clientVisibility
+}
+
+// geoJSON is the subset of a GeoJSON object understood by a Region
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates [][][]float64   `json:"coordinates"`
+	Bbox        []float64       `json:"bbox"`
+	Geometry    json.RawMessage `json:"geometry"`
+}
+
+//
+// MakeRegion parses the GeoJSON polygon or bbox 'value' and computes its
+// covering for the topology level of the given configuration.
+// The value can either be a bbox array [minLng, minLat, maxLng, maxLat], a
+// GeoJSON Polygon, a GeoJSON Feature with a Polygon geometry or any GeoJSON
+// object with a 'bbox' member.
+//
+func MakeRegion(value string, config *Config) (*Region, error) {
+
+	r := new(Region)
+	r.value = value
+	err := r.parse([]byte(value))
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &s2.RegionCoverer{MaxLevel: config.topologyLevel, MinLevel: config.topologyLevel}
+	var covering s2.CellUnion
+	if len(r.loops) > 0 {
+		covering = rc.Covering(r.loops[0])
+	} else {
+		covering = rc.Covering(r.rect)
+	}
+
+	if len(covering) > maxRegionCells {
+		return nil, errors.New("Region covers too many cells")
+	}
+	r.cellGroup = covering
+	return r, nil
+}
+
+func (r *Region) parse(value []byte) error {
+
+	value = bytes.TrimSpace(value)
+	if len(value) > 0 && value[0] == '[' {
+		var bbox []float64
+		err := json.Unmarshal(value, &bbox)
+		if err != nil {
+			return err
+		}
+		return r.parseBbox(bbox)
+	}
+
+	var obj geoJSON
+	err := json.Unmarshal(value, &obj)
+	if err != nil {
+		return err
+	}
+
+	switch obj.Type {
+	case "Feature":
+		if len(obj.Geometry) == 0 {
+			return errors.New("Region feature has no geometry")
+		}
+		return r.parse(obj.Geometry)
+	case "Polygon":
+		return r.parsePolygon(obj.Coordinates)
+	}
+
+	if len(obj.Bbox) > 0 {
+		return r.parseBbox(obj.Bbox)
+	}
+	return errors.New("Unsupported region type: " + obj.Type)
+}
+
+func (r *Region) parseBbox(bbox []float64) error {
+
+	if len(bbox) != 4 {
+		return errors.New("Region bbox must be [minLng, minLat, maxLng, maxLat]")
+	}
+	if bbox[1] > bbox[3] {
+		return errors.New("Region bbox has minLat greater than maxLat")
+	}
+
+	lo := s2.LatLngFromDegrees(bbox[1], bbox[0]).Normalized()
+	hi := s2.LatLngFromDegrees(bbox[3], bbox[2]).Normalized()
+	r.rect = s2.RectFromLatLng(lo).AddPoint(hi)
+	if bbox[0] > bbox[2] {
+		// The bbox crosses the antimeridian
+		r.rect.Lng.Lo, r.rect.Lng.Hi = lo.Lng.Radians(), hi.Lng.Radians()
+	}
+	return nil
+}
+
+func (r *Region) parsePolygon(rings [][][]float64) error {
+
+	if len(rings) == 0 {
+		return errors.New("Region polygon has no rings")
+	}
+
+	for i, ring := range rings {
+		// GeoJSON rings repeat the first position at the end
+		if len(ring) > 1 && ring[0][0] == ring[len(ring)-1][0] && ring[0][1] == ring[len(ring)-1][1] {
+			ring = ring[:len(ring)-1]
+		}
+		if len(ring) < 3 {
+			return errors.New("Region polygon ring has less than 3 positions")
+		}
+
+		points := make([]s2.Point, 0, len(ring))
+		for _, pos := range ring {
+			if len(pos) < 2 {
+				return errors.New("Region polygon position must be [lng, lat]")
+			}
+			points = append(points, s2.PointFromLatLng(s2.LatLngFromDegrees(pos[1], pos[0])))
+		}
+
+		loop := s2.LoopFromPoints(points)
+		if err := loop.Validate(); err != nil {
+			return err
+		}
+
+		// Not all GeoJSON producers follow the right hand rule, so always
+		// treat each ring as the smaller of the two areas it bounds.
+		if !loop.IsNormalized() {
+			loop.Invert()
+		}
+
+		if i == 0 {
+			r.loops = make([]*s2.Loop, 0, len(rings))
+		}
+		r.loops = append(r.loops, loop)
+	}
+	return nil
+}
+
+//
+// Return true if the location 'loc' lies within this region.
+//
+func (r *Region) ContainsLocation(loc *Location) bool {
+
+	ll := s2.LatLngFromDegrees(loc.Lat, loc.Lng)
+	if len(r.loops) == 0 {
+		return r.rect.ContainsLatLng(ll)
+	}
+
+	p := s2.PointFromLatLng(ll)
+	if !r.loops[0].ContainsPoint(p) {
+		return false
+	}
+	for _, hole := range r.loops[1:] {
+		if hole.ContainsPoint(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// A region filters the data written to a connection to the region
+func (r *Region) matches(conn Connection, loc *Location) bool {
+	return r.ContainsLocation(loc)
+}
+
+// A region only admits the data of the clients visible to its connection
+func (r *Region) admits(clientId string, now time.Time) bool {
+	return r.visible == nil || r.visible.admits(clientId, now)
+}
+
+func (r *Region) GetCellGroup() []s2.CellID {
+	return r.cellGroup
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestRegion(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+
+	values := []string{
+		`[138.59, -34.93, 138.60, -34.92]`,
+		`{"type": "Polygon", "coordinates": [[[138.59, -34.93], [138.60, -34.93], [138.60, -34.92], [138.59, -34.92], [138.59, -34.93]]]}`,
+		`{"type": "Polygon", "coordinates": [[[138.59, -34.93], [138.59, -34.92], [138.60, -34.92], [138.60, -34.93]]]}`,
+		`{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [[[138.59, -34.93], [138.60, -34.93], [138.60, -34.92], [138.59, -34.92]]]}}`,
+	}
+
+	inside := MakeLocation(-34.925, 138.595, 0, 0, 0)
+	outside := MakeLocation(-34.915, 138.595, 0, 0, 0)
+	for _, v := range values {
+		r, err := MakeRegion(v, &c)
+		if err != nil {
+			t.Fatalf("MakeRegion(%s): %v", v, err)
+		}
+		if len(r.GetCellGroup()) == 0 {
+			t.Errorf("MakeRegion(%s): empty covering", v)
+		}
+		if !r.ContainsLocation(&inside) {
+			t.Errorf("MakeRegion(%s): expected location inside region", v)
+		}
+		if r.ContainsLocation(&outside) {
+			t.Errorf("MakeRegion(%s): expected location outside region", v)
+		}
+	}
+
+	// A region covering too many cells is rejected
+	_, err := MakeRegion(`[138.0, -35.0, 139.0, -34.0]`, &c)
+	if err == nil {
+		t.Error("Expected an error for a region covering too many cells")
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"sync"
+
+	"github.com/golang/geo/s2"
+)
+
+// The level of the coarse cells in which the occupancy of the topology is tracked
+const occupancyLevel = 10
+
+//
+// Scale is a topology level along with the search radius used around the
+// cells of that level.
+//
+type Scale struct {
+
+	// The S2 level of the topology cells
+	level int
+
+	// The search radius around a cell
+	searchRadiusMeters float64
+	height             float64
+
+	// The minimum occupancy of a coarse cell for this scale to be used
+	minOccupancy int
+}
+
+func makeScale(topologyLevel int, searchRadiusMeters float64, minOccupancy int) Scale {
+	s := Scale{
+		level:              topologyLevel,
+		searchRadiusMeters: searchRadiusMeters,
+		height:             toHeight(searchRadiusMeters),
+		minOccupancy:       minOccupancy,
+	}
+	return s
+}
+
+func (s *Scale) GetLevel() int {
+	return s.level
+}
+
+func (s *Scale) GetSearchRadiusMeters() float64 {
+	return s.searchRadiusMeters
+}
+
+//
+// SetAdaptiveScales enables adaptive topology levels. Entities in a coarse
+// cell occupied by less than 'sparseMax' entities use a coarser level with a
+// larger search radius, while entities in a coarse cell occupied by at least
+// 'denseMin' entities use a finer level with a smaller search radius.
+//
+func (c *Config) SetAdaptiveScales(sparseMax int, denseMin int) {
+	c.scales = []Scale{
+		makeScale(c.topologyLevel-2, c.searchRadiusMeters*4, 0),
+		makeScale(c.topologyLevel, c.searchRadiusMeters, sparseMax),
+		makeScale(c.topologyLevel+2, c.searchRadiusMeters/4, denseMin),
+	}
+}
+
+//
+// Return the scale to use within a coarse cell occupied by 'occupancy' entities
+//
+func (c *Config) selectScale(occupancy int) *Scale {
+	scale := &c.scales[0]
+	for i := range c.scales {
+		if c.scales[i].minOccupancy <= occupancy {
+			scale = &c.scales[i]
+		}
+	}
+	return scale
+}
+
+//
+// Return the scale with the level 'level', or the default scale if there is none
+//
+func (c *Config) scaleForLevel(level int) *Scale {
+	for i := range c.scales {
+		if c.scales[i].level == level {
+			return &c.scales[i]
+		}
+	}
+	return c.selectScale(0)
+}
+
+//
+// occupancy tracks the number of entities within each coarse cell of a topology
+//
+type occupancy struct {
+
+	// Map of coarse cell ids to the number of entities within them
+	counts map[s2.CellID]int
+
+	// A Read/Write mutex for synchronising the counts between threads
+	lock sync.RWMutex
+}
+
+func makeOccupancy() *occupancy {
+	o := &occupancy{counts: make(map[s2.CellID]int)}
+	return o
+}
+
+//
+// Return the number of entities within the coarse cell 'cid'
+//
+func (o *occupancy) count(cid s2.CellID) int {
+	if o == nil {
+		return 0
+	}
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return o.counts[cid]
+}
+
+//
+// Move an entity from the coarse cell 'from' to the coarse cell 'to'.
+// A zero cell id means the entity is entering or leaving the topology.
+//
+func (o *occupancy) move(from s2.CellID, to s2.CellID) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if from != 0 {
+		o.counts[from]--
+		if o.counts[from] <= 0 {
+			delete(o.counts, from)
+		}
+	}
+	if to != 0 {
+		o.counts[to]++
+	}
+}
@@ -0,0 +1,443 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The states of an SOS alert
+const (
+	// Repeating until enough recipients acknowledge it
+	sosActive = "active"
+
+	// Acknowledged by enough recipients
+	sosAcknowledged = "acknowledged"
+
+	// Cancelled by the client that raised it
+	sosCancelled = "cancelled"
+
+	// Neither acknowledged nor cancelled in time
+	sosExpired = "expired"
+)
+
+// The events notified to the SOS webhooks
+const (
+	sosEventRaised       = "raised"
+	sosEventEscalated    = "escalated"
+	sosEventAcknowledged = "acknowledged"
+	sosEventCancelled    = "cancelled"
+	sosEventExpired      = "expired"
+)
+
+const (
+	// The default number of acknowledgements an SOS alert requires
+	defaultSOSAcks = 1
+
+	// The default interval at which an unacknowledged SOS alert repeats
+	defaultSOSRepeat = 30 * time.Second
+
+	// The number of repeats after which an unacknowledged alert is escalated
+	sosEscalateAttempts = 3
+
+	// The time after which an unacknowledged alert stops repeating
+	sosExpiry = 2 * time.Hour
+
+	// The interval at which an alert is written again to a websocket client
+	// that has not acknowledged it
+	sosRedeliverPeriod = 5 * time.Second
+
+	// The attempts made to deliver a webhook, doubling the wait each time
+	sosWebhookAttempts = 3
+	sosWebhookBackoff  = 2 * time.Second
+	sosWebhookTimeout  = 10 * time.Second
+)
+
+var (
+	errSOSNotFound     = errors.New("No active SOS alert with that id")
+	errSOSOwnAlert     = errors.New("An SOS alert cannot be acknowledged by its sender")
+	errSOSNotOwner     = errors.New("Only the sender may cancel an SOS alert")
+	errSOSNotRecipient = errors.New("Only the recipients of an SOS alert may acknowledge it")
+)
+
+// Every published SOS alert starts with its type, so it can be told apart
+// from user data without decoding it
+var sosPrefix = []byte(`{"type":"sos"`)
+
+//
+// SOSAlert is an emergency raised by a client. It is written to the members
+// of the client's groups, the entities around it and its followers, and
+// repeats until acknowledged by the configured number of recipients.
+//
+type SOSAlert struct {
+
+	// Always "sos", to distinguish alerts from user data
+	Type string `json:"type"`
+
+	// The unique id of the alert
+	Id string `json:"id"`
+
+	// The client id of the sender and its latest location
+	ClientId string   `json:"clientid"`
+	Location Location `json:"location"`
+
+	// A description of the emergency given by the sender
+	Text string `json:"text,omitempty"`
+
+	// The state of the alert: active, acknowledged, cancelled or expired
+	State string `json:"state"`
+
+	// The number of times the alert has been written, starting at 1
+	Attempt int `json:"attempt"`
+
+	// True once the alert has repeated unacknowledged for too long
+	Escalated bool `json:"escalated,omitempty"`
+
+	// The client ids of the recipients that acknowledged the alert, and the
+	// number of acknowledgements required
+	Acks     []string `json:"acks"`
+	Required int      `json:"required"`
+
+	// The server time the alert was raised, in milliseconds
+	Time int64 `json:"time_ms"`
+}
+
+// SOSWebhook is the body posted to the SOS webhooks
+type SOSWebhook struct {
+	Event string   `json:"event"`
+	Alert SOSAlert `json:"alert"`
+}
+
+//
+// Return true if the published data 'data' is an SOS alert
+//
+func isSOS(data []byte) bool {
+	return bytes.HasPrefix(data, sosPrefix)
+}
+
+// The state of an alert kept by the SOSService
+type sosState struct {
+	alert  SOSAlert
+	entity *Entity
+	raised time.Time
+	next   time.Time
+}
+
+//
+// SOSService repeats the active SOS alerts until they are acknowledged,
+// cancelled or expire, and notifies the webhooks of their progress.
+//
+type SOSService struct {
+
+	// The context through which alerts are written and stored
+	ctx Context
+
+	// The number of acknowledgements an alert requires and the interval at
+	// which it repeats until then
+	required int
+	repeat   time.Duration
+
+	// The URLs notified of each alert
+	webhooks []string
+	client   *http.Client
+
+	// The active alerts, by id and by the entity that raised them
+	alerts   map[string]*sosState
+	entities map[*Entity]*sosState
+
+	// A lock synchronising the alerts
+	lock sync.Mutex
+}
+
+//
+// MakeSOSService creates the SOS service of the context 'ctx' with the
+// settings of the configuration 'config'
+//
+func MakeSOSService(ctx Context, config *Config) *SOSService {
+	s := &SOSService{
+		ctx:      ctx,
+		required: config.sosAcks,
+		repeat:   config.sosRepeat,
+		webhooks: config.sosWebhooks,
+		client:   &http.Client{Timeout: sosWebhookTimeout},
+		alerts:   make(map[string]*sosState),
+		entities: make(map[*Entity]*sosState),
+	}
+	if s.required < 1 {
+		s.required = 1
+	}
+	return s
+}
+
+//
+// Raise an SOS alert with the text 'text' for the entity 'entity' at its
+// latest location. An entity with an active alert has it written again.
+//
+func (s *SOSService) Raise(entity *Entity, text string, now time.Time) SOSAlert {
+
+	s.lock.Lock()
+	state, ok := s.entities[entity]
+	event := ""
+	if ok {
+		state.alert.Attempt++
+		if text != "" {
+			state.alert.Text = text
+		}
+	} else {
+		state = &sosState{
+			alert: SOSAlert{
+				Type:     "sos",
+				Id:       uuid.New().String(),
+				ClientId: uuid.UUID(entity.clientId).String(),
+				Text:     text,
+				State:    sosActive,
+				Attempt:  1,
+				Acks:     []string{},
+				Required: s.required,
+				Time:     now.UnixNano() / int64(time.Millisecond),
+			},
+			entity: entity,
+			raised: now,
+		}
+		s.alerts[state.alert.Id] = state
+		s.entities[entity] = state
+		event = sosEventRaised
+	}
+	state.alert.Location = entity.location
+	state.next = now.Add(s.repeat)
+	alert := state.alert
+	s.lock.Unlock()
+
+	s.publish(entity, &alert, event)
+	return alert
+}
+
+//
+// Acknowledge the alert with id 'id' on behalf of the entity 'entity'.
+// The alert stops repeating once enough recipients acknowledge it. Only the
+// entities it is written to may acknowledge it.
+//
+func (s *SOSService) Acknowledge(entity *Entity, id string) (SOSAlert, error) {
+
+	s.lock.Lock()
+	state, ok := s.alerts[id]
+	if !ok {
+		s.lock.Unlock()
+		return SOSAlert{}, errSOSNotFound
+	}
+	if state.entity.clientId == entity.clientId {
+		s.lock.Unlock()
+		return SOSAlert{}, errSOSOwnAlert
+	}
+	sender, location := state.alert.ClientId, state.alert.Location
+	s.lock.Unlock()
+
+	// The recipients are checked without the lock, as they may be stored
+	if !s.receives(entity, sender, location) {
+		return SOSAlert{}, errSOSNotRecipient
+	}
+
+	s.lock.Lock()
+	if s.alerts[id] != state {
+		// Acknowledged, cancelled or expired meanwhile
+		s.lock.Unlock()
+		return SOSAlert{}, errSOSNotFound
+	}
+
+	clientIdStr := uuid.UUID(entity.clientId).String()
+	for _, ack := range state.alert.Acks {
+		if ack == clientIdStr {
+			// Already acknowledged by this client
+			alert := state.alert
+			s.lock.Unlock()
+			return alert, nil
+		}
+	}
+	state.alert.Acks = append(state.alert.Acks, clientIdStr)
+
+	event := ""
+	if len(state.alert.Acks) >= state.alert.Required {
+		state.alert.State = sosAcknowledged
+		s.removeNoLock(state)
+		event = sosEventAcknowledged
+	}
+	alert := state.alert
+	s.lock.Unlock()
+
+	err := s.ctx.RecordSOSAck(entity, &alert)
+	if err != nil {
+		log.Printf("SOS: Failed to record acknowledgement: %v", err)
+	}
+
+	// Let the sender and other recipients know of the acknowledgement
+	s.publish(state.entity, &alert, event)
+	return alert, nil
+}
+
+//
+// Return true if the entity 'entity' receives the alerts of the client
+// 'sender' raised at the location 'location': it is around the location,
+// or is a member of one of the sender's groups or a follower of the sender.
+//
+func (s *SOSService) receives(entity *Entity, sender string, location Location) bool {
+	if location.Timestamp != 0 && entity.cell != nil && entity.cell.covers(location) {
+		return true
+	}
+	return s.ctx.VisibleClients(entity, []string{sender})[sender]
+}
+
+//
+// Cancel the alert with id 'id' raised by the entity 'entity'
+//
+func (s *SOSService) Cancel(entity *Entity, id string) (SOSAlert, error) {
+
+	s.lock.Lock()
+	state, ok := s.alerts[id]
+	if !ok {
+		s.lock.Unlock()
+		return SOSAlert{}, errSOSNotFound
+	}
+	if state.entity.clientId != entity.clientId {
+		s.lock.Unlock()
+		return SOSAlert{}, errSOSNotOwner
+	}
+	state.alert.State = sosCancelled
+	s.removeNoLock(state)
+	alert := state.alert
+	s.lock.Unlock()
+
+	s.publish(state.entity, &alert, sosEventCancelled)
+	return alert, nil
+}
+
+//
+// Repeat the active alerts that are due at the time 'now', escalating those
+// unacknowledged for too long and expiring the oldest
+//
+func (s *SOSService) repeatDue(now time.Time) {
+
+	type due struct {
+		entity *Entity
+		alert  SOSAlert
+		event  string
+	}
+
+	s.lock.Lock()
+	repeats := make([]due, 0)
+	for _, state := range s.alerts {
+		if now.Before(state.next) {
+			continue
+		}
+
+		event := ""
+		if now.Sub(state.raised) > sosExpiry {
+			state.alert.State = sosExpired
+			s.removeNoLock(state)
+			event = sosEventExpired
+		} else {
+			state.alert.Attempt++
+			state.alert.Location = state.entity.location
+			state.next = now.Add(s.repeat)
+			if !state.alert.Escalated && state.alert.Attempt > sosEscalateAttempts {
+				state.alert.Escalated = true
+				event = sosEventEscalated
+			}
+		}
+		alert := state.alert
+		repeats = append(repeats, due{state.entity, alert, event})
+	}
+	s.lock.Unlock()
+
+	for i := range repeats {
+		s.publish(repeats[i].entity, &repeats[i].alert, repeats[i].event)
+	}
+}
+
+//
+// Remove the alert 'state' from the active alerts
+//
+func (s *SOSService) removeNoLock(state *sosState) {
+	delete(s.alerts, state.alert.Id)
+	if s.entities[state.entity] == state {
+		delete(s.entities, state.entity)
+	}
+}
+
+//
+// Write the alert 'alert' of the entity 'entity' to its recipients and
+// notify the webhooks of the event 'event', if any
+//
+func (s *SOSService) publish(entity *Entity, alert *SOSAlert, event string) {
+
+	js, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("SOS: Failure generating alert: %v", err)
+		return
+	}
+
+	err = s.ctx.BroadcastSOS(entity, alert, js)
+	if err != nil {
+		log.Printf("SOS: Failed to broadcast alert %s: %v", alert.Id, err)
+	}
+
+	if event != "" {
+		for _, url := range s.webhooks {
+			go s.notify(url, SOSWebhook{Event: event, Alert: *alert})
+		}
+	}
+}
+
+//
+// Post the webhook 'hook' to the URL 'url', retrying on failure
+//
+func (s *SOSService) notify(url string, hook SOSWebhook) {
+
+	js, err := json.Marshal(&hook)
+	if err != nil {
+		return
+	}
+
+	wait := sosWebhookBackoff
+	for attempt := 1; ; attempt++ {
+		resp, perr := s.client.Post(url, "application/json", bytes.NewReader(js))
+		if perr == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			perr = errors.New(resp.Status)
+		}
+		if attempt == sosWebhookAttempts {
+			log.Printf("SOS: Failed to notify webhook %s of alert %s: %v", url, hook.Alert.Id, perr)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+//
+// Run repeats the active alerts until they are acknowledged
+//
+func (s *SOSService) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.repeatDue(now)
+	}
+}
+
+// SetSOS sets the number of acknowledgements that stop an SOS alert
+// repeating, the interval at which it repeats and the webhooks notified of
+// its progress.
+func (c *Config) SetSOS(requiredAcks int, repeat time.Duration, webhooks []string) {
+	c.sosAcks = requiredAcks
+	c.sosRepeat = repeat
+	c.sosWebhooks = webhooks
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sosContext records the SOS alerts written through it
+type sosContext struct {
+	Context
+	alerts []SOSAlert
+	acks   int
+
+	// The clients that share a group with the sender or follow it
+	recipients map[ClientID]bool
+}
+
+func (ctx *sosContext) VisibleClients(entity *Entity, clientIds []string) map[string]bool {
+	visible := map[string]bool{}
+	if ctx.recipients[entity.clientId] {
+		for _, clientId := range clientIds {
+			visible[clientId] = true
+		}
+	}
+	return visible
+}
+
+func (ctx *sosContext) BroadcastSOS(entity *Entity, alert *SOSAlert, message []byte) error {
+	ctx.alerts = append(ctx.alerts, *alert)
+	return nil
+}
+
+func (ctx *sosContext) RecordSOSAck(entity *Entity, alert *SOSAlert) error {
+	ctx.acks++
+	return nil
+}
+
+func TestSOS(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	c.SetSOS(2, 30*time.Second, nil)
+	ctx := &sosContext{}
+	s := MakeSOSService(ctx, &c)
+
+	sender := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	first := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	second := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	ctx.recipients = map[ClientID]bool{first.clientId: true, second.clientId: true}
+	start := time.Unix(1000, 0)
+
+	alert := s.Raise(sender, "Twisted ankle", start)
+	if alert.State != sosActive || alert.Attempt != 1 || len(ctx.alerts) != 1 {
+		t.Fatalf("Raise: unexpected alert %+v", alert)
+	}
+
+	// Raising again repeats the same alert
+	if again := s.Raise(sender, "", start); again.Id != alert.Id || again.Attempt != 2 {
+		t.Errorf("Raise: expected the active alert to repeat, got %+v", again)
+	}
+
+	// The alert repeats until acknowledged, and escalates
+	for i := 1; i <= sosEscalateAttempts; i++ {
+		s.repeatDue(start.Add(time.Duration(i) * time.Minute))
+	}
+	latest := ctx.alerts[len(ctx.alerts)-1]
+	if latest.Attempt != 2+sosEscalateAttempts || !latest.Escalated {
+		t.Errorf("repeatDue: expected an escalated alert, got %+v", latest)
+	}
+
+	// The sender cannot acknowledge its own alert
+	if _, err := s.Acknowledge(sender, alert.Id); err != errSOSOwnAlert {
+		t.Errorf("Acknowledge: expected errSOSOwnAlert, got %v", err)
+	}
+
+	// A single acknowledgement is not enough, nor is acknowledging twice
+	for i := 0; i < 2; i++ {
+		acked, err := s.Acknowledge(first, alert.Id)
+		if err != nil || acked.State != sosActive || len(acked.Acks) != 1 {
+			t.Errorf("Acknowledge: unexpected alert %+v, %v", acked, err)
+		}
+	}
+
+	acked, err := s.Acknowledge(second, alert.Id)
+	if err != nil || acked.State != sosAcknowledged || ctx.acks != 2 {
+		t.Errorf("Acknowledge: expected an acknowledged alert, got %+v, %v", acked, err)
+	}
+
+	// An acknowledged alert no longer repeats
+	n := len(ctx.alerts)
+	s.repeatDue(start.Add(time.Hour))
+	if len(ctx.alerts) != n {
+		t.Errorf("repeatDue: acknowledged alert repeated")
+	}
+	if _, err = s.Cancel(sender, alert.Id); err != errSOSNotFound {
+		t.Errorf("Cancel: expected errSOSNotFound, got %v", err)
+	}
+
+	// An unacknowledged alert expires
+	alert = s.Raise(sender, "", start)
+	s.repeatDue(start.Add(sosExpiry + time.Minute))
+	if latest = ctx.alerts[len(ctx.alerts)-1]; latest.State != sosExpired {
+		t.Errorf("repeatDue: expected an expired alert, got %+v", latest)
+	}
+
+	// Only the sender can cancel an alert
+	alert = s.Raise(sender, "", start)
+	if _, err = s.Cancel(first, alert.Id); err != errSOSNotOwner {
+		t.Errorf("Cancel: expected errSOSNotOwner, got %v", err)
+	}
+	if cancelled, cerr := s.Cancel(sender, alert.Id); cerr != nil || cancelled.State != sosCancelled {
+		t.Errorf("Cancel: unexpected alert %+v, %v", cancelled, cerr)
+	}
+}
+
+func TestSOSRecipients(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	topology := MakeTopology(c)
+	ctx := &sosContext{recipients: map[ClientID]bool{}}
+	s := MakeSOSService(ctx, &c)
+
+	loc := MakeLocation(-34.9287, 138.5999, 0, 0, 1000)
+	sender := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), topology.MakeCell())
+	sender.location = loc
+	alert := s.Raise(sender, "", time.Unix(1000, 0))
+
+	// Entities far away that are neither members nor followers knowing the
+	// id of the alert cannot acknowledge it
+	stranger := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), topology.MakeCell())
+	stranger.cell.Changed(&Location{Lat: 51.5072, Lng: -0.1276, Timestamp: 1000})
+	if _, err := s.Acknowledge(stranger, alert.Id); err != errSOSNotRecipient {
+		t.Errorf("Acknowledge by a stranger: expected errSOSNotRecipient, got %v", err)
+	}
+
+	// Entities around the sender receive the alert
+	nearby := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), topology.MakeCell())
+	nearby.cell.Changed(&Location{Lat: loc.Lat + 0.001, Lng: loc.Lng, Timestamp: 1000})
+	if _, err := s.Acknowledge(nearby, alert.Id); err != nil {
+		t.Errorf("Acknowledge by a nearby entity: %v", err)
+	}
+
+	// As do the members of the sender's groups and its followers
+	alert = s.Raise(sender, "", time.Unix(2000, 0))
+	ctx.recipients[stranger.clientId] = true
+	if acked, err := s.Acknowledge(stranger, alert.Id); err != nil || acked.State != sosAcknowledged {
+		t.Errorf("Acknowledge by a member: %+v, %v", acked, err)
+	}
+}
+
+func TestSOSGroups(t *testing.T) {
+
+	groups := []Group{{Uuid: "g1"}, {Uuid: "g2"}, {Uuid: "g1"}}
+	ids := sosGroups(groups, []string{"g2", "g3", "g3"})
+	if strings.Join(ids, ",") != "g1,g2,g3" {
+		t.Errorf("sosGroups: %v, want each group once", ids)
+	}
+}
+
+func TestWebSocketSOSQueue(t *testing.T) {
+
+	c := &WebSocketConnection{
+		encoder:  makeEventEncoder(eventVersionEnvelope),
+		sos:      make(map[string]*pendingSOS),
+		sosReady: make(chan struct{}, 1),
+	}
+	now := time.Unix(1000, 0)
+	sos := func(id string, state string) *Event {
+		js, _ := json.Marshal(&SOSAlert{Type: "sos", Id: id, State: state})
+		return &Event{Type: EventSOS, Payload: js}
+	}
+
+	// More alerts than ever fit the priority queue are all written, once
+	for i := 0; i < 20; i++ {
+		c.queueSOS(sos(uuid.New().String(), sosActive), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if due := c.dueSOS(now); len(due) != 20 {
+		t.Fatalf("dueSOS: %d alerts written, want 20", len(due))
+	}
+	if due := c.dueSOS(now.Add(time.Second)); len(due) != 0 {
+		t.Errorf("dueSOS: %d alerts written again before they are due", len(due))
+	}
+
+	// Alerts not acknowledged are written again with the same sequence
+	// number, and acknowledged ones are not
+	c.acknowledge(10)
+	due := c.dueSOS(now.Add(sosRedeliverPeriod))
+	if len(due) != 10 {
+		t.Fatalf("dueSOS: %d alerts written again, want 10", len(due))
+	}
+	var env Envelope
+	json.Unmarshal(due[0], &env)
+	if env.Seq != 11 || env.Type != EventSOS {
+		t.Errorf("dueSOS: first alert written again %+v, want sequence number 11", env)
+	}
+	c.acknowledge(20)
+	if due = c.dueSOS(now.Add(2 * sosRedeliverPeriod)); len(due) != 0 || len(c.sos) != 0 {
+		t.Errorf("dueSOS: %d alerts written and %d queued after their acknowledgement", len(due), len(c.sos))
+	}
+
+	// A new state of an alert replaces the one queued
+	c.queueSOS(sos("a1", sosActive), now)
+	c.queueSOS(sos("a1", sosCancelled), now)
+	if due = c.dueSOS(now); len(due) != 1 || !strings.Contains(string(due[0]), sosCancelled) {
+		t.Errorf("dueSOS: %d alerts written, want the cancelled alert", len(due))
+	}
+
+	// Clients that do not acknowledge events are written each alert once
+	c = &WebSocketConnection{
+		encoder:  makeEventEncoder(eventVersionLegacy),
+		sos:      make(map[string]*pendingSOS),
+		sosReady: make(chan struct{}, 1),
+	}
+	c.queueSOS(sos("a1", sosActive), now)
+	if due = c.dueSOS(now); len(due) != 1 || len(c.sos) != 0 {
+		t.Errorf("dueSOS: %d alerts written and %d queued for a version 1 client", len(due), len(c.sos))
+	}
+}
@@ -0,0 +1,418 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The number of events buffered by a stream for resumption
+	streamBufferSize = 256
+
+	// The time a stream is kept without a client attached, so the client
+	// can resume it after reconnecting
+	streamIdleTimeout = 60 * time.Second
+
+	// The period between checks for idle streams
+	streamExpiryPeriod = 10 * time.Second
+
+	// The longest time a long-poll request waits for an event
+	longPollWait = 25 * time.Second
+)
+
+// streamEvent is an encoded event buffered by a stream
+type streamEvent struct {
+	id        uint64
+	eventType string
+	data      []byte
+}
+
+//
+// StreamConnection is a Connection for clients that cannot use websockets.
+// Events are buffered with increasing ids and read by Server-Sent Events
+// or long-poll requests. The stream outlives each request so that a client
+// reconnecting with the id of the last event it received resumes the same
+// stream without losing events.
+//
+type StreamConnection struct {
+
+	// The entity representing this connection
+	entity *Entity
+
+	// The endpoint on which this stream is operating
+	endpoint *Endpoint
+
+	// The encoder of the events written to this stream
+	encoder eventEncoder
+
+	// The most recent events, oldest first
+	events []streamEvent
+
+	// The id of the last event written. The ids of a stream start after
+	// the time it was created, so that the ids of an expired stream are
+	// before those of the stream replacing it.
+	lastId uint64
+
+	// The id of the latest event dropped from the buffer, or before the
+	// first event of the stream
+	dropped uint64
+
+	// Closed and replaced whenever an event is written
+	notify chan struct{}
+
+	// The number of requests reading from this stream and the time the
+	// last one finished
+	attached int
+	detached time.Time
+
+	// Closed once the stream has expired
+	done chan struct{}
+
+	// A mutex for synchronising the stream between threads
+	lock sync.Mutex
+}
+
+func MakeStreamConnection(entity *Entity, endpoint *Endpoint, version int) *StreamConnection {
+	now := time.Now()
+	first := streamFirstId(now)
+	c := &StreamConnection{
+		entity:   entity,
+		endpoint: endpoint,
+		encoder:  makeEventEncoder(version),
+		events:   make([]streamEvent, 0, streamBufferSize),
+		lastId:   first,
+		dropped:  first,
+		notify:   make(chan struct{}),
+		detached: now,
+		done:     make(chan struct{}),
+	}
+	return c
+}
+
+//
+// Return the id before the first event of a stream created at 'now': the
+// time in milliseconds, times 1000. Ids stay below the 2^53 integers exact
+// in JavaScript for centuries.
+//
+func streamFirstId(now time.Time) uint64 {
+	return uint64(now.UnixNano()/int64(time.Millisecond)) * 1000
+}
+
+func (c *StreamConnection) GetEntity() *Entity {
+	return c.entity
+}
+
+// Run the subscription of the entity on this stream until the stream expires
+func (c *StreamConnection) ReadPump() {
+
+	c.entity.subscription.Start(c)
+
+	<-c.done
+	c.entity.subscription.Stop(c)
+}
+
+// Expire this stream once no client has been attached for a while
+func (c *StreamConnection) WritePump() {
+	ticker := time.NewTicker(streamExpiryPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.lock.Lock()
+		idle := c.attached == 0 && time.Since(c.detached) > streamIdleTimeout
+		c.lock.Unlock()
+		if idle {
+			c.endpoint.removeStream(c)
+			close(c.done)
+			return
+		}
+	}
+}
+
+func (c *StreamConnection) Write(event *Event) {
+
+	data := c.encoder.encode(event)
+	if data == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastId++
+	if len(c.events) == streamBufferSize {
+		// Drop the oldest event, other than an SOS alert
+		drop := 0
+		for drop < len(c.events)-1 && c.events[drop].eventType == EventSOS {
+			drop++
+		}
+		c.dropped = c.events[drop].id
+		c.events = append(c.events[:drop], c.events[drop+1:]...)
+	}
+	c.events = append(c.events, streamEvent{id: c.lastId, eventType: event.Type, data: data})
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+//
+// Return the buffered events after the event with id 'lastId', the id to
+// read from next, whether events after 'lastId' were lost before they could
+// be read, and a channel closed when the next event is written. Events are
+// lost when they were dropped from the buffer, or when 'lastId' is of
+// another stream, such as one that expired while the client was away. All
+// the buffered events are returned for an id of another stream.
+//
+func (c *StreamConnection) since(lastId uint64) ([]streamEvent, uint64, bool, <-chan struct{}) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	lost := lastId != 0 && (lastId < c.dropped || lastId > c.lastId)
+	if lastId > c.lastId {
+		lastId = 0
+	}
+	events := make([]streamEvent, 0)
+	for _, e := range c.events {
+		if e.id > lastId {
+			events = append(events, e)
+		}
+	}
+	if lost || len(events) > 0 {
+		lastId = c.lastId
+	}
+	return events, lastId, lost, c.notify
+}
+
+func (c *StreamConnection) attach() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.attached++
+}
+
+func (c *StreamConnection) detach() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.attached--
+	c.detached = time.Now()
+}
+
+//
+// Return the stream of the entity 'entity', creating and starting it if
+// the entity has none.
+//
+func (endpoint *Endpoint) getStream(entity *Entity, req *http.Request) *StreamConnection {
+
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+
+	c, ok := endpoint.streams[entity]
+	if !ok {
+		c = MakeStreamConnection(entity, endpoint, negotiateEventVersion(req))
+		endpoint.streams[entity] = c
+		go c.ReadPump()
+		go c.WritePump()
+	}
+	return c
+}
+
+func (endpoint *Endpoint) removeStream(c *StreamConnection) {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	if endpoint.streams[c.entity] == c {
+		delete(endpoint.streams, c.entity)
+	}
+}
+
+// Return the id of the last event received by the client making 'req'
+func lastEventId(req *http.Request, param string) uint64 {
+	s := req.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = req.URL.Query().Get(param)
+	}
+	id, _ := strconv.ParseUint(s, 10, 64)
+	return id
+}
+
+// EventsHandler streams the data of an entity as Server-Sent Events.
+// Each event has the id to resume from, the event type and the event JSON
+// in the format of the negotiated event version.
+// Headers:
+//    Last-Event-ID: <id> (optional, to resume a stream)
+//    Event-Version: <event_version> (optional)
+// Query:
+//    lastEventId: <id> (optional, for clients that cannot set headers)
+//    v: <event_version> (optional)
+func (endpoint *Endpoint) EventsHandler(w http.ResponseWriter, req *http.Request) {
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Get the entity associated with this token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Events: Failed to acquire entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		messageError(w, "Events: Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := endpoint.getStream(entity, req)
+	c.attach()
+	defer c.detach()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	lastId := lastEventId(req, "lastEventId")
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		var events []streamEvent
+		var lost bool
+		var notify <-chan struct{}
+		events, lastId, lost, notify = c.since(lastId)
+		if lost {
+			// Tell the client events were dropped while it was away
+			sys := makeSystemEvent("resync", c.encoder.version)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", sys.Type, sys.Payload)
+		}
+		for _, e := range events {
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.eventType, e.data)
+		}
+		flusher.Flush()
+
+		select {
+		case <-notify:
+		case <-ticker.C:
+			// Keep the connection alive through proxies
+			fmt.Fprint(w, ": ping\n\n")
+		case <-req.Context().Done():
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// PollEvent is a single event returned by a long-poll request
+type PollEvent struct {
+	Id   uint64          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// PollResponse is the response to a long-poll request
+type PollResponse struct {
+
+	// The events after the id given in the request
+	Events []PollEvent `json:"events"`
+
+	// The id to give in the next request
+	LastId uint64 `json:"lastid"`
+
+	// True if events after the id given in the request were dropped
+	Lost bool `json:"lost"`
+}
+
+// PollHandler returns the events of an entity after the given id, waiting
+// for up to 25 seconds if there are none yet.
+// Headers:
+//    Last-Event-ID: <id> (optional)
+//    Event-Version: <event_version> (optional)
+// Query:
+//    since: <id> (optional)
+//    v: <event_version> (optional)
+func (endpoint *Endpoint) PollHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// Poll requests must be Gets
+		return
+	}
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Get the entity associated with this token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Poll: Failed to acquire entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := endpoint.getStream(entity, req)
+	c.attach()
+	defer c.detach()
+
+	events, lastId, lost, notify := c.since(lastEventId(req, "since"))
+	if len(events) == 0 && !lost {
+		timer := time.NewTimer(longPollWait)
+		select {
+		case <-notify:
+			events, lastId, lost, _ = c.since(lastId)
+		case <-timer.C:
+		case <-req.Context().Done():
+		case <-c.done:
+		}
+		timer.Stop()
+	}
+
+	response := PollResponse{Events: make([]PollEvent, 0, len(events)), LastId: lastId, Lost: lost}
+	for _, e := range events {
+		response.Events = append(response.Events, PollEvent{Id: e.id, Type: e.eventType, Data: json.RawMessage(e.data)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	js, jerr := json.Marshal(&response)
+	if jerr != nil {
+		messageError(w, "Poll: Failure generating response: " + jerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(js)
+}
+
+// CommandHandler handles a single command, as otherwise sent over the
+// websocket, for clients reading their data with EventsHandler or
+// PollHandler. The reply to the command is the response.
+func (endpoint *Endpoint) CommandHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		// Command requests must be POST
+		return
+	}
+
+	vars := mux.Vars(req)
+	tokenIdStr := vars["tokenid"]
+
+	// Get the entity associated with this token
+	entity, err := endpoint.GetEntity(tokenIdStr)
+	if err != nil {
+		messageError(w, "Command: Failed to acquire entity: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxMessageSize))
+	var message json.RawMessage
+	err = decoder.Decode(&message)
+	if err != nil {
+		messageError(w, "Command: Invalid command: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	reply := endpoint.handleCommand(entity, nil, message)
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Write(reply)
+	log.Printf("Command: handled for entity with tokenID: %s", tokenIdStr)
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// Return an endpoint with the entity of the token "t1" reading from a
+// stream with 'n' events. The stream is not started, so the handlers read
+// it without a subscription.
+//
+func makeTestStream(n int) (*Endpoint, *StreamConnection) {
+
+	entity := &Entity{}
+	endpoint := &Endpoint{
+		entities: map[string]*Entity{"t1": entity},
+		streams:  make(map[*Entity]*StreamConnection),
+	}
+	c := MakeStreamConnection(entity, endpoint, eventVersionEnvelope)
+	endpoint.streams[entity] = c
+	for i := 0; i < n; i++ {
+		c.Write(&Event{Type: EventLocation, Payload: []byte(`{"clientid":"c` + strconv.Itoa(i) + `"}`)})
+	}
+	return endpoint, c
+}
+
+func TestStreamSince(t *testing.T) {
+
+	_, c := makeTestStream(3)
+	first := c.lastId - 2
+
+	tests := []struct {
+		lastId uint64
+		events int
+		resume uint64
+		lost   bool
+	}{
+		{0, 3, c.lastId, false},
+		{first, 2, c.lastId, false},
+		{c.lastId, 0, c.lastId, false},
+
+		// An id of the stream that expired before this one
+		{300, 3, c.lastId, true},
+		{first - 2, 3, c.lastId, true},
+
+		// An id after the last event, of a stream created later
+		{c.lastId + 1000, 3, c.lastId, true},
+	}
+
+	for _, test := range tests {
+		events, resume, lost, _ := c.since(test.lastId)
+		if len(events) != test.events || resume != test.resume || lost != test.lost {
+			t.Errorf("since(%d): %d events to %d, lost %v, want %d to %d, lost %v",
+				test.lastId, len(events), resume, lost, test.events, test.resume, test.lost)
+		}
+	}
+
+	// A client that read all events of a new stream has lost none
+	_, fresh := makeTestStream(0)
+	if events, resume, lost, _ := fresh.since(0); len(events) != 0 || resume != 0 || lost {
+		t.Errorf("since(0) of an empty stream: %d events to %d, lost %v", len(events), resume, lost)
+	}
+
+	// Events dropped from the buffer are lost
+	_, full := makeTestStream(streamBufferSize + 2)
+	oldest := full.lastId - streamBufferSize - 1
+	if events, _, lost, _ := full.since(oldest); len(events) != streamBufferSize || !lost {
+		t.Errorf("since(%d) of an overflowed stream: %d events, lost %v", oldest, len(events), lost)
+	}
+	if _, _, lost, _ := full.since(oldest + 1); lost {
+		t.Errorf("since(%d) of an overflowed stream lost events", oldest+1)
+	}
+}
+
+func TestEventsHandlerResume(t *testing.T) {
+
+	endpoint, c := makeTestStream(2)
+	close(c.done)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/entity/t1/events", nil)
+	req.Header.Set("Last-Event-ID", "300")
+	req = mux.SetURLVars(req, map[string]string{"tokenid": "t1"})
+	w := httptest.NewRecorder()
+	endpoint.EventsHandler(w, req)
+
+	body := w.Body.String()
+	if w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content type %q", w.Header().Get("Content-Type"))
+	}
+	resync := strings.Index(body, `"event":"resync"`)
+	if resync < 0 {
+		t.Fatalf("No resync event for an expired stream id: %s", body)
+	}
+	for id := c.lastId - 1; id <= c.lastId; id++ {
+		i := strings.Index(body, "id: "+strconv.FormatUint(id, 10)+"\nevent: location\n")
+		if i < resync {
+			t.Errorf("Event %d not sent after the resync: %s", id, body)
+		}
+	}
+
+	// Resuming from the last event sends neither a resync nor old events
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/entity/t1/events", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(c.lastId, 10))
+	req = mux.SetURLVars(req, map[string]string{"tokenid": "t1"})
+	w = httptest.NewRecorder()
+	endpoint.EventsHandler(w, req)
+	if body := w.Body.String(); strings.Contains(body, "resync") || strings.Contains(body, "id: ") {
+		t.Errorf("Events resent after the last event: %s", body)
+	}
+}
+
+func TestPollHandlerResume(t *testing.T) {
+
+	endpoint, c := makeTestStream(3)
+
+	poll := func(since uint64) PollResponse {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/entity/t1/poll?since="+strconv.FormatUint(since, 10), nil)
+		req = mux.SetURLVars(req, map[string]string{"tokenid": "t1"})
+		w := httptest.NewRecorder()
+		endpoint.PollHandler(w, req)
+		var response PollResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Invalid poll response %s: %v", w.Body.String(), err)
+		}
+		return response
+	}
+
+	response := poll(c.lastId - 1)
+	if len(response.Events) != 1 || response.Events[0].Id != c.lastId || response.LastId != c.lastId || response.Lost {
+		t.Errorf("Poll of the last event: %+v", response)
+	}
+
+	response = poll(300)
+	if len(response.Events) != 3 || response.LastId != c.lastId || !response.Lost {
+		t.Errorf("Poll of an expired stream id: %+v", response)
+	}
+	if response.Events[0].Type != EventLocation || !strings.Contains(string(response.Events[0].Data), `"seq":1`) {
+		t.Errorf("Poll event %+v, want the first location", response.Events[0])
+	}
+
+	// A poll with nothing to read waits until the stream expires
+	close(c.done)
+	response = poll(c.lastId)
+	if len(response.Events) != 0 || response.LastId != c.lastId || response.Lost {
+		t.Errorf("Poll with no new events: %+v", response)
+	}
+}
@@ -1,12 +1,80 @@
 package core
 
 import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"log"
 	"sync"
 	"strconv"
+	"time"
+	"github.com/google/uuid"
 	"github.com/gomodule/redigo/redis"
 )
 
 
+const (
+	// The time allowed for a running subscription to apply a filter
+	filterTimeout = 5 * time.Second
+
+	// The period between checks that the entity of a running subscription
+	// is still a member of the groups it is subscribed to
+	groupMemberPeriod = time.Minute
+)
+
+//
+// filterError is the reason a filter could not be applied, with the error
+// code replied to the client
+//
+type filterError struct {
+	code    string
+	message string
+}
+
+func (e *filterError) Error() string {
+	return e.message
+}
+
+// filterRequest is a filter to apply to a running subscription, along with
+// the channel on which the outcome is returned
+type filterRequest struct {
+	filter *UserFilter
+	result chan error
+}
+
+//
+// fanoutConnection writes the events of the subscription of an entity to
+// every connection of the entity, so its websockets, event streams and
+// bridged device share the one subscription and its filters
+//
+type fanoutConnection struct {
+	entity *Entity
+
+	// The connections attached to the subscription
+	conns map[Connection]bool
+
+	// A lock synchronising access to the attached connections
+	lock sync.RWMutex
+}
+
+func (c *fanoutConnection) GetEntity() *Entity { return c.entity }
+func (c *fanoutConnection) ReadPump()          {}
+func (c *fanoutConnection) WritePump()         {}
+
+func (c *fanoutConnection) Write(event *Event) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for conn := range c.conns {
+		conn.Write(event)
+	}
+}
+
+// attachRequest is a connection attached to a running subscription, which
+// is sent the snapshots of the current filters
+type attachRequest struct {
+	conn Connection
+}
+
 type Subscription struct {
 
 	// The Context on which this Subscription is operating
@@ -15,75 +83,334 @@ type Subscription struct {
 	// The current cell
 	cell *Cell
 
-	// Subscription filter.
-	filter *UserFilter
+	// Subscription filters, keyed by filter key.
+	filters map[string]*UserFilter
 
 	// Input
 	input chan interface{}
+
+	// The connections the subscription writes to
+	conns *fanoutConnection
+
+	// Closed to stop the running subscription, which closes 'stopped' once
+	// it has stopped. Both are nil while the subscription is not running.
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// A lock synchronising the starting and stopping of the subscription
+	lock sync.Mutex
 }
 
 func MakeSubscription(ctx Context) *Subscription {
+	local := &UserFilter{Type: "local", Value: ""}
 	s := Subscription{
 		ctx: ctx,
 		cell: nil,
-		filter: &UserFilter{Type: "local", Value: ""},
+		filters: map[string]*UserFilter{filterKey(local): local},
 		input: make(chan interface{}),
+		conns: &fanoutConnection{conns: map[Connection]bool{}},
 	}
 	return &s
 }
 
 //
-// Start this subscription operating on the given connection.
+// Start writing this subscription to the given connection, until Stop is
+// called with it. The subscription runs while any connection of the entity
+// is attached, and a connection attached to a running subscription is sent
+// the snapshots of its current filters.
 //
 func (self *Subscription) Start(conn Connection) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.conns.lock.Lock()
+	self.conns.entity = conn.GetEntity()
+	self.conns.conns[conn] = true
+	self.conns.lock.Unlock()
+
+	if self.stop == nil {
+		self.stop = make(chan struct{})
+		self.stopped = make(chan struct{})
+		go self.run(self.conns, self.stop, self.stopped)
+		return
+	}
+	go func(stop chan struct{}) {
+		select {
+		case self.input <- &attachRequest{conn}:
+		case <-stop:
+		}
+	}(self.stop)
+}
+
+//
+// Stop writing this subscription to the connection 'conn'. Once no
+// connection remains attached, stop the subscription and return when it
+// has stopped.
+//
+func (self *Subscription) Stop(conn Connection) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.conns.lock.Lock()
+	attached := self.conns.conns[conn]
+	delete(self.conns.conns, conn)
+	remaining := len(self.conns.conns)
+	self.conns.lock.Unlock()
+
+	if !attached || remaining > 0 || self.stop == nil {
+		return
+	}
+	close(self.stop)
+	<-self.stopped
+	self.stop, self.stopped = nil, nil
+}
+
+//
+// Run this subscription on the given connection until 'stop' is closed,
+// then close 'stopped'.
+//
+func (self *Subscription) run(conn Connection, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	// Always receive the messages sent directly to the entity
+	self.addFilter(conn, &UserFilter{Type: "inbox"})
+
+	// Resume the local filter of an entity that has already beaconed
+	if f, local := self.filters["local:"]; local && self.cell != nil {
+		self.ctx.SubscribeToCell(conn, self.cell)
+		self.sendSnapshot(conn, f)
+	}
+
+	members := time.NewTicker(groupMemberPeriod)
+	defer members.Stop()
+
+loop:
 	for {
 		//log.Print("Objected received 1")
 		var obj interface{}
 		select {
+		case <-stop:
+			break loop
+		case <-members.C:
+			self.checkGroups(conn)
 		case obj = <- self.input:
 			switch obj.(type) {
 			case *Cell:
 				cell, ok := obj.(*Cell)	// type assertion
 				if ok {
+					first := self.cell == nil
 					self.cell = cell	// remember for next time
-					if self.filter.Type == "local" {
+					if f, local := self.filters["local:"]; local {
 						// An update to the cell
 						self.ctx.SubscribeToCell(conn, cell)
+						if first {
+							self.sendSnapshot(conn, f)
+						}
 					}
 				}
-			case *UserFilter:
-				uf, ok := obj.(*UserFilter)	// type assertion
+			case *filterRequest:
+				req, ok := obj.(*filterRequest)	// type assertion
 				if ok {
-					if uf.Type != self.filter.Type || uf.Value != self.filter.Value {
-						// Filter has changed
-						if uf.Type == "group" {
-							// Subscribe to group
-							self.ctx.SubscribeToGroup(conn, uf.Value)
-						} else if uf.Type == "local" && self.cell != nil {
-							// Subscribe to cell
-							self.ctx.SubscribeToCell(conn, self.cell)
-						}
-					}
-					self.filter = uf
+					req.result <- self.applyFilter(conn, req.filter)
 				}
-			case string:
-				s, ok := obj.(string) 	// type assertion
-				if ok && s == "stop" {
-					break
+			case *attachRequest:
+				req, ok := obj.(*attachRequest)	// type assertion
+				if ok {
+					for _, f := range self.filters {
+						self.sendSnapshot(req.conn, f)
+					}
 				}
 			}
 		}
 	}
 
-	// Subscription finished, so unsubscribe the connection
+	// Subscription finished, so unsubscribe the connection. A later
+	// connection of the entity starts again from the local filter.
 	self.ctx.Unsubscribe(conn)
+	local := &UserFilter{Type: "local", Value: ""}
+	self.filters = map[string]*UserFilter{filterKey(local): local}
 }
 
-func (self *Subscription) Stop() {
-	select {
-	case self.input <- "stop":
+//
+// Remove the group filters of the connection 'conn' for the groups of which
+// its entity is no longer a member, so it no longer receives their messages
+//
+func (self *Subscription) checkGroups(conn Connection) {
+	for _, f := range self.filters {
+		if f.Type != "group" {
+			continue
+		}
+		if self.ctx.CheckGroupMember(conn.GetEntity(), f.Value) == errNotGroupMember {
+			log.Printf("Subscription: removed group filter %s of a former member", f.Value)
+			self.removeFilter(conn, f)
+		}
+	}
+}
+
+//
+// Add, remove or replace the filters of the connection 'conn' with the
+// filter 'uf', according to its action. Return the reason the filter could
+// not be applied, if any, in which case the filters are unchanged.
+//
+func (self *Subscription) applyFilter(conn Connection, uf *UserFilter) error {
+	switch uf.Action {
+	case "add":
+		return self.addFilter(conn, uf)
+	case "remove":
+		self.removeFilter(conn, uf)
+		return nil
+	default:
+		// Replace all current filters with the given filter
+		err := self.addFilter(conn, uf)
+		if err != nil {
+			return err
+		}
+		for key, f := range self.filters {
+			if key != filterKey(uf) && f.Type != "inbox" {
+				self.removeFilter(conn, f)
+			}
+		}
+		return nil
+	}
+}
+
+//
+// Subscribe the connection 'conn' to the filter 'uf' in addition to the
+// current filters. Return the reason the filter could not be subscribed,
+// such as being invalid or not permitted, if any.
+//
+func (self *Subscription) addFilter(conn Connection, uf *UserFilter) error {
+
+	key := filterKey(uf)
+	if _, ok := self.filters[key]; ok {
+		return nil
+	}
+
+	var err error
+	switch uf.Type {
+	case "local":
+		if self.cell != nil {
+			// Subscribe to cell
+			err = self.ctx.SubscribeToCell(conn, self.cell)
+		}
+	case "group":
+		// Subscribe to group
+		err = self.ctx.SubscribeToGroup(conn, uf.Value)
+	case "region":
+		// Subscribe to the cells covering the region
+		region, rerr := self.ctx.GetTopology().MakeRegion(uf.Value)
+		if rerr != nil {
+			return &filterError{"invalid_filter", "Invalid region filter: " + rerr.Error()}
+		}
+		// Only the data of the clients visible to the entity is written
+		entity := conn.GetEntity()
+		region.visible = makeClientVisibility(func(clientIds []string) map[string]bool {
+			return self.ctx.VisibleClients(entity, clientIds)
+		})
+		err = self.ctx.SubscribeToRegion(conn, region)
+	case "entity":
+		// Subscribe to a single client, if permitted
+		clientUUID, uerr := uuid.Parse(uf.Value)
+		if uerr != nil {
+			return &filterError{"invalid_filter", "Invalid entity filter: " + uerr.Error()}
+		}
+		if !self.ctx.CanFollow(conn.GetEntity(), ClientID(clientUUID)) {
+			return &filterError{"not_permitted", "Not permitted to follow client " + uf.Value}
+		}
+		err = self.ctx.SubscribeToEntity(conn, ClientID(clientUUID))
+	case "density":
+		// Subscribe to the periodic density updates
+		err = self.ctx.GetTopology().SubscribeToDensity(conn)
+	case "inbox":
+		// Subscribe to the messages sent directly to the entity
+		err = self.ctx.GetTopology().SubscribeToInbox(conn)
 	default:
+		return &filterError{"invalid_filter", "Unknown filter type: " + uf.Type}
+	}
+
+	if err == errNotGroupMember {
+		return &filterError{"not_permitted", err.Error()}
+	}
+	if err != nil {
+		log.Printf("Subscription: failed to add %s filter: %v", uf.Type, err)
+		return &filterError{"filter_failed", "Failed to add " + uf.Type + " filter: " + err.Error()}
 	}
+	self.filters[key] = &UserFilter{Type: uf.Type, Value: uf.Value}
+	self.sendSnapshot(conn, self.filters[key])
+	return nil
+}
+
+//
+// Write the last known positions of the entities matching the filter 'uf'
+// to the connection 'conn', so it need not wait for the next beacons.
+//
+func (self *Subscription) sendSnapshot(conn Connection, uf *UserFilter) {
+
+	var positions []UserData
+	var err error
+	t := self.ctx.GetTopology()
+	switch uf.Type {
+	case "local":
+		if self.cell == nil {
+			return
+		}
+		positions, err = t.GetCellGroupPositions(self.cell.cellGroup)
+	case "region":
+		region, rerr := t.MakeRegion(uf.Value)
+		if rerr != nil {
+			return
+		}
+		positions, err = t.GetRegionPositions(region)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("Subscription: failed to get snapshot: %v", err)
+		return
+	}
+
+	// A region may cover any client, so only those visible to the entity
+	// are written
+	var visible map[string]bool
+	if uf.Type == "region" {
+		clientIds := make([]string, 0, len(positions))
+		for i := range positions {
+			clientIds = append(clientIds, positions[i].ClientId)
+		}
+		visible = self.ctx.VisibleClients(conn.GetEntity(), clientIds)
+	}
+
+	clientIdStr := uuid.UUID(conn.GetEntity().clientId).String()
+	for i := range positions {
+		if positions[i].ClientId == clientIdStr {
+			continue
+		}
+		if visible != nil && !visible[positions[i].ClientId] {
+			continue
+		}
+		message, merr := json.Marshal(&positions[i])
+		if merr == nil {
+			conn.Write(&Event{Type: EventLocation, Source: []UserFilter{*uf}, Payload: message})
+		}
+	}
+}
+
+//
+// Unsubscribe the connection 'conn' from the filter 'uf' only.
+//
+func (self *Subscription) removeFilter(conn Connection, uf *UserFilter) {
+
+	key := filterKey(uf)
+	f, ok := self.filters[key]
+	if !ok {
+		return
+	}
+
+	err := self.ctx.UnsubscribeFromFilter(conn, f)
+	if err != nil {
+		log.Printf("Subscription: failed to remove %s filter: %v", uf.Type, err)
+	}
+	delete(self.filters, key)
 }
 
 func (self *Subscription) setCellFilter(cell *Cell) {
@@ -93,14 +420,104 @@ func (self *Subscription) setCellFilter(cell *Cell) {
 	}
 }
 
-func (self *Subscription) setUserFilter(filter *UserFilter) {
+//
+// Apply the filter 'filter' to the running subscription and return the
+// outcome, once the subscription has applied it
+//
+func (self *Subscription) setUserFilter(filter *UserFilter) error {
+
+	req := &filterRequest{filter: filter, result: make(chan error, 1)}
+	timeout := time.NewTimer(filterTimeout)
+	defer timeout.Stop()
+
 	select {
-	case self.input <- filter:
-	default:
+	case self.input <- req:
+	case <-timeout.C:
+		return &filterError{"not_connected", "No connection is receiving data"}
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-timeout.C:
+		return &filterError{"filter_failed", "Timed out applying the filter"}
+	}
+}
+
+
+
+//
+// Return the key identifying the filter 'uf' within a Subscription
+//
+func filterKey(uf *UserFilter) string {
+	return uf.Type + ":" + uf.Value
+}
+
+//
+// Return the message 'message' tagged with the filters that matched it.
+// The filters are added as a member of the JSON message object.
+//
+func tagMessage(message []byte, filters []UserFilter) []byte {
+
+	message = bytes.TrimSpace(message)
+	if len(message) < 2 || message[0] != '{' {
+		return message
+	}
+
+	tag, err := json.Marshal(filters)
+	if err != nil {
+		return message
 	}
+
+	buf := make([]byte, 0, len(message)+len(tag)+12)
+	buf = append(buf, `{"filters":`...)
+	buf = append(buf, tag...)
+	rest := bytes.TrimSpace(message[1:])
+	if rest[0] != '}' {
+		buf = append(buf, ',')
+	}
+	return append(buf, rest...)
+}
+
+//
+// Return true if the entity of the connection 'conn' blocked the sender of
+// the message 'data', whose decoded forms are 'shared'
+//
+func blocksSender(conn Connection, shared *eventPayload, data []byte) bool {
+	entity := conn.GetEntity()
+	return entity != nil && len(entity.blocked) > 0 && entity.blocks(shared.senderOf(data))
+}
+
+//
+// Return true if the location 'loc' matches all of the filters 'filters'
+// for the connection 'conn'
+//
+func matchesLocation(filters []locationFilter, conn Connection, loc *Location) bool {
+	for _, f := range filters {
+		if !f.matches(conn, loc) {
+			return false
+		}
+	}
+	return true
 }
 
+//
+// The channels subscribed to by a connection for a single filter
+//
+type filterChannels struct {
+
+	// The filter the channels are subscribed for
+	filter UserFilter
+
+	// The location filters the data must match
+	locations []locationFilter
 
+	// The set of subscribed channels
+	channels map[string]bool
+
+	// The clients last seen inside the region of a region filter, for
+	// writing geofence events as they enter and leave it
+	inside map[string]bool
+}
 
 //
 // Subscriber
@@ -110,8 +527,8 @@ type Subscriber struct {
 	// The Redis URL to publish to
 	redisUrl string
 
-	// Map of connections and the channels they are sunscribed to
-	connections map[Connection]map[string]bool
+	// Map of connections and the channels subscribed to for each filter
+	connections map[Connection]map[string]*filterChannels
 
 	// Map of channels and the connections subscribed to
 	channels map[string]map[Connection]bool
@@ -119,6 +536,10 @@ type Subscriber struct {
 	// A connection to the Redis database to received data from subscribed channels
 	subconn redis.PubSubConn
 
+	// The data recently written to each connection, which may be shared
+	// with other subscribers
+	recent *recentData
+
 	// A Read/Write mutex for synchronising data between threads
 	lock sync.RWMutex
 }
@@ -129,8 +550,9 @@ type Subscriber struct {
 func MakeSubscriber(redisUrl string) Subscriber {
 	s := Subscriber{
 		redisUrl: redisUrl,
-		connections: make(map[Connection]map[string]bool),
-		channels:    make(map[string]map[Connection]bool)}
+		connections: make(map[Connection]map[string]*filterChannels),
+		channels:    make(map[string]map[Connection]bool),
+		recent:      makeRecentData()}
 	return s
 }
 
@@ -157,8 +579,53 @@ func (self *Subscriber) Run() error {
 			switch v := self.subconn.Receive().(type) {
 			case redis.Message:
 				self.lock.RLock()
+				var userData *UserData
+				shared := new(eventPayload)
+				hash, now := hashData(v.Data), time.Now()
+				message := isMessage(v.Data)
+				unlocated := message || isSOS(v.Data)
+				presence := isPresence(v.Data)
 				for conn := range self.channels[v.Channel] {
-					conn.Write(v.Data)
+					if message && blocksSender(conn, shared, v.Data) {
+						continue
+					}
+					matched := make([]UserFilter, 0, 1)
+					var geofences []*Event
+					for _, fc := range self.connections[conn] {
+						if !fc.channels[v.Channel] {
+							continue
+						}
+						if len(fc.locations) > 0 && !unlocated {
+							// Only match the data whose location matches the filter.
+							// Messages have no location and SOS alerts must reach
+							// every recipient, so both match every filter.
+							if userData == nil {
+								var err error
+								if userData, err = shared.user(v.Data); err != nil {
+									log.Printf("Subscriber: failed to decode data on channel %s", v.Channel)
+								}
+							}
+							if !admitsClient(fc.locations, userData.ClientId, now) {
+								continue
+							}
+							inside := matchesLocation(fc.locations, conn, &userData.Location)
+							if fc.filter.Type == "region" && !presence {
+								if e := fc.crossed(userData, inside); e != nil {
+									geofences = append(geofences, e)
+								}
+							}
+							if !inside {
+								continue
+							}
+						}
+						matched = append(matched, fc.filter)
+					}
+					if len(matched) > 0 && self.recent.first(conn, hash, now) {
+						conn.Write(&Event{Type: eventTypeOf(matched, v.Data), Source: matched, Payload: v.Data, shared: shared})
+					}
+					for _, e := range geofences {
+						conn.Write(e)
+					}
 				}
 				self.lock.RUnlock()
 			case error:
@@ -171,45 +638,102 @@ func (self *Subscriber) Run() error {
 }
 
 //
-// Subscribe the Connection 'conn' to the cell 'cell' within this Topology.
+// Subscribe the Connection 'conn' to the cell 'cell' within this Topology
+// for the "local" filter. Return an error on failure or nil otherwise.
+// Only the cells added to or removed from the cell group previously
+// subscribed to for the "local" filter are subscribed or unsubscribed.
+// Only data matching all of the location filters 'locations' is written.
+//
+func (self *Subscriber) SubscribeToCell(conn Connection, cell *Cell, locations ...locationFilter) error {
+
+	channels := make([]string, 0, len(cell.cellGroup))
+	for _, cellId := range cell.cellGroup {
+		channels = append(channels, strconv.FormatUint(uint64(cellId), 10))
+	}
+	return self.SubscribeFilter(conn, UserFilter{Type: "local"}, channels, locations...)
+}
+
+//
+// Subscribe the Connection 'conn' to the channels 'channels' for the filter
+// 'filter'. Channels previously subscribed to for the same filter but not in
+// 'channels' are unsubscribed. Only data matching all of the location
+// filters 'locations' is matched by the filter.
 // Return an error on failure or nil otherwise.
-// This will call Unsubscribe for previous subscribed cells.
 //
-func (self *Subscriber) SubscribeToCell(conn Connection, cell *Cell) error {
+func (self *Subscriber) SubscribeFilter(conn Connection, filter UserFilter, channels []string, locations ...locationFilter) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	// Unsubscribe from old cells
-	err := self.unsubscribeNoLock(conn)
-	if err != nil {
-		return err
+	filter.Action = ""
+	key := filterKey(&filter)
+
+	_, ok := self.connections[conn]
+	if !ok {
+		self.connections[conn] = map[string]*filterChannels{}
+	}
+	fc, ok := self.connections[conn][key]
+	if !ok {
+		fc = &filterChannels{filter: filter, channels: map[string]bool{}}
+		self.connections[conn][key] = fc
 	}
+	fc.locations = locations
 
-	// Subscribe to the new cell group
-	for _, cellId := range cell.cellGroup {
-		cellIdStr := strconv.FormatUint(uint64(cellId), 10)
-		err = self.subscribeNoLock(conn, cellIdStr)
-		if err != nil {
-			return err
+	next := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		next[channel] = true
+	}
+
+	// Unsubscribe from channels no longer required by the filter
+	for channel := range fc.channels {
+		if !next[channel] {
+			delete(fc.channels, channel)
+			err := self.releaseNoLock(conn, channel)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Subscribe to the channels newly required by the filter
+	for channel := range next {
+		if !fc.channels[channel] {
+			fc.channels[channel] = true
+			err := self.subscribeNoLock(conn, channel)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
 //
-// Subscribe the Connection 'conn' to the channel 'channel' within this Topology.
-// Return an error on failure or nil otherwise.
+// Unsubscribe the Connection 'conn' from the channels of the filter 'filter'.
+// Channels still required by other filters of the connection remain subscribed.
 //
-func (self *Subscriber) Subscribe(conn Connection, channel string, unsubscribe bool) error {
+func (self *Subscriber) UnsubscribeFilter(conn Connection, filter UserFilter) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	if unsubscribe {
-		// Unsubscribe from all other channels
-		_ = self.unsubscribeNoLock(conn)
+	filter.Action = ""
+	key := filterKey(&filter)
+
+	fc, ok := self.connections[conn][key]
+	if !ok {
+		return nil
+	}
+	delete(self.connections[conn], key)
+	if len(self.connections[conn]) == 0 {
+		delete(self.connections, conn)
 	}
 
-	return self.subscribeNoLock(conn, channel)
+	for channel := range fc.channels {
+		err := self.releaseNoLock(conn, channel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //
@@ -217,13 +741,7 @@ func (self *Subscriber) Subscribe(conn Connection, channel string, unsubscribe b
 //
 func (self *Subscriber) subscribeNoLock(conn Connection, channel string) error {
 
-	_, ok := self.connections[conn]
-	if !ok {
-		self.connections[conn] = map[string]bool{}
-	}
-	self.connections[conn][channel] = true
-
-	_, ok = self.channels[channel]
+	_, ok := self.channels[channel]
 	if !ok {
 		self.channels[channel] = map[Connection]bool{}
 		err := self.subconn.Subscribe(channel)
@@ -236,6 +754,32 @@ func (self *Subscriber) subscribeNoLock(conn Connection, channel string) error {
 	return nil
 }
 
+//
+// Remove the Connection 'conn' from the channel 'channel' unless one of the
+// connection's filters still requires it.
+//
+func (self *Subscriber) releaseNoLock(conn Connection, channel string) error {
+
+	if !self.channels[channel][conn] {
+		return nil
+	}
+	for _, fc := range self.connections[conn] {
+		if fc.channels[channel] {
+			return nil
+		}
+	}
+
+	delete(self.channels[channel], conn)
+	if len(self.channels[channel]) == 0 {
+		delete(self.channels, channel)
+		err := self.subconn.Unsubscribe(channel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //
 //
 //
@@ -243,6 +787,7 @@ func (self *Subscriber) Unsubscribe(conn Connection) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
+	self.recent.remove(conn)
 	return self.unsubscribeNoLock(conn)
 }
 
@@ -251,16 +796,83 @@ func (self *Subscriber) Unsubscribe(conn Connection) error {
 //
 func (self *Subscriber) unsubscribeNoLock(conn Connection) error {
 
-	for c := range self.connections[conn] {
-		delete(self.channels[c], conn)
-		if len(self.channels[c]) == 0 {
-			delete(self.channels, c)
-			err := self.subconn.Unsubscribe(c)
+	filters := self.connections[conn]
+	delete(self.connections, conn)
+
+	for _, fc := range filters {
+		for channel := range fc.channels {
+			err := self.releaseNoLock(conn, channel)
 			if err != nil {
 				return err
 			}
 		}
 	}
-	delete(self.connections, conn)
 	return nil
 }
+
+// The time within which data published to several channels is written to a
+// connection only once
+const recentDataWindow = 2 * time.Second
+
+// The number of recent data kept per connection before pruning
+const recentDataPrune = 64
+
+//
+// recentData remembers the data recently written to each connection. A
+// beacon is published to the channels of its cells, groups and client, so a
+// connection with several filters would otherwise receive it several times.
+//
+type recentData struct {
+	seen map[Connection]map[uint64]time.Time
+	lock sync.Mutex
+}
+
+func makeRecentData() *recentData {
+	return &recentData{seen: make(map[Connection]map[uint64]time.Time)}
+}
+
+//
+// Return a hash identifying the published data 'data'
+//
+func hashData(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+//
+// Return true if the data with hash 'hash' has not been written to the
+// connection 'conn' within the recent window, and remember it as written.
+//
+func (r *recentData) first(conn Connection, hash uint64, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	seen, ok := r.seen[conn]
+	if !ok {
+		seen = make(map[uint64]time.Time)
+		r.seen[conn] = seen
+	}
+	if t, ok := seen[hash]; ok && now.Sub(t) < recentDataWindow {
+		return false
+	}
+
+	if len(seen) >= recentDataPrune {
+		for h, t := range seen {
+			if now.Sub(t) >= recentDataWindow {
+				delete(seen, h)
+			}
+		}
+	}
+	seen[hash] = now
+	return true
+}
+
+//
+// Forget the data written to the connection 'conn'
+//
+func (r *recentData) remove(conn Connection) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.seen, conn)
+}
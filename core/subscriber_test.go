@@ -0,0 +1,193 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testConnection records the events written to it
+type testConnection struct {
+	entity *Entity
+	events []*Event
+}
+
+func (c *testConnection) GetEntity() *Entity { return c.entity }
+func (c *testConnection) ReadPump()          {}
+func (c *testConnection) WritePump()         {}
+func (c *testConnection) Write(event *Event) { c.events = append(c.events, event) }
+
+func TestFollowConsent(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	topology := MakeTopology(c)
+	ctx := MakeDataStoreContext(&topology, MakeDataStore())
+	follower := MakeEntity(&ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	conn := &testConnection{entity: follower}
+	victim := ClientID(uuid.New())
+
+	// Following another client requires its consent
+	if ctx.CanFollow(follower, victim) {
+		t.Errorf("CanFollow: permitted without consent")
+	}
+
+	// A group filter cannot be used to read the feed of another client
+	value := entityChannel(victim)
+	if groupChannel(value) == entityChannel(victim) {
+		t.Errorf("groupChannel: group %s shares the channel of client feed", value)
+	}
+	if err := ctx.SubscribeToGroup(conn, value); err == nil {
+		t.Errorf("SubscribeToGroup: subscribed to group %s without membership", value)
+	}
+	if len(topology.groupSubscriber.connections) != 0 || len(topology.entitySubscriber.connections) != 0 {
+		t.Errorf("SubscribeToGroup: connection subscribed to a channel")
+	}
+}
+
+// filterContext records the filters subscribed to through it
+type filterContext struct {
+	Context
+	topology   *Topology
+	subscribed map[string]bool
+}
+
+func (ctx *filterContext) GetTopology() *Topology {
+	return ctx.topology
+}
+
+func (ctx *filterContext) SubscribeToGroup(conn Connection, groupId string) error {
+	ctx.subscribed["group:"+groupId] = true
+	return nil
+}
+
+func (ctx *filterContext) CanFollow(entity *Entity, clientId ClientID) bool {
+	return true
+}
+
+func (ctx *filterContext) SubscribeToEntity(conn Connection, clientId ClientID) error {
+	ctx.subscribed["entity:"+uuid.UUID(clientId).String()] = true
+	return nil
+}
+
+func (ctx *filterContext) UnsubscribeFromFilter(conn Connection, filter *UserFilter) error {
+	delete(ctx.subscribed, filterKey(filter))
+	return nil
+}
+
+func (ctx *filterContext) Unsubscribe(conn Connection) error {
+	ctx.subscribed = map[string]bool{}
+	return nil
+}
+
+func TestSubscriptionFilters(t *testing.T) {
+
+	topology := MakeTopology(MakeConfig(250, 15))
+	ctx := &filterContext{topology: &topology, subscribed: map[string]bool{}}
+	s := MakeSubscription(ctx)
+	conn := &testConnection{entity: MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)}
+	friend := uuid.New().String()
+
+	// Filters are added alongside the default local filter
+	s.applyFilter(conn, &UserFilter{Type: "group", Value: "club", Action: "add"})
+	s.applyFilter(conn, &UserFilter{Type: "entity", Value: friend, Action: "add"})
+	if len(s.filters) != 3 || !ctx.subscribed["group:club"] || !ctx.subscribed["entity:"+friend] {
+		t.Errorf("applyFilter: expected local, group and entity filters, got %v", s.filters)
+	}
+
+	// A single filter can be removed
+	s.applyFilter(conn, &UserFilter{Type: "group", Value: "club", Action: "remove"})
+	if _, ok := s.filters["group:club"]; ok || ctx.subscribed["group:club"] {
+		t.Errorf("applyFilter: group filter not removed")
+	}
+
+	// A filter without an action replaces all others, other than the inbox
+	s.filters["inbox:"] = &UserFilter{Type: "inbox"}
+	s.applyFilter(conn, &UserFilter{Type: "group", Value: "race"})
+	if len(s.filters) != 2 || s.filters["group:race"] == nil || s.filters["inbox:"] == nil {
+		t.Errorf("applyFilter: expected the group and inbox filters, got %v", s.filters)
+	}
+	if ctx.subscribed["entity:"+friend] {
+		t.Errorf("applyFilter: replaced entity filter still subscribed")
+	}
+}
+
+func TestSubscriptionConnections(t *testing.T) {
+
+	topology := MakeTopology(MakeConfig(250, 15))
+	ctx := &filterContext{topology: &topology, subscribed: map[string]bool{}}
+	entity := MakeEntity(ctx, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	s := entity.subscription
+	s.filters["inbox:"] = &UserFilter{Type: "inbox"}
+	a, b := &testConnection{entity: entity}, &testConnection{entity: entity}
+
+	// The connections of an entity share the one running subscription
+	s.Start(a)
+	s.Start(b)
+	if err := s.setUserFilter(&UserFilter{Type: "group", Value: "club", Action: "add"}); err != nil {
+		t.Fatalf("setUserFilter: %v", err)
+	}
+	s.conns.Write(&Event{Type: EventLocation})
+	if len(a.events) != 1 || len(b.events) != 1 {
+		t.Errorf("Write: expected an event on each connection, got %d and %d", len(a.events), len(b.events))
+	}
+
+	// Stopping one connection leaves the subscription running for the other
+	s.Stop(a)
+	s.Stop(a)
+	if err := s.setUserFilter(&UserFilter{Type: "group", Value: "race", Action: "add"}); err != nil {
+		t.Fatalf("setUserFilter: %v", err)
+	}
+	if !ctx.subscribed["group:club"] || !ctx.subscribed["group:race"] {
+		t.Errorf("Stop: filters of the remaining connection lost, got %v", ctx.subscribed)
+	}
+	s.conns.Write(&Event{Type: EventLocation})
+	if len(a.events) != 1 || len(b.events) != 2 {
+		t.Errorf("Write: expected an event on the remaining connection only, got %d and %d", len(a.events), len(b.events))
+	}
+
+	// Stopping the last connection stops the subscription before returning
+	s.Stop(b)
+	if s.stop != nil || len(ctx.subscribed) != 0 || len(s.filters) != 1 || s.filters["local:"] == nil {
+		t.Errorf("Stop: expected a stopped subscription with the local filter, got %v", s.filters)
+	}
+}
+
+func TestTagMessage(t *testing.T) {
+
+	filters := []UserFilter{{Type: "group", Value: "club"}, {Type: "local"}}
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{`{"clientid":"a"}`, `{"filters":[{"filtertype":"group","filtervalue":"club"},{"filtertype":"local","filtervalue":""}],"clientid":"a"}`},
+		{` {} `, `{"filters":[{"filtertype":"group","filtervalue":"club"},{"filtertype":"local","filtervalue":""}]}`},
+		{`[1,2]`, `[1,2]`},
+	}
+	for _, test := range tests {
+		if tagged := string(tagMessage([]byte(test.message), filters)); tagged != test.expected {
+			t.Errorf("tagMessage(%s): expected %s, got %s", test.message, test.expected, tagged)
+		}
+	}
+}
+
+func TestRecentData(t *testing.T) {
+
+	r := makeRecentData()
+	a, b := &testConnection{}, &testConnection{}
+	now := time.Unix(1000, 0)
+	beacon := hashData([]byte(`{"clientid":"a"}`))
+
+	// Data received on a second channel is written once per connection
+	if !r.first(a, beacon, now) || r.first(a, beacon, now) {
+		t.Errorf("first: duplicate data written twice")
+	}
+	if !r.first(b, beacon, now) {
+		t.Errorf("first: data not written to another connection")
+	}
+
+	// The same data is written again once the window has passed
+	if !r.first(a, beacon, now.Add(recentDataWindow)) {
+		t.Errorf("first: data not written after the window")
+	}
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/geo/r1"
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+)
+
+const (
+	// The width and height of a rendered tile in pixels
+	tileSize = 256
+
+	// The number of grid cells along each side of a GeoJSON tile
+	tileGridSize = 32
+
+	// The radius in pixels of the kernel used to render each point
+	tileKernelRadius = 4
+
+	// The density of a pixel drawn in the hottest colour at the highest
+	// public zoom. It doubles for each zoom level out, as the points of
+	// entities moving along roads merge.
+	tileFullDensity = 64
+
+	// The maximum number of tiles held by a tile cache
+	tileCacheSize = 1024
+
+	// The time a tile is held by a tile cache
+	tileCacheTTL = 5 * time.Minute
+
+	// The highest zoom of the tiles of all entities. Tiles restricted to a
+	// group of the requesting entity may zoom further.
+	maxPublicTileZoom = 14
+)
+
+// Tile is the address of an XYZ (slippy map) tile
+type Tile struct {
+	Z, X, Y int
+}
+
+// Return true if the tile address is within the range of its zoom level
+func (t Tile) IsValid() bool {
+	n := 1 << uint(t.Z)
+	return t.Z >= 0 && t.Z <= 22 && t.X >= 0 && t.X < n && t.Y >= 0 && t.Y < n
+}
+
+// Return the longitude of the pixel column 'px' within a zoom level of 'n' tiles
+func tileLng(px float64, n float64) float64 {
+	return px/(n*tileSize)*360 - 180
+}
+
+// Return the latitude of the pixel row 'py' within a zoom level of 'n' tiles
+func tileLat(py float64, n float64) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*py/(n*tileSize)))) * 180 / math.Pi
+}
+
+// Return the rect bounding the pixels 'x0' to 'x1' and 'y0' to 'y1' within
+// a zoom level of 'n' tiles, clamped to the extent of the map so it never
+// wraps across the antimeridian
+func pixelBound(x0, y0, x1, y1 float64, n float64) s2.Rect {
+	extent := n * tileSize
+	x0, x1 = math.Max(x0, 0), math.Min(x1, extent)
+	y0, y1 = math.Max(y0, 0), math.Min(y1, extent)
+	return s2.Rect{
+		Lat: r1.Interval{Lo: tileLat(y1, n) * math.Pi / 180, Hi: tileLat(y0, n) * math.Pi / 180},
+		Lng: s1.IntervalFromEndpoints(tileLng(x0, n)*math.Pi/180, tileLng(x1, n)*math.Pi/180),
+	}
+}
+
+// Return the bounding rect of this tile
+func (t Tile) Bound() s2.Rect {
+	n := float64(int(1) << uint(t.Z))
+	x0, y0 := float64(t.X)*tileSize, float64(t.Y)*tileSize
+	return pixelBound(x0, y0, x0+tileSize, y0+tileSize, n)
+}
+
+// Return the bound of locations to query to render this tile, which includes
+// a margin for the points just outside the tile that contribute to its edges.
+// The margin stops at the edges of the map.
+func (t Tile) QueryBound() s2.Rect {
+	n := float64(int(1) << uint(t.Z))
+	x0, y0 := float64(t.X)*tileSize, float64(t.Y)*tileSize
+	return pixelBound(x0-tileKernelRadius, y0-tileKernelRadius,
+		x0+tileSize+tileKernelRadius, y0+tileSize+tileKernelRadius, n)
+}
+
+// Return the ranges of longitude in degrees covered by the interval 'lng'.
+// An interval crossing the antimeridian is split in two, as is one starting
+// at -180 degrees, which s1 represents as starting at 180 degrees.
+func lngRanges(lng s1.Interval) [][2]float64 {
+	lo, hi := lng.Lo*180/math.Pi, lng.Hi*180/math.Pi
+	if lng.IsFull() {
+		return [][2]float64{{-180, 180}}
+	}
+	if !lng.IsInverted() {
+		return [][2]float64{{lo, hi}}
+	}
+	if lo == 180 {
+		return [][2]float64{{-180, hi}}
+	}
+	return [][2]float64{{lo, 180}, {-180, hi}}
+}
+
+// Return the end of the time range of a tile request made at the time 'now'
+// without an explicit end. It is rounded up to the lifetime of a cached
+// tile, so that repeated requests share a cached tile.
+func tileRangeEnd(now time.Time) time.Time {
+	return now.Truncate(tileCacheTTL).Add(tileCacheTTL)
+}
+
+// Return the pixel coordinates of the location 'loc' within this tile
+func (t Tile) pixel(loc *Location) (float64, float64) {
+	n := float64(int(1) << uint(t.Z))
+	lat := loc.Lat * math.Pi / 180
+	x := (loc.Lng + 180) / 360 * n * tileSize
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n * tileSize
+	return x - float64(t.X)*tileSize, y - float64(t.Y)*tileSize
+}
+
+// Return the density of a pixel drawn in the hottest colour at the zoom
+// 'z'. The scale is the same for every tile of a zoom, so that neighbouring
+// tiles join without seams.
+func tileScale(z int) float64 {
+	levels := maxPublicTileZoom - z
+	if levels < 0 {
+		levels = 0
+	}
+	return tileFullDensity * math.Exp2(float64(levels))
+}
+
+// RenderTilePNG renders the density of the locations 'locations' within the
+// tile 't' as a transparent heatmap PNG image.
+func RenderTilePNG(t Tile, locations []Location) ([]byte, error) {
+
+	// Accumulate the kernel of each point into a density grid. Points just
+	// outside the tile still contribute to the pixels along its edges.
+	grid := make([]float64, tileSize*tileSize)
+	for i := range locations {
+		px, py := t.pixel(&locations[i])
+		cx, cy := int(math.Floor(px)), int(math.Floor(py))
+		for y := cy - tileKernelRadius; y <= cy+tileKernelRadius; y++ {
+			for x := cx - tileKernelRadius; x <= cx+tileKernelRadius; x++ {
+				if x < 0 || y < 0 || x >= tileSize || y >= tileSize {
+					continue
+				}
+				d2 := float64((x-cx)*(x-cx) + (y-cy)*(y-cy))
+				w := 1 - d2/float64(tileKernelRadius*tileKernelRadius)
+				if w <= 0 {
+					continue
+				}
+				grid[y*tileSize+x] += w
+			}
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	scale := math.Log1p(tileScale(t.Z))
+	for i, v := range grid {
+		if v > 0 {
+			img.SetNRGBA(i%tileSize, i/tileSize, heatColor(math.Log1p(v)/scale))
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, img)
+	return buf.Bytes(), err
+}
+
+// Return the heatmap colour for the normalised density 'v' (0 to 1),
+// ranging from a transparent blue through green and yellow to an opaque red.
+func heatColor(v float64) color.NRGBA {
+	v = math.Max(0, math.Min(1, v))
+	var r, g, b float64
+	switch {
+	case v < 0.33:
+		f := v / 0.33
+		r, g, b = 0, f, 1-f
+	case v < 0.66:
+		f := (v - 0.33) / 0.33
+		r, g, b = f, 1, 0
+	default:
+		f := (v - 0.66) / 0.34
+		r, g, b = 1, 1-f, 0
+	}
+	return color.NRGBA{uint8(r * 255), uint8(g * 255), uint8(b * 255), uint8(64 + v*191)}
+}
+
+// RenderTileGeoJSON renders the density of the locations 'locations' within
+// the tile 't' as a GeoJSON FeatureCollection of grid cell polygons, each
+// with the number of points within it.
+func RenderTileGeoJSON(t Tile, locations []Location) ([]byte, error) {
+
+	const cellPx = tileSize / tileGridSize
+	counts := make([]int, tileGridSize*tileGridSize)
+	for i := range locations {
+		px, py := t.pixel(&locations[i])
+		if px < 0 || py < 0 || px >= tileSize || py >= tileSize {
+			continue
+		}
+		counts[int(py)/cellPx*tileGridSize+int(px)/cellPx]++
+	}
+
+	type geometry struct {
+		Type        string         `json:"type"`
+		Coordinates [][][2]float64 `json:"coordinates"`
+	}
+	type properties struct {
+		Count int `json:"count"`
+	}
+	type feature struct {
+		Type       string     `json:"type"`
+		Geometry   geometry   `json:"geometry"`
+		Properties properties `json:"properties"`
+	}
+	type collection struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}
+
+	n := float64(int(1) << uint(t.Z))
+	fc := collection{Type: "FeatureCollection", Features: make([]feature, 0)}
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		x0 := float64(t.X*tileSize + (i%tileGridSize)*cellPx)
+		y0 := float64(t.Y*tileSize + (i/tileGridSize)*cellPx)
+		west, east := tileLng(x0, n), tileLng(x0+cellPx, n)
+		north, south := tileLat(y0, n), tileLat(y0+cellPx, n)
+		ring := [][2]float64{{west, south}, {east, south}, {east, north}, {west, north}, {west, south}}
+		fc.Features = append(fc.Features, feature{
+			Type:       "Feature",
+			Geometry:   geometry{Type: "Polygon", Coordinates: [][][2]float64{ring}},
+			Properties: properties{Count: count},
+		})
+	}
+	return json.Marshal(&fc)
+}
+
+// tileCache is a bounded LRU cache of rendered tiles. Tiles expire after a
+// fixed time so tiles covering recent data are re-rendered.
+type tileCache struct {
+
+	// The list of cached tiles, most recently used first
+	order *list.List
+
+	// Map of tile keys to their entry within 'order'
+	entries map[string]*list.Element
+
+	// A mutex for synchronising the cache between threads
+	lock sync.Mutex
+}
+
+// An entry within the tile cache
+type tileEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+func makeTileCache() *tileCache {
+	tc := &tileCache{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	return tc
+}
+
+// Return the cached tile with key 'key', if any
+func (tc *tileCache) get(key string) ([]byte, bool) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	elem, ok := tc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*tileEntry)
+	if time.Now().After(entry.expires) {
+		tc.order.Remove(elem)
+		delete(tc.entries, key)
+		return nil, false
+	}
+	tc.order.MoveToFront(elem)
+	return entry.data, true
+}
+
+// Cache the tile 'data' with key 'key'
+func (tc *tileCache) put(key string, data []byte) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if elem, ok := tc.entries[key]; ok {
+		tc.order.Remove(elem)
+	}
+	tc.entries[key] = tc.order.PushFront(&tileEntry{key: key, data: data, expires: time.Now().Add(tileCacheTTL)})
+	if tc.order.Len() > tileCacheSize {
+		oldest := tc.order.Back()
+		tc.order.Remove(oldest)
+		delete(tc.entries, oldest.Value.(*tileEntry).key)
+	}
+}
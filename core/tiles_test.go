@@ -0,0 +1,172 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestTileQueryBound(t *testing.T) {
+
+	tests := []struct {
+		tile   Tile
+		ranges [][2]float64
+	}{
+		// Tiles along the edges of the map do not wrap around the antimeridian
+		{Tile{1, 0, 0}, [][2]float64{{-180, 2.8125}}},
+		{Tile{1, 1, 0}, [][2]float64{{-2.8125, 180}}},
+		{Tile{3, 0, 2}, [][2]float64{{-180, -134.296875}}},
+		{Tile{0, 0, 0}, [][2]float64{{-180, 180}}},
+	}
+	for _, test := range tests {
+		bound := test.tile.QueryBound()
+		ranges := lngRanges(bound.Lng)
+		if len(ranges) != len(test.ranges) {
+			t.Errorf("QueryBound(%v): expected ranges %v, got %v", test.tile, test.ranges, ranges)
+			continue
+		}
+		for i := range ranges {
+			if ranges[i][0] > ranges[i][1] || !closeTo(ranges[i][0], test.ranges[i][0]) || !closeTo(ranges[i][1], test.ranges[i][1]) {
+				t.Errorf("QueryBound(%v): expected ranges %v, got %v", test.tile, test.ranges, ranges)
+			}
+		}
+		if lo, hi := bound.Lo().Lat.Degrees(), bound.Hi().Lat.Degrees(); lo >= hi || lo < -85.06 || hi > 85.06 {
+			t.Errorf("QueryBound(%v): invalid latitudes %v to %v", test.tile, lo, hi)
+		}
+	}
+
+	// A bound crossing the antimeridian is split in two
+	crossing := Tile{1, 0, 0}.QueryBound()
+	crossing.Lng.Lo, crossing.Lng.Hi = 3, -3
+	if ranges := lngRanges(crossing.Lng); len(ranges) != 2 || ranges[0][1] != 180 || ranges[1][0] != -180 {
+		t.Errorf("lngRanges: expected two ranges, got %v", ranges)
+	}
+}
+
+func closeTo(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
+
+func TestTileRangeEnd(t *testing.T) {
+
+	// Requests made within the lifetime of a cached tile share its time range
+	now := time.Unix(1000000, 0)
+	end := tileRangeEnd(now)
+	if !end.After(now) || end.Sub(now) > tileCacheTTL {
+		t.Errorf("tileRangeEnd: unexpected end %v for %v", end, now)
+	}
+	if later := tileRangeEnd(end.Add(-time.Second)); !later.Equal(end) {
+		t.Errorf("tileRangeEnd: expected %v, got %v", end, later)
+	}
+}
+
+// Return the location at the pixel 'px', 'py' of the zoom 'z'
+func tilePixelLocation(z int, px float64, py float64) Location {
+	n := float64(int(1) << uint(z))
+	return MakeLocation(tileLat(py, n), tileLng(px, n), 0, 0, 0)
+}
+
+// Return the colour of the pixel 'x', 'y' of the PNG tile 'data'
+func tilePixel(t *testing.T, data []byte, x int, y int) color.NRGBA {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Invalid PNG tile: %v", err)
+	}
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func TestRenderTilePNG(t *testing.T) {
+
+	left, right := Tile{14, 8000, 5000}, Tile{14, 8001, 5000}
+	edge := float64(right.X * tileSize)
+	row := float64(right.Y*tileSize) + 100.5
+
+	// A point just left of the edge between two tiles, and a crowd of
+	// points elsewhere in the left tile only
+	locations := []Location{tilePixelLocation(14, edge-0.5, row)}
+	for i := 0; i < 20; i++ {
+		locations = append(locations, tilePixelLocation(14, edge-128.5, row))
+	}
+	leftPNG, err := RenderTilePNG(left, locations)
+	if err != nil {
+		t.Fatalf("RenderTilePNG: %v", err)
+	}
+	rightPNG, err := RenderTilePNG(right, locations)
+	if err != nil {
+		t.Fatalf("RenderTilePNG: %v", err)
+	}
+
+	// The point is drawn in both tiles, in the same colour a pixel apart
+	// whatever else either tile holds
+	l, r := tilePixel(t, leftPNG, tileSize-2, 100), tilePixel(t, rightPNG, 0, 100)
+	if l.A == 0 || r.A == 0 {
+		t.Fatalf("RenderTilePNG: point at the edge drawn as %v and %v", l, r)
+	}
+	if l != r {
+		t.Errorf("RenderTilePNG: seam between %v and %v", l, r)
+	}
+	if c := tilePixel(t, rightPNG, tileKernelRadius+1, 100); c.A != 0 {
+		t.Errorf("RenderTilePNG: point drawn beyond its kernel as %v", c)
+	}
+
+	// The crowd is hotter than the single point, yet not saturated
+	crowd := tilePixel(t, leftPNG, tileSize-129, 100)
+	if crowd.A <= l.A || crowd.A == 255 {
+		t.Errorf("RenderTilePNG: crowd drawn as %v, single point as %v", crowd, l)
+	}
+	if tileScale(10) <= tileScale(14) || tileScale(16) != tileScale(14) {
+		t.Errorf("tileScale: %v at zoom 10, %v at 14, %v at 16", tileScale(10), tileScale(14), tileScale(16))
+	}
+}
+
+func TestRenderTileGeoJSON(t *testing.T) {
+
+	tile := Tile{14, 8000, 5000}
+	x0, y0 := float64(tile.X*tileSize), float64(tile.Y*tileSize)
+	const cellPx = tileSize / tileGridSize
+
+	// Three points in the first grid cell, one in the last, and one in the
+	// next tile
+	locations := []Location{
+		tilePixelLocation(14, x0+1.5, y0+1.5),
+		tilePixelLocation(14, x0+cellPx-1.5, y0+1.5),
+		tilePixelLocation(14, x0+1.5, y0+cellPx-1.5),
+		tilePixelLocation(14, x0+tileSize-1.5, y0+tileSize-1.5),
+		tilePixelLocation(14, x0+tileSize+1.5, y0+1.5),
+	}
+	data, err := RenderTileGeoJSON(tile, locations)
+	if err != nil {
+		t.Fatalf("RenderTileGeoJSON: %v", err)
+	}
+
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Coordinates [][][2]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties struct {
+				Count int `json:"count"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err = json.Unmarshal(data, &fc); err != nil || fc.Type != "FeatureCollection" || len(fc.Features) != 2 {
+		t.Fatalf("RenderTileGeoJSON: %s, %v", data, err)
+	}
+	for i, count := range []int{3, 1} {
+		f := fc.Features[i]
+		if f.Properties.Count != count {
+			t.Errorf("RenderTileGeoJSON: cell %d counts %d, want %d", i, f.Properties.Count, count)
+		}
+
+		// Each cell polygon contains its points
+		ring := f.Geometry.Coordinates[0]
+		loc := locations[3*i]
+		if len(ring) != 5 || loc.Lng < ring[0][0] || loc.Lng > ring[1][0] || loc.Lat < ring[0][1] || loc.Lat > ring[2][1] {
+			t.Errorf("RenderTileGeoJSON: cell %v does not contain %v, %v", ring, loc.Lat, loc.Lng)
+		}
+	}
+}
@@ -1,15 +1,22 @@
 package core
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
+	"time"
 
+	"github.com/golang/geo/s2"
 	"github.com/google/uuid"
 )
 
 // types
 
+// The period at which stale last known positions are removed
+const positionExpiryPeriod = time.Minute
+
 const earthCircumferenceMeters = 1000 * 40075.071
 const pi = 3.14159265358979323846
 
@@ -43,6 +50,10 @@ func earthMetersToRadians(m float64) float64 {
 	return (2 * pi) * (m / earthCircumferenceMeters)
 }
 
+func earthRadiansToMeters(r float64) float64 {
+	return earthCircumferenceMeters * (r / (2 * pi))
+}
+
 func toHeight(m float64) float64 {
 	radiusRadians := earthMetersToRadians(m)
 	return (radiusRadians * radiusRadians) / 2
@@ -55,9 +66,54 @@ type Config struct {
 	topologyLevel      int
 	height             float64
 
+	// The distance an entity must be inside a neighbouring cell before it
+	// is considered to have changed cell. Zero disables hysteresis.
+	hysteresisMeters float64
+
+	// The maximum vertical distance between an entity and the locations it
+	// receives, and the height of a floor for indoor venues. A threshold of
+	// zero disables vertical filtering.
+	verticalThresholdMeters float64
+	floorHeightMeters       float64
+
+	// Location pipeline settings
+	maxSpeedMetersPerSec float64
+	maxAccuracyMeters    float64
+	kalman               bool
+
+	// The trust score below which a client is flagged as implausible
+	trustThreshold float64
+
+	// The address on which beacon datagrams are received, none if empty,
+	// and the key of the HMAC they require
+	udpAddr string
+	udpKey  []byte
+
+	// The address of the MQTT broker to bridge, none if empty
+	mqttAddr string
+
+	// The number of acknowledgements that stop an SOS alert repeating, the
+	// interval at which it repeats and the webhooks notified of it
+	sosAcks     int
+	sosRepeat   time.Duration
+	sosWebhooks []string
+
+	// The scales available to the topology, ordered by minimum occupancy.
+	// The default scale is the topology level and search radius above.
+	scales []Scale
+
+	// A cache of cell ids to the covering of the search radius around them
+	coverings *coveringCache
+
 	// Redis settings
 	redisUrl        string
 	tokenTimeoutSec int
+
+	// The service under which last known positions are stored
+	service string
+
+	// The time after which a last known position is no longer reported
+	positionTimeoutSec int
 }
 
 // MakeConfig creates a new config object.
@@ -66,11 +122,39 @@ func MakeConfig(searchRadiusMeters float64, topologyLevel int) Config {
 		searchRadiusMeters,
 		topologyLevel,
 		toHeight(searchRadiusMeters),
+		0,
+		0,
+		0,
+		defaultMaxSpeedMetersPerSec,
+		0,
+		false,
+		defaultTrustThreshold,
+		"",
+		nil,
+		"",
+		defaultSOSAcks,
+		defaultSOSRepeat,
+		nil,
+		[]Scale{makeScale(topologyLevel, searchRadiusMeters, 0)},
+		makeCoveringCache(defaultCoveringCacheSize),
 		"redis://localhost",
-		30}
+		30,
+		"default",
+		300}
 	return c
 }
 
+// SetService sets the service under which last known positions are stored.
+func (c *Config) SetService(service string) {
+	c.service = service
+}
+
+// SetHysteresisMeters sets the distance an entity must be inside a
+// neighbouring cell before its cell changes.
+func (c *Config) SetHysteresisMeters(hysteresisMeters float64) {
+	c.hysteresisMeters = hysteresisMeters
+}
+
 // Topology is the structure that contains all the cells and cell
 // entities.
 type Topology struct {
@@ -87,6 +171,19 @@ type Topology struct {
 	// A group based subscribers
 	groupSubscriber Subscriber
 
+	// The number of entities within each coarse cell of the topology
+	occupancy *occupancy
+
+
+	// The density of entities and beacons per cell
+	density *Density
+
+	// An entity based subscriber
+	entitySubscriber Subscriber
+
+	// The plausibility of the beacons received from each client
+	plausibility *Plausibility
+
 	// Map of connections and the channels they are sunscribed to
 	//connections map[Connection]map[string]bool
 
@@ -111,9 +208,20 @@ func MakeTopology(c Config) Topology {
 		publisher:       MakePublisher(c.redisUrl),
 		cellSubscriber:  MakeSubscriber(c.redisUrl),
 		groupSubscriber: MakeSubscriber(c.redisUrl),
+		entitySubscriber: MakeSubscriber(c.redisUrl),
+		occupancy:       makeOccupancy(),
+		density:         MakeDensity(),
 		//connections: make(map[Connection]map[string]bool),
 		//channels:    make(map[string]map[Connection]bool),
 	}
+
+	// The checker reads the settings of the topology's own configuration
+	t.plausibility = MakePlausibility(&t.config)
+
+	// Data published to several channels is written to each connection once,
+	// whichever subscribers it is received by
+	t.groupSubscriber.recent = t.cellSubscriber.recent
+	t.entitySubscriber.recent = t.cellSubscriber.recent
 	return t
 }
 
@@ -121,7 +229,17 @@ func MakeTopology(c Config) Topology {
 // Make a Cell for operation within this topology
 //
 func (t *Topology) MakeCell() *Cell {
-	return MakeCell(&t.config)
+	c := MakeCell(&t.config)
+	c.occupancy = t.occupancy
+	return c
+}
+
+//
+// Make a Region for operation within this topology from the GeoJSON polygon
+// or bbox 'value'.
+//
+func (t *Topology) MakeRegion(value string) (*Region, error) {
+	return MakeRegion(value, &t.config)
 }
 
 //
@@ -149,6 +267,13 @@ func (t *Topology) Connect() error {
 		return err
 	}
 	log.Print("Group Subscriber connected to Redis Server URL: " + t.groupSubscriber.redisUrl)
+
+	err = t.entitySubscriber.Connect()
+	if err != nil {
+		log.Fatal("Failed to connect Entity Subscriber to Redis Server(1): ", err)
+		return err
+	}
+	log.Print("Entity Subscriber connected to Redis Server URL: " + t.entitySubscriber.redisUrl)
 	return nil
 }
 
@@ -159,6 +284,16 @@ func (t *Topology) Run() error {
 
 	t.cellSubscriber.Run()
 	t.groupSubscriber.Run()
+	t.entitySubscriber.Run()
+
+	// Periodically publish the density of the topology
+	go t.density.Run(&t.publisher)
+
+	// Periodically expire the plausibility state of idle clients
+	go t.plausibility.Run()
+
+	// Periodically remove the last known positions of idle clients
+	go t.expirePositions()
 
 	// TODO: wait for the subscribers to be actually running
 
@@ -192,26 +327,110 @@ func (t *Topology) GetClientID(tokenId TokenID) (ClientID, error) {
 //
 // Subscribe the Connection 'conn' to the cell 'cell' within this Topology.
 // Return an error on failure or nil otherwise.
-// This will call Unsubscribe for previous subscribed cells.
+// Only the cells added to or removed from the previously subscribed cell
+// group are subscribed or unsubscribed.
 //
 func (t *Topology) SubscribeToCell(conn Connection, cell *Cell) error {
 
-	// Unsubscribe from any groups first
-	_ = t.groupSubscriber.Unsubscribe(conn)
+	return t.cellSubscriber.SubscribeToCell(conn, cell, t.localFilters()...)
+}
+
+//
+// Return the location filters applied to the local cells of this Topology.
+// Regions are watched from afar, so are not filtered by the altitude of the
+// watching entity.
+//
+func (t *Topology) localFilters() []locationFilter {
 
-	return t.cellSubscriber.SubscribeToCell(conn, cell)
+	filters := make([]locationFilter, 0, 2)
+	if vf := t.config.verticalFilter(); vf != nil {
+		filters = append(filters, vf)
+	}
+	return filters
 }
 
 //
 // Subscribe the Connection 'conn' to the channel 'groupId' within this Topology.
 // Return an error on failure or nil otherwise.
 //
-func (t *Topology) SubscribeToGroup(conn Connection, groupId string, unsubscribe bool) error {
+func (t *Topology) SubscribeToGroup(conn Connection, groupId string) error {
 
-	// Unsubscribe from any cells first
-	_ = t.cellSubscriber.Unsubscribe(conn)
+	if groupId == "" {
+		return errors.New("Missing group id")
+	}
+	filter := UserFilter{Type: "group", Value: groupId}
+	return t.groupSubscriber.SubscribeFilter(conn, filter, []string{groupChannel(groupId)})
+}
+
+//
+// Subscribe the Connection 'conn' to the cells covering the region 'region'
+// within this Topology. Data written to the connection is filtered to the
+// exact region. Return an error on failure or nil otherwise.
+//
+func (t *Topology) SubscribeToRegion(conn Connection, region *Region) error {
 
-	return t.groupSubscriber.Subscribe(conn, groupId, unsubscribe)
+	channels := make([]string, 0, len(region.cellGroup))
+	for _, cellId := range region.cellGroup {
+		channels = append(channels, strconv.FormatUint(uint64(cellId), 10))
+	}
+
+	filter := UserFilter{Type: "region", Value: region.value}
+	return t.cellSubscriber.SubscribeFilter(conn, filter, channels, region)
+}
+
+//
+// Subscribe the Connection 'conn' to the channel of the client 'clientId'
+// within this Topology. Return an error on failure or nil otherwise.
+//
+func (t *Topology) SubscribeToEntity(conn Connection, clientId ClientID) error {
+
+	filter := UserFilter{Type: "entity", Value: uuid.UUID(clientId).String()}
+	return t.entitySubscriber.SubscribeFilter(conn, filter, []string{entityChannel(clientId)})
+}
+
+//
+// Subscribe the Connection 'conn' to the inbox of its own entity, on which
+// the messages sent directly to the entity's client are published.
+//
+func (t *Topology) SubscribeToInbox(conn Connection) error {
+
+	filter := UserFilter{Type: "inbox"}
+	return t.entitySubscriber.SubscribeFilter(conn, filter, []string{inboxChannel(conn.GetEntity().clientId)})
+}
+
+//
+// Subscribe the Connection 'conn' to the periodic density updates of this
+// Topology. Return an error on failure or nil otherwise.
+//
+func (t *Topology) SubscribeToDensity(conn Connection) error {
+
+	filter := UserFilter{Type: "density"}
+	return t.groupSubscriber.SubscribeFilter(conn, filter, []string{densityChannel})
+}
+
+//
+// Return the density of the cells at level 'level' over the window 'window'
+// intersecting the rect 'bound'. Cells holding too few entities are left out.
+//
+func (t *Topology) GetDensity(level int, window time.Duration, bound s2.Rect) []CellDensityData {
+	return t.density.Query(level, window, bound, densityMinEntities)
+}
+
+//
+// Unsubscribe the Connection 'conn' from the filter 'filter' only, leaving
+// its other filters subscribed.
+//
+func (t *Topology) UnsubscribeFromFilter(conn Connection, filter *UserFilter) error {
+
+	switch filter.Type {
+	case "local", "region":
+		return t.cellSubscriber.UnsubscribeFilter(conn, *filter)
+	case "group", "density":
+		return t.groupSubscriber.UnsubscribeFilter(conn, *filter)
+	case "entity", "inbox":
+		return t.entitySubscriber.UnsubscribeFilter(conn, *filter)
+	}
+	return errors.New("Unknown filter type: " + filter.Type)
 }
 
 //
@@ -223,13 +442,51 @@ func (t *Topology) UnsubscribeFromGroups(conn Connection) error {
 }
 
 //
-// Unsubscribe the Connection 'conn' from all groups and cells.
+// Unsubscribe the Connection 'conn' from all groups, entities and cells.
 //
 func (t *Topology) Unsubscribe(conn Connection) error {
 
 	_ = t.cellSubscriber.Unsubscribe(conn)
 	_ = t.groupSubscriber.Unsubscribe(conn)
-	return nil
+	_ = t.entitySubscriber.Unsubscribe(conn)
+
+	// The entity no longer counts towards the occupancy until it beacons again
+	entity := conn.GetEntity()
+	if entity == nil {
+		return nil
+	}
+	if entity.cell != nil {
+		entity.cell.release()
+	}
+	return t.PublishPresence(entity, presenceOffline)
+}
+
+//
+// Publish the presence 'state' of the entity 'entity' to the cells of its
+// last known location, its groups and its followers, unless it is already
+// in that state
+//
+func (t *Topology) PublishPresence(entity *Entity, state string) error {
+
+	if entity.presence == state || (entity.presence == "" && state == presenceOffline) {
+		return nil
+	}
+	entity.presence = state
+
+	message, err := json.Marshal(makePresence(entity, state, time.Now()))
+	if err != nil {
+		return err
+	}
+	if entity.location.Timestamp != 0 {
+		err = t.publishToCells(entity.location, message)
+		if err != nil {
+			return err
+		}
+	}
+	for _, group := range entity.groups {
+		_ = t.publisher.Publish(groupChannel(group.Uuid), message)
+	}
+	return t.publisher.Publish(entityChannel(entity.clientId), message)
 }
 
 //
@@ -237,21 +494,263 @@ func (t *Topology) Unsubscribe(conn Connection) error {
 //
 func (t *Topology) Broadcast(entity *Entity, message []byte) error {
 
-	// Broadcast the message to the cells
-	cellIdStr := strconv.FormatUint(uint64(entity.cell.s2cellID), 10)
-	err := t.publisher.Publish(cellIdStr, message)
+	// Broadcast the message to the cells containing the entity
+	err := t.publishToCells(entity.location, message)
 	if err != nil {
 		return err
 	}
 
 	// Broadcast the message the entities Groups
 	for _, group := range entity.groups {
-		_ = t.publisher.Publish(group.Uuid, message)
+		_ = t.publisher.Publish(groupChannel(group.Uuid), message)
+	}
+
+	// Broadcast the message to the entity's own channel for its followers
+	_ = t.publisher.Publish(entityChannel(entity.clientId), message)
+
+	// Remember the entity's last known position and count it towards density
+	t.density.Record(entity, time.Now())
+	err = t.publisher.SetPosition(t.config.service, entity.clientId, entity.location, message)
+	if err != nil {
+		log.Printf("Failed to store position: %v", err)
+	}
+
+	// Let the watchers of the entity know it is back online
+	err = t.PublishPresence(entity, presenceOnline)
+	if err != nil {
+		log.Printf("Failed to publish presence: %v", err)
 	}
 
 	return nil
 }
 
+//
+// Publish the message 'message' to the cells containing the location 'loc'
+// at every scale, as neighbouring entities may be operating at another scale
+//
+func (t *Topology) publishToCells(loc Location, message []byte) error {
+
+	leaf := s2.CellIDFromLatLng(s2.LatLngFromDegrees(loc.Lat, loc.Lng))
+	for _, scale := range t.config.scales {
+		cellIdStr := strconv.FormatUint(uint64(leaf.Parent(scale.level)), 10)
+		err := t.publisher.Publish(cellIdStr, message)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Publish the SOS alert 'message' of the entity 'entity' to the groups
+// 'groups', the cells around the entity and the entity's followers.
+//
+func (t *Topology) PublishSOS(entity *Entity, groups []string, message []byte) error {
+
+	var err error
+	if entity.location.Timestamp != 0 {
+		err = t.publishToCells(entity.location, message)
+	}
+	for _, group := range groups {
+		if perr := t.publisher.Publish(groupChannel(group), message); perr != nil {
+			err = perr
+		}
+	}
+	if perr := t.publisher.Publish(entityChannel(entity.clientId), message); perr != nil {
+		err = perr
+	}
+	return err
+}
+
+//
+// Publish the message 'message' sent by the entity 'entity' to the target
+// 'to': a group, the cells around the entity or the inbox of a client.
+//
+func (t *Topology) PublishMessage(entity *Entity, to MessageTarget, message []byte) error {
+
+	switch to.Type {
+	case targetGroup:
+		return t.publisher.Publish(groupChannel(to.Value), message)
+	case targetLocal:
+		return t.publishToCells(entity.location, message)
+	case targetClient:
+		clientUUID, err := uuid.Parse(to.Value)
+		if err != nil {
+			return err
+		}
+		return t.publisher.Publish(inboxChannel(ClientID(clientUUID)), message)
+	}
+	return errors.New("Unknown message target: " + to.Type)
+}
+
+//
+// Return the last known user data of all entities within 'radiusMeters' of
+// the location 'loc', nearest first.
+//
+func (t *Topology) GetPositions(loc Location, radiusMeters float64) ([]UserData, error) {
+
+	values, err := t.publisher.GetPositions(t.config.service, loc, radiusMeters, t.config.positionTimeoutSec)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make([]UserData, 0, len(values))
+	for _, v := range values {
+		userData := UserData{}
+		if json.Unmarshal(v, &userData) == nil {
+			positions = append(positions, userData)
+		}
+	}
+	return positions, nil
+}
+
+//
+// Periodically remove the last known positions not updated within the
+// position timeout, so they are not written on the read path
+//
+func (t *Topology) expirePositions() {
+	ticker := time.NewTicker(positionExpiryPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := t.publisher.ExpirePositions(t.config.service, t.config.positionTimeoutSec)
+		if err != nil {
+			log.Printf("Failed to expire positions: %v", err)
+		}
+	}
+}
+
+//
+// Return the 'k' nearest entities to the location 'loc', nearest first.
+// Only the clients returned by 'visible' are included. Fewer are returned
+// if fewer are within the farthest nearest radius.
+//
+func (t *Topology) GetNearest(loc Location, k int, visible func(clientIds []string) map[string]bool) ([]Neighbour, error) {
+	return findNearest(loc, k, visible, t.GetPositions, time.Now())
+}
+
+//
+// Remove the last known position of the entity 'entity', so it is no longer
+// found near it, such as when it enters standby
+//
+func (t *Topology) RemovePosition(entity *Entity) error {
+	return t.publisher.RemovePosition(t.config.service, entity.clientId)
+}
+
+//
+// Check the plausibility of the raw location 'loc' received from the entity
+// 'entity'. Return the flags raised by the location, if any.
+//
+func (t *Topology) CheckPlausibility(entity *Entity, loc Location) []PlausibilityFlag {
+	return t.plausibility.Check(entity.clientId, loc, time.Now())
+}
+
+//
+// Return the flags raised by the location 'loc' recorded by the entity
+// 'entity' before it was received, such as while offline
+//
+func (t *Topology) CheckRecordedPlausibility(entity *Entity, loc Location) []PlausibilityFlag {
+	return t.plausibility.CheckRecorded(entity.clientId, loc, time.Now())
+}
+
+//
+// Return the trust score of the client 'clientId' and whether it is flagged
+//
+func (t *Topology) GetTrust(clientId ClientID) (float64, bool) {
+	return t.plausibility.GetTrust(clientId)
+}
+
+//
+// Return the clients of 'clientIds' that have not been flagged as
+// implausible, for building rankings such as group leaderboards.
+//
+func (t *Topology) ExcludeFlagged(clientIds []ClientID) []ClientID {
+	return t.plausibility.ExcludeFlagged(clientIds)
+}
+
+//
+// Remove the entity 'entity' from this topology
+//
+func (t *Topology) RemoveEntity(entity *Entity) {
+	entity.cell.release()
+}
+
+//
+// Return the last known user data of all entities within the cells 'cellGroup'
+//
+func (t *Topology) GetCellGroupPositions(cellGroup []s2.CellID) ([]UserData, error) {
+
+	if len(cellGroup) == 0 {
+		return []UserData{}, nil
+	}
+
+	// Search the cap bounding the cell group, then filter to the cells
+	union := s2.CellUnion(append([]s2.CellID(nil), cellGroup...))
+	bound := union.CapBound()
+	center := s2.LatLngFromPoint(bound.Center())
+	loc := MakeLocation(center.Lat.Degrees(), center.Lng.Degrees(), 0, 0, 0)
+	positions, err := t.GetPositions(loc, earthRadiansToMeters(bound.Radius().Radians()))
+	if err != nil {
+		return nil, err
+	}
+
+	level := cellGroup[0].Level()
+	inGroup := make(map[s2.CellID]bool, len(cellGroup))
+	for _, cid := range cellGroup {
+		inGroup[cid] = true
+	}
+
+	filtered := positions[:0]
+	for _, p := range positions {
+		cid := s2.CellIDFromLatLng(s2.LatLngFromDegrees(p.Location.Lat, p.Location.Lng)).Parent(level)
+		if inGroup[cid] {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered, nil
+}
+
+//
+// Return the last known user data of all entities within the region 'region'
+//
+func (t *Topology) GetRegionPositions(region *Region) ([]UserData, error) {
+
+	positions, err := t.GetCellGroupPositions(region.cellGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := positions[:0]
+	for _, p := range positions {
+		if region.ContainsLocation(&p.Location) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered, nil
+}
+
+//
+// Return the channel on which the updates of the members of group 'groupId'
+// are published. Group ids are chosen by clients, so are kept apart from the
+// other channels to prevent a group filter subscribing to them.
+//
+func groupChannel(groupId string) string {
+	return "group:" + groupId
+}
+
+//
+// Return the channel on which the updates of client 'clientId' are published
+//
+func entityChannel(clientId ClientID) string {
+	return "entity:" + uuid.UUID(clientId).String()
+}
+
+//
+// Return the channel on which the messages sent to client 'clientId' are published
+//
+func inboxChannel(clientId ClientID) string {
+	return "inbox:" + uuid.UUID(clientId).String()
+}
+
 //
 //
 //
@@ -262,8 +761,9 @@ func (t *Topology) EntityExpired(tokenId TokenID) bool {
 
 // Display the given Topology.
 func (t *Topology) Display() {
-	fmt.Printf("Created Topology {\n  Search Radius: %f meters\n  Topology Level: %d\n  Height: %e meters\n}\n",
+	fmt.Printf("Created Topology {\n  Search Radius: %f meters\n  Topology Level: %d\n  Height: %e meters\n  Hysteresis: %f meters\n}\n",
 		t.config.searchRadiusMeters,
 		t.config.topologyLevel,
-		t.config.height)
+		t.config.height,
+		t.config.hysteresisMeters)
 }
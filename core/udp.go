@@ -0,0 +1,357 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// The first byte and version of a beacon datagram
+	udpMagic   = 'u'
+	udpVersion = 1
+
+	// The flags of a beacon datagram
+	udpFlagHMAC    = 0x01
+	udpFlagShortId = 0x02
+	udpFlagStandby = 0x04
+
+	// The length of the truncated HMAC-SHA256 ending a datagram
+	udpHMACSize = 16
+
+	// The largest datagram read
+	maxDatagramSize = 512
+
+	// The beacons per second and burst allowed from a single tracker
+	udpRatePerSec = 2
+	udpRateBurst  = 10
+
+	// The period between removing idle trackers and logging the datagrams
+	// rejected. It is longer than a beacon is in sync, so datagrams replayed
+	// once a tracker is removed are rejected as out of sync.
+	udpExpiryPeriod = time.Minute
+)
+
+//
+// A beacon datagram is a fire and forget beacon for low power trackers.
+// All fields are big endian:
+//
+//    magic    1 byte   'u'
+//    version  1 byte   1
+//    flags    1 byte   HMAC (0x01), short id (0x02), standby (0x04)
+//    id       16 bytes token id, or 4 bytes short id if flagged
+//    seq      4 bytes  increasing sequence number, wrapping
+//    location 32 bytes version 2 location (millisecond timestamp)
+//    hmac     16 bytes truncated HMAC-SHA256 of all preceding bytes, if flagged
+//
+// The short id and the key of the HMAC are given in the response to a sync
+// request. If the listener has a key, every datagram must carry a valid
+// HMAC keyed by the beacon key of its token.
+//
+type udpBeacon struct {
+	flags    uint8
+	tokenId  TokenID
+	shortId  uint32
+	seq      uint32
+	location Location
+
+	// The bytes covered by the HMAC, and the HMAC if flagged
+	body []byte
+	sum  []byte
+}
+
+// Parse the datagram 'data', without checking its HMAC
+func parseUDPBeacon(data []byte) (*udpBeacon, error) {
+
+	if len(data) < 3 || data[0] != udpMagic || data[1] != udpVersion {
+		return nil, errors.New("Not a beacon datagram")
+	}
+
+	b := new(udpBeacon)
+	b.flags = data[2]
+	if b.flags&udpFlagHMAC != 0 {
+		if len(data) < udpHMACSize {
+			return nil, errors.New("Datagram too short")
+		}
+		data, b.sum = data[:len(data)-udpHMACSize], data[len(data)-udpHMACSize:]
+	}
+	b.body = data
+
+	idSize := 16
+	if b.flags&udpFlagShortId != 0 {
+		idSize = 4
+	}
+	if len(data) != 3+idSize+4+32 {
+		return nil, errors.New("Invalid datagram length")
+	}
+
+	buf := bytes.NewBuffer(data[3:])
+	if idSize == 4 {
+		binary.Read(buf, binary.BigEndian, &b.shortId)
+	} else {
+		binary.Read(buf, binary.BigEndian, &b.tokenId)
+	}
+	binary.Read(buf, binary.BigEndian, &b.seq)
+	DeserializeVersion(&b.location, buf, 2)
+	return b, nil
+}
+
+//
+// Return an error unless the beacon carries a valid HMAC keyed by 'key'.
+// Without a key no HMAC is required, and any carried is ignored.
+//
+func (b *udpBeacon) verify(key []byte) error {
+	if len(key) == 0 {
+		return nil
+	}
+	if b.sum == nil {
+		return errors.New("Missing HMAC")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b.body)
+	if !hmac.Equal(mac.Sum(nil)[:udpHMACSize], b.sum) {
+		return errors.New("Invalid HMAC")
+	}
+	return nil
+}
+
+//
+// Return the key of the HMAC of the datagrams of the token 'tokenId',
+// derived from the listener key 'key' so that no two trackers share a key.
+// Return nil if there is no listener key.
+//
+func beaconKey(key []byte, tokenId TokenID) []byte {
+	if len(key) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(tokenId[:])
+	return mac.Sum(nil)
+}
+
+// Return the short id of the token 'tokenId'
+func shortIdOf(tokenId TokenID) uint32 {
+	return binary.BigEndian.Uint32(tokenId[:4])
+}
+
+// rateLimiter is a token bucket limiting the actions of a single client,
+// such as the beacons of a tracker
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Return a limiter allowing 'rate' actions per second after a burst of
+// 'burst' actions from the time 'now'
+func makeRateLimiter(rate float64, burst float64, now time.Time) rateLimiter {
+	return rateLimiter{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// Return true if an action is allowed at the time 'now'
+func (r *rateLimiter) allow(now time.Time) bool {
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+//
+// udpSource is the state of the datagrams received for a single entity
+//
+type udpSource struct {
+
+	// The rate limiter of the datagrams
+	limiter rateLimiter
+
+	// The sequence number of the last beacon
+	seq uint32
+
+	// The latest location timestamp of the beacons, in milliseconds
+	latest int64
+}
+
+//
+// Record the sequence number 'seq' of a beacon located at the time 't' in
+// milliseconds. Return false if it is not newer than the last, allowing it
+// to wrap. A tracker that reboots restarts its sequence, so an older
+// sequence number is accepted with a location newer than every location
+// received before: a replayed beacon never has one.
+//
+func (s *udpSource) advance(seq uint32, t int64) bool {
+	if int32(seq-s.seq) <= 0 && t <= s.latest {
+		return false
+	}
+	s.seq = seq
+	if t > s.latest {
+		s.latest = t
+	}
+	return true
+}
+
+//
+// UDPListener receives beacon datagrams and broadcasts them like beacons
+// received by the endpoint 'endpoint'.
+//
+type UDPListener struct {
+
+	// The endpoint the beacons are given to
+	endpoint *Endpoint
+
+	// The key from which the key of the HMAC of each token is derived. If
+	// empty no HMAC is required.
+	key []byte
+
+	// Map of entities to the state of their datagrams. An entity synced
+	// again is a new entity, so its sequence starts anew.
+	sources map[*Entity]*udpSource
+
+	// The number of datagrams rejected since last logged, and the reason
+	// the last was rejected
+	rejected uint64
+	reason   atomic.Value
+
+	// A mutex for synchronising the listener between threads
+	lock sync.Mutex
+}
+
+func MakeUDPListener(endpoint *Endpoint, key []byte) *UDPListener {
+	l := &UDPListener{
+		endpoint: endpoint,
+		key:      key,
+		sources:  make(map[*Entity]*udpSource),
+	}
+	return l
+}
+
+//
+// Listen for beacon datagrams on the address 'addr' until an error occurs
+//
+func (l *UDPListener) Listen(addr string) error {
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("UDP Beacon Service Started on %s\n", addr)
+
+	go l.expire()
+
+	data := make([]byte, maxDatagramSize)
+	for {
+		n, src, rerr := conn.ReadFrom(data)
+		if rerr != nil {
+			return rerr
+		}
+		err = l.handle(data[:n], time.Now())
+		if err != nil {
+			// Rejections are logged periodically, so that a flood of
+			// datagrams cannot flood the log
+			atomic.AddUint64(&l.rejected, 1)
+			l.reason.Store(src.String() + ": " + err.Error())
+		}
+	}
+}
+
+// Handle the datagram 'data' received at 'now'
+func (l *UDPListener) handle(data []byte, now time.Time) error {
+
+	b, err := parseUDPBeacon(data)
+	if err != nil {
+		return err
+	}
+
+	var entity *Entity
+	if b.flags&udpFlagShortId != 0 {
+		entity, err = l.endpoint.GetEntityByShortId(b.shortId)
+	} else {
+		entity, err = l.endpoint.GetEntity(uuid.UUID(b.tokenId).String())
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.verify(beaconKey(l.key, entity.tokenId))
+	if err != nil {
+		return err
+	}
+	err = l.accept(entity, b, now)
+	if err != nil {
+		return err
+	}
+
+	userData, berr := l.endpoint.processLocation(entity, b.location)
+	if berr == nil {
+		berr = l.endpoint.publishUserData(entity, userData, b.flags&udpFlagStandby != 0)
+	}
+	if berr != nil {
+		return berr
+	}
+	return nil
+}
+
+//
+// Return an error if the entity 'entity' may not send the beacon 'b' at
+// 'now', either because it is sending too many or the beacon is replayed
+//
+func (l *UDPListener) accept(entity *Entity, b *udpBeacon, now time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	s, ok := l.sources[entity]
+	if !ok {
+		s = &udpSource{limiter: makeRateLimiter(udpRatePerSec, udpRateBurst, now)}
+		l.sources[entity] = s
+	}
+	if !s.limiter.allow(now) {
+		return errors.New("Rate limited")
+	}
+	if !s.advance(b.seq, b.location.UnixMilli()) {
+		return errors.New("Replayed sequence number")
+	}
+	return nil
+}
+
+// Periodically remove idle entities and log the datagrams rejected
+func (l *UDPListener) expire() {
+	ticker := time.NewTicker(udpExpiryPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.lock.Lock()
+		for entity, s := range l.sources {
+			if now.Sub(s.limiter.last) > udpExpiryPeriod {
+				delete(l.sources, entity)
+			}
+		}
+		l.lock.Unlock()
+
+		if n := atomic.SwapUint64(&l.rejected, 0); n > 0 {
+			log.Printf("UDP: Rejected %d datagrams, the last from %v", n, l.reason.Load())
+		}
+	}
+}
+
+// SetUDPBeacons listens for beacon datagrams on the address 'addr',
+// requiring an HMAC keyed by each token and the key 'key' unless it is
+// empty.
+func (c *Config) SetUDPBeacons(addr string, key []byte) {
+	c.udpAddr = addr
+	c.udpKey = key
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Return a beacon datagram of the token 'tokenId', signed with 'key' if set
+func makeUDPDatagram(tokenId TokenID, seq uint32, loc Location, key []byte) []byte {
+
+	flags := byte(0)
+	if key != nil {
+		flags |= udpFlagHMAC
+	}
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{udpMagic, udpVersion, flags})
+	binary.Write(buf, binary.BigEndian, &tokenId)
+	binary.Write(buf, binary.BigEndian, seq)
+	SerializeVersion(&loc, buf, 2)
+	if key == nil {
+		return buf.Bytes()
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf.Bytes())
+	return append(buf.Bytes(), mac.Sum(nil)[:udpHMACSize]...)
+}
+
+func TestParseUDPBeacon(t *testing.T) {
+
+	key := []byte("secret")
+	tokenId := TokenID(uuid.New())
+	loc := MakeLocation(-34.9287, 138.5999, 0, 0, 1700000000)
+	datagram := makeUDPDatagram(tokenId, 7, loc, beaconKey(key, tokenId))
+
+	b, err := parseUDPBeacon(datagram)
+	if err != nil {
+		t.Fatalf("parseUDPBeacon: %v", err)
+	}
+	if b.tokenId != tokenId || b.seq != 7 || b.location.Timestamp != loc.Timestamp {
+		t.Errorf("parseUDPBeacon: got %+v", b)
+	}
+	if err = b.verify(beaconKey(key, tokenId)); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if err = b.verify(nil); err != nil {
+		t.Errorf("verify without a key: %v", err)
+	}
+
+	// The key of one token does not sign the datagrams of another
+	if err = b.verify(key); err == nil {
+		t.Errorf("verify: expected invalid HMAC with the listener key")
+	}
+	if err = b.verify(beaconKey(key, TokenID(uuid.New()))); err == nil {
+		t.Errorf("verify: expected invalid HMAC with the key of another token")
+	}
+
+	b, err = parseUDPBeacon(makeUDPDatagram(tokenId, 7, loc, nil))
+	if err != nil {
+		t.Fatalf("parseUDPBeacon: %v", err)
+	}
+	if err = b.verify(beaconKey(key, tokenId)); err == nil {
+		t.Errorf("verify: expected missing HMAC")
+	}
+
+	if _, err = parseUDPBeacon(datagram[:len(datagram)-1]); err == nil {
+		t.Errorf("parseUDPBeacon: expected invalid length")
+	}
+	if beaconKey(nil, tokenId) != nil {
+		t.Errorf("beaconKey: expected no key without a listener key")
+	}
+}
+
+func TestUDPSourceAdvance(t *testing.T) {
+
+	// Sequence numbers must increase, but may wrap
+	var s udpSource
+	for _, c := range []struct {
+		seq uint32
+		t   int64
+		ok  bool
+	}{
+		{0xfffffffe, 1000, true},
+		{0xfffffffe, 1000, false},
+		{1, 2000, true},
+		{0, 2000, false},
+		{2, 2000, true},
+
+		// A replay of an earlier beacon
+		{0xfffffffe, 1000, false},
+
+		// A tracker that rebooted restarts its sequence
+		{0, 3000, true},
+		{1, 4000, true},
+		{0, 3000, false},
+	} {
+		if s.advance(c.seq, c.t) != c.ok {
+			t.Errorf("advance(%d, %d): expected %v", c.seq, c.t, c.ok)
+		}
+	}
+}
+
+func TestUDPListenerAccept(t *testing.T) {
+
+	l := MakeUDPListener(nil, nil)
+	first, second := &Entity{}, &Entity{}
+	now := time.Unix(1700000000, 0)
+	beacon := func(seq uint32) *udpBeacon {
+		b := &udpBeacon{seq: seq}
+		b.location.SetUnixMilli(now.UnixNano() / int64(time.Millisecond))
+		return b
+	}
+
+	// Each entity has its own burst, whatever the source of its datagrams
+	for i := 0; i < udpRateBurst; i++ {
+		if err := l.accept(first, beacon(uint32(i+1)), now); err != nil {
+			t.Fatalf("accept(%d): %v", i+1, err)
+		}
+	}
+	if err := l.accept(first, beacon(udpRateBurst+1), now); err == nil {
+		t.Errorf("accept: expected the burst to be rate limited")
+	}
+	if err := l.accept(second, beacon(1), now); err != nil {
+		t.Errorf("accept: another entity was rate limited: %v", err)
+	}
+
+	now = now.Add(time.Second)
+	if err := l.accept(first, beacon(udpRateBurst+2), now); err != nil {
+		t.Errorf("accept after a second: %v", err)
+	}
+	if err := l.accept(first, beacon(udpRateBurst+2), now); err == nil {
+		t.Errorf("accept: expected a replayed sequence number")
+	}
+	if len(l.sources) != 2 {
+		t.Errorf("%d sources, expected 2", len(l.sources))
+	}
+}
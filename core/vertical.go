@@ -0,0 +1,69 @@
+package core
+
+import (
+	"math"
+)
+
+//
+// locationFilter matches the locations of the data written to a connection
+//
+type locationFilter interface {
+
+	// Return true if the location 'loc' should be written to the connection 'conn'
+	matches(conn Connection, loc *Location) bool
+}
+
+//
+// verticalFilter matches the locations within a vertical distance of the
+// entity of a connection, optionally bucketing altitudes into floors.
+// An altitude of zero is unknown rather than ground level, so locations
+// without an altitude, or seen by an entity without one, always match.
+//
+type verticalFilter struct {
+
+	// The maximum vertical distance between the entity and a location
+	thresholdMeters float64
+
+	// The height of a floor, or zero to compare altitudes directly
+	floorHeightMeters float64
+}
+
+func (vf *verticalFilter) matches(conn Connection, loc *Location) bool {
+	entity := conn.GetEntity()
+	if entity == nil || entity.location.Alt == 0 || loc.Alt == 0 {
+		return true
+	}
+	return vf.distance(entity.location.Alt, loc.Alt) <= vf.thresholdMeters
+}
+
+// Return the vertical distance between the altitudes 'a' and 'b'
+func (vf *verticalFilter) distance(a float32, b float32) float64 {
+	if vf.floorHeightMeters > 0 {
+		floorA := math.Floor(float64(a) / vf.floorHeightMeters)
+		floorB := math.Floor(float64(b) / vf.floorHeightMeters)
+		return math.Abs(floorA-floorB) * vf.floorHeightMeters
+	}
+	return math.Abs(float64(a) - float64(b))
+}
+
+// SetVerticalThresholdMeters sets the maximum vertical distance between an
+// entity and the locations it receives from its local cells. Zero disables
+// vertical filtering.
+func (c *Config) SetVerticalThresholdMeters(thresholdMeters float64) {
+	c.verticalThresholdMeters = thresholdMeters
+}
+
+// SetFloorHeightMeters buckets altitudes into floors of the given height
+// before comparing them with the vertical threshold, for indoor venues.
+// Zero compares altitudes directly.
+func (c *Config) SetFloorHeightMeters(floorHeightMeters float64) {
+	c.floorHeightMeters = floorHeightMeters
+}
+
+// Return the vertical filter for the configuration, or nil if disabled
+func (c *Config) verticalFilter() locationFilter {
+	if c.verticalThresholdMeters <= 0 {
+		return nil
+	}
+	return &verticalFilter{c.verticalThresholdMeters, c.floorHeightMeters}
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestVerticalFilter(t *testing.T) {
+
+	entity := MakeEntity(nil, ClientID(uuid.New()), TokenID(uuid.New()), nil)
+	conn := &testConnection{entity: entity}
+
+	tests := []struct {
+		floorHeight float64
+		entityAlt   float32
+		locAlt      float32
+		expected    bool
+	}{
+		{0, 10, 12, true},
+		{0, 10, 20, false},
+		{0, 20, 10, false},
+
+		// Unknown altitudes always match
+		{0, 0, 20, true},
+		{0, 20, 0, true},
+
+		// Altitudes on the same floor match, those on other floors do not
+		{4, 9, 11, true},
+		{4, 7, 9, true},
+		{4, 5, 13, false},
+	}
+	for _, test := range tests {
+		vf := &verticalFilter{thresholdMeters: 4, floorHeightMeters: test.floorHeight}
+		entity.location = MakeLocation(0, 0, test.entityAlt, 0, 0)
+		loc := MakeLocation(0, 0, test.locAlt, 0, 0)
+		if vf.matches(conn, &loc) != test.expected {
+			t.Errorf("matches(%v, %v, floor %v): expected %v", test.entityAlt, test.locAlt, test.floorHeight, test.expected)
+		}
+	}
+}
+
+func TestRegionNotVerticallyFiltered(t *testing.T) {
+
+	c := MakeConfig(250, 15)
+	c.SetVerticalThresholdMeters(5)
+	topology := MakeTopology(c)
+	conn := &testConnection{entity: MakeEntity(nil, ClientID(uuid.New()), TokenID(uuid.New()), nil)}
+
+	if len(topology.localFilters()) != 1 {
+		t.Fatalf("localFilters: expected the vertical filter")
+	}
+
+	// A region is only filtered by its own shape
+	region := &Region{value: "far"}
+	if err := topology.SubscribeToRegion(conn, region); err != nil {
+		t.Fatalf("SubscribeToRegion: %v", err)
+	}
+	fc := topology.cellSubscriber.connections[conn]["region:far"]
+	if fc == nil || len(fc.locations) != 1 || fc.locations[0] != locationFilter(region) {
+		t.Errorf("SubscribeToRegion: expected only the region filter, got %+v", fc)
+	}
+}
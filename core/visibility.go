@@ -0,0 +1,124 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// The time for which the visibility of a client is remembered
+	visibilityPeriod = time.Minute
+)
+
+//
+// clientFilter matches the clients whose data is written to a connection
+//
+type clientFilter interface {
+
+	// Return true if the data of the client 'clientId' should be written
+	admits(clientId string, now time.Time) bool
+}
+
+//
+// Return true if all of the filters 'filters' that match clients admit the
+// client 'clientId'
+//
+func admitsClient(filters []locationFilter, clientId string, now time.Time) bool {
+	for _, f := range filters {
+		if c, ok := f.(clientFilter); ok && !c.admits(clientId, now) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// clientVisibility remembers which clients are visible to an entity, so the
+// data received for a connection can be checked without waiting for the
+// database. Clients not yet known are looked up in the background and are
+// not visible until then.
+//
+type clientVisibility struct {
+
+	// Return the client ids of 'clientIds' that are visible
+	lookup func(clientIds []string) map[string]bool
+
+	// The clients looked up, and the clients waiting to be
+	known     map[string]visibleClient
+	pending   map[string]bool
+	resolving bool
+
+	// A lock synchronising access to the clients
+	lock sync.Mutex
+}
+
+type visibleClient struct {
+	visible bool
+	expires time.Time
+}
+
+func makeClientVisibility(lookup func(clientIds []string) map[string]bool) *clientVisibility {
+	return &clientVisibility{
+		lookup:  lookup,
+		known:   map[string]visibleClient{},
+		pending: map[string]bool{},
+	}
+}
+
+//
+// Return true if the client 'clientId' is known to be visible. A client not
+// known, or known for longer than the visibility period, is looked up again.
+// Until then an unknown client is not visible and a known one keeps its
+// last visibility.
+//
+func (v *clientVisibility) admits(clientId string, now time.Time) bool {
+	if clientId == "" {
+		return false
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	c, ok := v.known[clientId]
+	if ok && now.Before(c.expires) {
+		return c.visible
+	}
+	v.pending[clientId] = true
+	if !v.resolving {
+		v.resolving = true
+		go v.resolve()
+	}
+	return ok && c.visible
+}
+
+// Look up the pending clients until none remain
+func (v *clientVisibility) resolve() {
+	for {
+		v.lock.Lock()
+		if len(v.pending) == 0 {
+			v.resolving = false
+			v.lock.Unlock()
+			return
+		}
+		clientIds := make([]string, 0, len(v.pending))
+		for clientId := range v.pending {
+			clientIds = append(clientIds, clientId)
+		}
+		v.pending = map[string]bool{}
+		v.lock.Unlock()
+
+		visible := v.lookup(clientIds)
+		now := time.Now()
+
+		v.lock.Lock()
+		for clientId, c := range v.known {
+			if !now.Before(c.expires) {
+				delete(v.known, clientId)
+			}
+		}
+		for _, clientId := range clientIds {
+			v.known[clientId] = visibleClient{visible: visible[clientId], expires: now.Add(visibilityPeriod)}
+		}
+		v.lock.Unlock()
+	}
+}
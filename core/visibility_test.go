@@ -0,0 +1,67 @@
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientVisibility(t *testing.T) {
+
+	var lock sync.Mutex
+	lookups := 0
+	friends := map[string]bool{"friend": true}
+	v := makeClientVisibility(func(clientIds []string) map[string]bool {
+		lock.Lock()
+		defer lock.Unlock()
+		lookups++
+		visible := map[string]bool{}
+		for _, clientId := range clientIds {
+			visible[clientId] = friends[clientId]
+		}
+		return visible
+	})
+	region := &Region{visible: v}
+	filters := []locationFilter{region}
+
+	// Clients are not visible until they have been looked up
+	now := time.Now()
+	if admitsClient(filters, "friend", now) || admitsClient(filters, "stranger", now) {
+		t.Errorf("admits: admitted a client not yet looked up")
+	}
+	deadline := time.Now().Add(time.Second)
+	for !admitsClient(filters, "friend", now) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !admitsClient(filters, "friend", now) || admitsClient(filters, "stranger", now) {
+		t.Errorf("admits: expected only the friend to be admitted")
+	}
+	if admitsClient(filters, "", now) {
+		t.Errorf("admits: admitted data without a client")
+	}
+
+	// A client is looked up again once its visibility expires, keeping its
+	// last visibility in the meantime
+	lock.Lock()
+	friends["friend"] = false
+	before := lookups
+	lock.Unlock()
+	later := now.Add(2 * visibilityPeriod)
+	if !admitsClient(filters, "friend", later) {
+		t.Errorf("admits: expired client lost its visibility before being looked up")
+	}
+	deadline = time.Now().Add(time.Second)
+	for admitsClient(filters, "friend", later) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	lock.Lock()
+	if lookups == before || admitsClient(filters, "friend", later) {
+		t.Errorf("admits: expired client not looked up again")
+	}
+	lock.Unlock()
+
+	// A region without a visibility admits every client
+	if !admitsClient([]locationFilter{&Region{}}, "stranger", now) {
+		t.Errorf("admits: region without visibility refused a client")
+	}
+}
@@ -0,0 +1,10 @@
+-- Upgrade a database created before locations kept the timestamp sent by
+-- the client. Locations stored earlier were never corrected by a clock
+-- offset, so their raw timestamp is their stored timestamp.
+BEGIN TRANSACTION;
+
+ALTER TABLE v1.location_data ADD COLUMN IF NOT EXISTS raw_timestamp TIMESTAMP(6) WITHOUT TIME ZONE;
+UPDATE v1.location_data SET raw_timestamp = timestamp WHERE raw_timestamp IS NULL;
+ALTER TABLE v1.location_data ALTER COLUMN raw_timestamp SET NOT NULL;
+
+COMMIT;
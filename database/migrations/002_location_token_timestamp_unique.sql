@@ -0,0 +1,21 @@
+-- Upgrade a database created before each location was stored once per
+-- token and timestamp. Batches retried before then may have stored the
+-- same location more than once, so all but one copy of each is removed
+-- before the unique index is built.
+BEGIN TRANSACTION;
+
+-- No location is stored while the copies are removed
+LOCK TABLE v1.location_data IN SHARE ROW EXCLUSIVE MODE;
+
+DELETE FROM v1.location_data
+WHERE ctid IN (
+    SELECT ctid FROM (
+        SELECT ctid, row_number() OVER (PARTITION BY token_uuid, timestamp ORDER BY ctid) AS copy
+        FROM v1.location_data
+    ) copies
+    WHERE copy > 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS location_data_token_timestamp_idx ON v1.location_data (token_uuid, timestamp);
+
+COMMIT;
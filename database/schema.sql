@@ -18,9 +18,116 @@ CREATE TABLE v1.location_data
     lat FLOAT(8) NOT NULL,
     lng FLOAT(8) NOT NULL,
     alt REAL NOT NULL,
-    timestamp TIMESTAMP WITHOUT TIME ZONE NOT NULL
+    -- Microsecond precision holds the millisecond timestamps of version 2 clients
+    timestamp TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+    -- The timestamp as sent by the client, before clock offset correction.
+    -- Existing databases are upgraded by migrations/001_location_raw_timestamp.sql
+    raw_timestamp TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
 );
 
+CREATE INDEX location_data_timestamp_idx ON v1.location_data (timestamp);
+-- A location is stored once however often a batch of locations is retried.
+-- Existing databases are upgraded by migrations/002_location_token_timestamp_unique.sql
+CREATE UNIQUE INDEX location_data_token_timestamp_idx ON v1.location_data (token_uuid, timestamp);
+CREATE INDEX location_data_lat_lng_idx ON v1.location_data (lat, lng);
+
+-- The groups of which each client is a member.
+CREATE TABLE v1.group_member
+(
+    client_uuid UUID NOT NULL,
+    group_id TEXT NOT NULL,
+    -- 'member' or 'organiser'. Organisers may make announcements.
+    role TEXT NOT NULL DEFAULT 'member',
+    PRIMARY KEY (client_uuid, group_id)
+);
+
+-- Clients that have consented to being followed by another client.
+CREATE TABLE v1.follow_consent
+(
+    client_uuid UUID NOT NULL,
+    follower_uuid UUID NOT NULL,
+    created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    PRIMARY KEY (client_uuid, follower_uuid)
+);
+
+-- Clients whose messages another client does not receive.
+CREATE TABLE v1.message_block
+(
+    client_uuid UUID NOT NULL,
+    blocked_uuid UUID NOT NULL,
+    created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    PRIMARY KEY (client_uuid, blocked_uuid)
+);
+
+-- Beacons judged implausible, such as impossible speeds or replayed tracks.
+CREATE TABLE v1.plausibility_flag
+(
+    client_uuid UUID NOT NULL,
+    token_uuid UUID NOT NULL,
+    type TEXT NOT NULL,
+    detail TEXT NOT NULL,
+    score REAL NOT NULL,
+    created TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX plausibility_flag_client_idx ON v1.plausibility_flag (client_uuid, created);
+
+-- The latest trust score of each client that has been flagged.
+CREATE TABLE v1.client_trust
+(
+    client_uuid UUID NOT NULL PRIMARY KEY,
+    score REAL NOT NULL,
+    flagged BOOLEAN NOT NULL,
+    updated TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+-- The messages sent to each group, kept as the group's history.
+CREATE TABLE v1.message
+(
+    id UUID NOT NULL PRIMARY KEY,
+    group_id TEXT NOT NULL,
+    sender_uuid UUID NOT NULL,
+    kind TEXT NOT NULL,
+    text TEXT NOT NULL,
+    data JSONB,
+    created TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX message_group_idx ON v1.message (group_id, created, id);
+
+-- The SOS alerts raised by clients, with their latest state.
+CREATE TABLE v1.sos_alert
+(
+    id UUID NOT NULL PRIMARY KEY,
+    client_uuid UUID NOT NULL,
+    token_uuid UUID NOT NULL,
+    lat FLOAT(8) NOT NULL,
+    lng FLOAT(8) NOT NULL,
+    text TEXT NOT NULL,
+    -- 'active', 'acknowledged', 'cancelled' or 'expired'
+    state TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    created TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+    updated TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX sos_alert_client_idx ON v1.sos_alert (client_uuid, created);
+
+-- The clients that acknowledged each SOS alert.
+CREATE TABLE v1.sos_ack
+(
+    alert_id UUID NOT NULL REFERENCES v1.sos_alert ON DELETE CASCADE,
+    client_uuid UUID NOT NULL,
+    created TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+    PRIMARY KEY (alert_id, client_uuid)
+);
+
+-- The group members eligible for group leaderboards, excluding flagged clients.
+CREATE VIEW v1.leaderboard_member AS
+SELECT g.client_uuid, g.group_id FROM v1.group_member g
+LEFT JOIN v1.client_trust t ON t.client_uuid = g.client_uuid
+WHERE t.flagged IS NOT TRUE;
+
 -- Permissions
 GRANT USAGE ON SCHEMA v1 TO data_producer;
 GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA v1 TO data_producer;
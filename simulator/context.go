@@ -5,6 +5,7 @@ import (
   "encoding/json"
   "time"
 
+  "github.com/golang/geo/s2"
   "github.com/google/uuid"
 )
 
@@ -133,7 +134,52 @@ func (ctx *SimulatorContext) SubscribeToCell(conn core.Connection, cell *core.Ce
 //
 func (ctx *SimulatorContext) SubscribeToGroup(conn core.Connection, groupId string) error {
 
-    return ctx.t.SubscribeToGroup(conn, groupId, true)  // unsubscribe first
+    return ctx.t.SubscribeToGroup(conn, groupId)
+}
+
+//
+// Subscribe the connection 'conn' to the region 'region'.
+//
+func (ctx *SimulatorContext) SubscribeToRegion(conn core.Connection, region *core.Region) error {
+
+    return ctx.t.SubscribeToRegion(conn, region)
+}
+
+//
+// All simulated clients may be followed.
+//
+func (ctx *SimulatorContext) CanFollow(entity *core.Entity, clientId core.ClientID) bool {
+
+    return true
+}
+
+//
+// Every simulated entity is a member of every group.
+//
+func (ctx *SimulatorContext) CheckGroupMember(entity *core.Entity, groupId string) error {
+
+    return nil
+}
+
+//
+// Return the client ids of 'clientIds' visible to the entity 'entity'.
+// Every simulated client is visible.
+//
+func (ctx *SimulatorContext) VisibleClients(entity *core.Entity, clientIds []string) map[string]bool {
+
+    visible := make(map[string]bool, len(clientIds))
+    for _, clientId := range clientIds {
+        visible[clientId] = true
+    }
+    return visible
+}
+
+//
+// Subscribe the connection 'conn' to the updates of the client 'clientId'.
+//
+func (ctx *SimulatorContext) SubscribeToEntity(conn core.Connection, clientId core.ClientID) error {
+
+    return ctx.t.SubscribeToEntity(conn, clientId)
 }
 
 //
@@ -144,6 +190,18 @@ func (ctx *SimulatorContext) UnsubscribeFromGroups(conn core.Connection) error {
     return ctx.t.UnsubscribeFromGroups(conn)
 }
 
+//
+// Unsubscribe the connection 'conn' from the filter 'filter' only
+//
+func (ctx *SimulatorContext) UnsubscribeFromFilter(conn core.Connection, filter *core.UserFilter) error {
+
+    if filter.Type == "local" {
+        delete(ctx.peers, conn.GetEntity())
+    }
+
+    return ctx.t.UnsubscribeFromFilter(conn, filter)
+}
+
 //
 // Unsubscribe the connection from all its channels/cells
 //
@@ -190,6 +248,53 @@ func (ctx *SimulatorContext) Broadcast(entity *core.Entity, message []byte) erro
     return nil
 }
 
+//
+// Record the plausibility flag raised against the entity
+//
+func (ctx *SimulatorContext) RecordFlag(entity *core.Entity, flag core.PlausibilityFlag) error {
+	return nil
+}
+
+//
+// Store the locations of the entity, which the simulator does not keep
+//
+func (ctx *SimulatorContext) RecordLocations(entity *core.Entity, locs []core.Location) error {
+	return nil
+}
+
+//
+// Send the message of the entity, without checking group membership
+//
+func (ctx *SimulatorContext) SendMessage(entity *core.Entity, msg *core.ChatMessage) error {
+
+    js, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    return ctx.t.PublishMessage(entity, msg.To, js)
+}
+
+//
+// Get the message history of a group, which the simulator does not keep
+//
+func (ctx *SimulatorContext) GetMessages(entity *core.Entity, groupId string, before string, limit int) ([]core.ChatMessage, error) {
+	return []core.ChatMessage{}, nil
+}
+
+//
+// Write the SOS alert of the entity to the entities around it and its followers
+//
+func (ctx *SimulatorContext) BroadcastSOS(entity *core.Entity, alert *core.SOSAlert, message []byte) error {
+	return ctx.t.PublishSOS(entity, []string{}, message)
+}
+
+//
+// Record the acknowledgement of the SOS alert, which the simulator does not keep
+//
+func (ctx *SimulatorContext) RecordSOSAck(entity *core.Entity, alert *core.SOSAlert) error {
+	return nil
+}
+
 func (ctx *SimulatorContext) GetClientID(tokenId core.TokenID) (core.ClientID, error) {
 	return ctx.t.GetClientID(tokenId)
 }
@@ -199,3 +304,9 @@ func (ctx *SimulatorContext) GetData(tokenId core.TokenID) (core.Activity, error
     // TODO:
     return ctx.activity, nil
 }
+
+func (ctx *SimulatorContext) GetLocations(bound s2.Rect, from time.Time, to time.Time, groupId string) ([]core.Location, error) {
+
+    // TODO:
+    return []core.Location{}, nil
+}
@@ -13,7 +13,7 @@ import (
 
 var reconnect time.Duration = 10
 
-func marshalData(data *bytes.Buffer) string {
+func marshalData(data *bytes.Buffer, version uint8) string {
 	// Read how many locations we have
 	var num uint32
 	binary.Read(data, binary.BigEndian, &num)
@@ -24,7 +24,7 @@ func marshalData(data *bytes.Buffer) string {
 	var s string
 	for i := 0; i < number; i++ {
 		loc := core.Location{}
-		core.Deserialize(&loc, data)
+		core.DeserializeVersion(&loc, data, version)
 		js, _ := json.Marshal(&loc)
 		s += string(js) + "\n"
 	}
@@ -51,7 +51,7 @@ func main() {
 				break
 			}
 
-			sd := marshalData(dataMsg.Data)
+			sd := marshalData(dataMsg.Data, dataMsg.Hdr.Version)
 			fmt.Printf("DATA RECEIVED: \n%s\n", sd)
 		}
 